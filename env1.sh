@@ -11,3 +11,29 @@ ISUCON_MATCHING_INTERVAL=0.5
 
 APP_RETRY_AFTER_MS=500
 CHAIR_RETRY_AFTER_MS=500
+
+# Webhook を内部のアドレスにも送ってよいネットワーク (CIDR のカンマ区切り)。未設定なら外部のアドレスにだけ送る
+# ISUCON_WEBHOOK_ALLOWED_NETWORKS=127.0.0.0/8
+
+# 通知の中継方法 (inprocess / mysql)。複数台で SSE を受ける場合は mysql にする
+# mysql なら椅子の生存確認も chair_liveness を通して共有する
+# ライドの状態のキャッシュはノードごとなので、同じライドのユーザーと椅子のリクエストは同じノードで受ける
+ISUCON_NOTIFICATION_BUS=inprocess
+
+# サービス地域はゾーンで決める。ゾーンが1つもないときだけ使う範囲 (最小緯度,最小経度,最大緯度,最大経度)
+# 未設定でゾーンも無ければどこでも受け付ける
+# ISUCON_SERVICE_AREA=-1000,-1000,1000,1000
+# 椅子の速度から求めた移動距離の何倍までを許すか。未設定か 0 なら瞬間移動を検出しない
+# ISUCON_TELEPORT_TOLERANCE=10
+# 乗車地・目的地に着いたとみなす距離。0 なら座標が一致したときだけ
+ISUCON_ARRIVAL_RADIUS=0
+# ゾーンの設定ファイル (JSON)。未設定なら zones テーブルから読む
+# ISUCON_ZONES_FILE=/home/isucon/zones.json
+# 椅子の稼働時間を解釈するタイムゾーン
+ISUCON_SCHEDULE_TZ=Asia/Tokyo
+# 座標も通知の接続も途絶えてからオフラインとみなすまでの時間 (ミリ秒)
+ISUCON_CHAIR_LIVENESS_TIMEOUT_MS=60000
+# 迎車の走行距離 1 あたりに売上へ上乗せしてオーナーへ支払う額。未設定なら売上だけを支払う
+# ISUCON_PICKUP_PAYOUT_PER_DISTANCE=10
+# 電池が満タンのときに椅子が走れる距離。椅子の仕様に合わせて設定する。未設定なら電池残量で走れる距離を制限しない
+# ISUCON_CHAIR_FULL_BATTERY_RANGE=1000
@@ -0,0 +1,481 @@
+package main
+
+import (
+	"errors"
+	"net/http"
+	"sort"
+	"time"
+
+	"github.com/go-sql-driver/mysql"
+	"github.com/jmoiron/sqlx"
+)
+
+var adminAccessToken string
+
+// MySQL の重複キーのエラー番号
+const mysqlErrDuplicateEntry = 1062
+
+func isDuplicateEntryError(err error) bool {
+	var mysqlErr *mysql.MySQLError
+	return errors.As(err, &mysqlErr) && mysqlErr.Number == mysqlErrDuplicateEntry
+}
+
+type adminCampaign struct {
+	Code         string `json:"code"`
+	DiscountType string `json:"discount_type"`
+	Discount     int    `json:"discount"`
+	MaxDiscount  *int   `json:"max_discount"`
+	MinFare      *int   `json:"min_fare"`
+	ExpiresAt    *int64 `json:"expires_at"`
+	MaxUses      *int   `json:"max_uses"`
+	Eligibility  string `json:"eligibility"`
+	IssuedCount  int    `json:"issued_count"`
+	UsedCount    int    `json:"used_count"`
+	CreatedAt    int64  `json:"created_at"`
+}
+
+func newAdminCampaign(campaign *CouponCampaign, issued, used int) adminCampaign {
+	c := adminCampaign{
+		Code:         campaign.Code,
+		DiscountType: campaign.DiscountType,
+		Discount:     campaign.Discount,
+		MaxDiscount:  campaign.MaxDiscount,
+		MinFare:      campaign.MinFare,
+		MaxUses:      campaign.MaxUses,
+		Eligibility:  campaign.Eligibility,
+		IssuedCount:  issued,
+		UsedCount:    used,
+		CreatedAt:    campaign.CreatedAt.UnixMilli(),
+	}
+	if campaign.ExpiresAt != nil {
+		t := campaign.ExpiresAt.UnixMilli()
+		c.ExpiresAt = &t
+	}
+	return c
+}
+
+type adminPostCampaignsRequest struct {
+	Code         string `json:"code"`
+	DiscountType string `json:"discount_type"`
+	Discount     int    `json:"discount"`
+	MaxDiscount  *int   `json:"max_discount"`
+	MinFare      *int   `json:"min_fare"`
+	ExpiresAt    *int64 `json:"expires_at"`
+	MaxUses      *int   `json:"max_uses"`
+	Eligibility  string `json:"eligibility"`
+}
+
+func adminPostCampaigns(w http.ResponseWriter, r *http.Request) {
+	ctx := r.Context()
+	req := &adminPostCampaignsRequest{}
+	if err := bindJSON(r, req); err != nil {
+		writeError(w, http.StatusBadRequest, err)
+		return
+	}
+	if req.Code == "" || req.Discount <= 0 {
+		writeError(w, http.StatusBadRequest, errors.New("required fields(code, discount) are empty"))
+		return
+	}
+	if req.DiscountType == "" {
+		req.DiscountType = couponDiscountTypeAmount
+	}
+	switch req.DiscountType {
+	case couponDiscountTypeAmount:
+	case couponDiscountTypePercent:
+		if req.Discount > 100 {
+			writeError(w, http.StatusBadRequest, errors.New("percentage discount must be between 1 and 100"))
+			return
+		}
+	default:
+		writeError(w, http.StatusBadRequest, errors.New("invalid discount_type"))
+		return
+	}
+	if (req.MaxDiscount != nil && *req.MaxDiscount < 0) || (req.MinFare != nil && *req.MinFare < 0) {
+		writeError(w, http.StatusBadRequest, errors.New("max_discount and min_fare must not be negative"))
+		return
+	}
+	if req.MaxUses != nil && *req.MaxUses < 0 {
+		writeError(w, http.StatusBadRequest, errors.New("max_uses must not be negative"))
+		return
+	}
+	if req.Eligibility == "" {
+		req.Eligibility = campaignEligibilityAll
+	}
+	switch req.Eligibility {
+	case campaignEligibilityAll, campaignEligibilityNewUsers, campaignEligibilityExistingUsers:
+	default:
+		writeError(w, http.StatusBadRequest, errors.New("invalid eligibility"))
+		return
+	}
+
+	now := time.Now().Truncate(time.Microsecond)
+	campaign := CouponCampaign{
+		Code:         req.Code,
+		DiscountType: req.DiscountType,
+		Discount:     req.Discount,
+		MaxDiscount:  req.MaxDiscount,
+		MinFare:      req.MinFare,
+		MaxUses:      req.MaxUses,
+		Eligibility:  req.Eligibility,
+		CreatedAt:    now,
+	}
+	if req.ExpiresAt != nil {
+		t := time.UnixMilli(*req.ExpiresAt)
+		campaign.ExpiresAt = &t
+	}
+
+	if _, found := getCouponCampaignFromCache(campaign.Code); found {
+		writeError(w, http.StatusConflict, errors.New("campaign already exists"))
+		return
+	}
+
+	if _, err := db.NamedExecContext(
+		ctx,
+		`INSERT INTO coupon_campaigns (code, discount_type, discount, max_discount, min_fare, expires_at, max_uses, eligibility, created_at)
+		VALUES (:code, :discount_type, :discount, :max_discount, :min_fare, :expires_at, :max_uses, :eligibility, :created_at)`,
+		campaign,
+	); err != nil {
+		// 他のノードで作られたキャンペーンはキャッシュに無いので、一意制約で検出する
+		if isDuplicateEntryError(err) {
+			writeError(w, http.StatusConflict, errors.New("campaign already exists"))
+			return
+		}
+		writeError(w, http.StatusInternalServerError, err)
+		return
+	}
+	insertCouponCampaignCacheMap(campaign)
+	publishCacheReloadToBus("coupon_campaigns")
+
+	writeJSON(w, http.StatusCreated, newAdminCampaign(&campaign, 0, 0))
+}
+
+type adminGetCampaignsResponse struct {
+	Campaigns []adminCampaign `json:"campaigns"`
+}
+
+func adminGetCampaigns(w http.ResponseWriter, r *http.Request) {
+	ctx := r.Context()
+
+	campaigns := []*CouponCampaign{}
+	if err := db.SelectContext(ctx, &campaigns, "SELECT * FROM coupon_campaigns ORDER BY created_at"); err != nil {
+		writeError(w, http.StatusInternalServerError, err)
+		return
+	}
+
+	type couponCount struct {
+		CampaignCode string `db:"campaign_code"`
+		Issued       int    `db:"issued"`
+		Used         int    `db:"used"`
+	}
+	counts := []couponCount{}
+	if err := db.SelectContext(ctx, &counts, "SELECT campaign_code, COUNT(*) AS issued, COUNT(used_by) AS used FROM coupons WHERE campaign_code IS NOT NULL GROUP BY campaign_code"); err != nil {
+		writeError(w, http.StatusInternalServerError, err)
+		return
+	}
+	countsByCode := map[string]couponCount{}
+	for _, c := range counts {
+		countsByCode[c.CampaignCode] = c
+	}
+
+	res := adminGetCampaignsResponse{Campaigns: []adminCampaign{}}
+	for _, campaign := range campaigns {
+		c := countsByCode[campaign.Code]
+		res.Campaigns = append(res.Campaigns, newAdminCampaign(campaign, c.Issued, c.Used))
+	}
+	writeJSON(w, http.StatusOK, res)
+}
+
+type adminPostCampaignCouponsRequest struct {
+	UserIDs  []string `json:"user_ids"`
+	AllUsers bool     `json:"all_users"`
+}
+
+type adminPostCampaignCouponsResponse struct {
+	Issued int `json:"issued"`
+}
+
+const couponBulkInsertSize = 1000
+
+func adminPostCampaignCoupons(w http.ResponseWriter, r *http.Request) {
+	ctx := r.Context()
+	code := r.PathValue("campaign_code")
+
+	req := &adminPostCampaignCouponsRequest{}
+	if err := bindJSON(r, req); err != nil {
+		writeError(w, http.StatusBadRequest, err)
+		return
+	}
+	if !req.AllUsers && len(req.UserIDs) == 0 {
+		writeError(w, http.StatusBadRequest, errors.New("either user_ids or all_users is required"))
+		return
+	}
+
+	tx, err := db.Beginx()
+	if err != nil {
+		writeError(w, http.StatusInternalServerError, err)
+		return
+	}
+	defer tx.Rollback()
+
+	campaign, err := getCouponCampaignForUpdate(ctx, tx, code)
+	if err != nil {
+		if errors.Is(err, errCampaignNotFound) {
+			writeError(w, http.StatusNotFound, err)
+			return
+		}
+		writeError(w, http.StatusInternalServerError, err)
+		return
+	}
+	if campaign.isExpired(time.Now()) {
+		writeError(w, http.StatusBadRequest, errors.New("campaign has expired"))
+		return
+	}
+
+	// 既に同じキャンペーンのクーポンを持っているユーザーには発行しない
+	query := "SELECT id FROM users WHERE id NOT IN (SELECT user_id FROM coupons WHERE code = ?)"
+	args := []interface{}{campaign.Code}
+	switch campaign.Eligibility {
+	case campaignEligibilityNewUsers:
+		query += " AND NOT EXISTS (SELECT 1 FROM rides WHERE rides.user_id = users.id)"
+	case campaignEligibilityExistingUsers:
+		query += " AND EXISTS (SELECT 1 FROM rides WHERE rides.user_id = users.id)"
+	}
+	if !req.AllUsers {
+		query += " AND id IN (?)"
+		args = append(args, req.UserIDs)
+	}
+	query += " ORDER BY id"
+	query, args, err = sqlx.In(query, args...)
+	if err != nil {
+		writeError(w, http.StatusInternalServerError, err)
+		return
+	}
+
+	userIDs := []string{}
+	if err := tx.SelectContext(ctx, &userIDs, tx.Rebind(query), args...); err != nil {
+		writeError(w, http.StatusInternalServerError, err)
+		return
+	}
+
+	if campaign.MaxUses != nil {
+		issued := 0
+		if err := tx.GetContext(ctx, &issued, "SELECT COUNT(*) FROM coupons WHERE campaign_code = ?", campaign.Code); err != nil {
+			writeError(w, http.StatusInternalServerError, err)
+			return
+		}
+		remaining := max(*campaign.MaxUses-issued, 0)
+		if len(userIDs) > remaining {
+			userIDs = userIDs[:remaining]
+		}
+	}
+
+	coupons := make([]Coupon, 0, len(userIDs))
+	for _, userID := range userIDs {
+		coupons = append(coupons, campaign.newCoupon(userID, campaign.Code))
+	}
+
+	for start := 0; start < len(coupons); start += couponBulkInsertSize {
+		end := min(start+couponBulkInsertSize, len(coupons))
+		if _, err := tx.NamedExecContext(ctx, insertCouponQuery, coupons[start:end]); err != nil {
+			writeError(w, http.StatusInternalServerError, err)
+			return
+		}
+	}
+
+	if err := tx.Commit(); err != nil {
+		writeError(w, http.StatusInternalServerError, err)
+		return
+	}
+	insertCouponCache(coupons...)
+
+	writeJSON(w, http.StatusOK, &adminPostCampaignCouponsResponse{
+		Issued: len(coupons),
+	})
+}
+
+type adminPostReferralTiersRequest struct {
+	Tier                string `json:"tier"`
+	MaxReferrals        int    `json:"max_referrals"`
+	InviteeCampaignCode string `json:"invitee_campaign_code"`
+	InviterCampaignCode string `json:"inviter_campaign_code"`
+}
+
+func adminPostReferralTiers(w http.ResponseWriter, r *http.Request) {
+	ctx := r.Context()
+	req := &adminPostReferralTiersRequest{}
+	if err := bindJSON(r, req); err != nil {
+		writeError(w, http.StatusBadRequest, err)
+		return
+	}
+	if req.Tier == "" || req.InviteeCampaignCode == "" || req.InviterCampaignCode == "" {
+		writeError(w, http.StatusBadRequest, errors.New("required fields(tier, invitee_campaign_code, inviter_campaign_code) are empty"))
+		return
+	}
+	if req.MaxReferrals < 0 {
+		writeError(w, http.StatusBadRequest, errors.New("max_referrals must not be negative"))
+		return
+	}
+	for _, code := range []string{req.InviteeCampaignCode, req.InviterCampaignCode} {
+		if _, found := getCouponCampaignFromCache(code); !found {
+			writeError(w, http.StatusBadRequest, errCampaignNotFound)
+			return
+		}
+	}
+
+	tier := ReferralTier{
+		Tier:                req.Tier,
+		MaxReferrals:        req.MaxReferrals,
+		InviteeCampaignCode: req.InviteeCampaignCode,
+		InviterCampaignCode: req.InviterCampaignCode,
+	}
+	if _, err := db.NamedExecContext(
+		ctx,
+		`INSERT INTO referral_tiers (tier, max_referrals, invitee_campaign_code, inviter_campaign_code)
+		VALUES (:tier, :max_referrals, :invitee_campaign_code, :inviter_campaign_code)
+		ON DUPLICATE KEY UPDATE max_referrals = VALUES(max_referrals), invitee_campaign_code = VALUES(invitee_campaign_code), inviter_campaign_code = VALUES(inviter_campaign_code)`,
+		tier,
+	); err != nil {
+		writeError(w, http.StatusInternalServerError, err)
+		return
+	}
+	upsertReferralTierCacheMap(tier)
+
+	writeJSON(w, http.StatusOK, req)
+}
+
+type adminPostUserTierRequest struct {
+	Tier string `json:"tier"`
+}
+
+func adminPostUserTier(w http.ResponseWriter, r *http.Request) {
+	ctx := r.Context()
+	userID := r.PathValue("user_id")
+
+	req := &adminPostUserTierRequest{}
+	if err := bindJSON(r, req); err != nil {
+		writeError(w, http.StatusBadRequest, err)
+		return
+	}
+	if req.Tier == "" {
+		writeError(w, http.StatusBadRequest, errors.New("required fields(tier) are empty"))
+		return
+	}
+
+	result, err := db.ExecContext(ctx, "UPDATE users SET tier = ? WHERE id = ?", req.Tier, userID)
+	if err != nil {
+		writeError(w, http.StatusInternalServerError, err)
+		return
+	}
+	if count, err := result.RowsAffected(); err != nil {
+		writeError(w, http.StatusInternalServerError, err)
+		return
+	} else if count == 0 {
+		if _, found := getUserByIDFromCache(userID); !found {
+			writeError(w, http.StatusNotFound, errors.New("user not found"))
+			return
+		}
+	}
+	updateUserTierInCache(userID, req.Tier)
+
+	w.WriteHeader(http.StatusNoContent)
+}
+
+type adminGetNotificationStatsResponse struct {
+	App   notificationStatsResponse `json:"app"`
+	Chair notificationStatsResponse `json:"chair"`
+	// 他のノードに送れずに捨てた通知の数
+	BusDropped int64 `json:"bus_dropped"`
+}
+
+func adminGetNotificationStats(w http.ResponseWriter, r *http.Request) {
+	writeJSON(w, http.StatusOK, &adminGetNotificationStatsResponse{
+		App:        appNotificationStreams.statsResponse(),
+		Chair:      chairNotificationStreams.statsResponse(),
+		BusDropped: notificationBusDropped.Load(),
+	})
+}
+
+type adminFlaggedChair struct {
+	ChairID    string     `json:"chair_id"`
+	Reason     string     `json:"reason"`
+	Coordinate Coordinate `json:"coordinate"`
+	Distance   int        `json:"distance"`
+	ElapsedMs  int64      `json:"elapsed_ms"`
+	FlaggedAt  int64      `json:"flagged_at"`
+}
+
+type adminGetFlaggedChairsResponse struct {
+	Chairs []adminFlaggedChair `json:"chairs"`
+}
+
+func adminGetFlaggedChairs(w http.ResponseWriter, r *http.Request) {
+	flags := getChairFlagsFromCache()
+	sort.Slice(flags, func(i, j int) bool {
+		return flags[i].CreatedAt.After(flags[j].CreatedAt)
+	})
+
+	res := adminGetFlaggedChairsResponse{Chairs: make([]adminFlaggedChair, 0, len(flags))}
+	for _, flag := range flags {
+		res.Chairs = append(res.Chairs, adminFlaggedChair{
+			ChairID:    flag.ChairID,
+			Reason:     flag.Reason,
+			Coordinate: Coordinate{Latitude: flag.Latitude, Longitude: flag.Longitude},
+			Distance:   flag.Distance,
+			ElapsedMs:  flag.ElapsedMs,
+			FlaggedAt:  flag.CreatedAt.UnixMilli(),
+		})
+	}
+	writeJSON(w, http.StatusOK, res)
+}
+
+// adminDeleteFlaggedChair は確認の済んだ椅子の印を外し、再びマッチングの対象にする
+func adminDeleteFlaggedChair(w http.ResponseWriter, r *http.Request) {
+	ctx := r.Context()
+	chairID := r.PathValue("chair_id")
+
+	found, err := unflagChair(ctx, chairID)
+	if err != nil {
+		writeError(w, http.StatusInternalServerError, err)
+		return
+	}
+	if !found {
+		writeError(w, http.StatusNotFound, errors.New("flagged chair not found"))
+		return
+	}
+
+	w.WriteHeader(http.StatusNoContent)
+}
+
+type adminGetZonesResponse struct {
+	Zones []zoneConfig `json:"zones"`
+}
+
+func adminGetZones(w http.ResponseWriter, r *http.Request) {
+	writeJSON(w, http.StatusOK, &adminGetZonesResponse{Zones: getZonesFromCache()})
+}
+
+// adminPostZones はゾーンを追加する。同じ ID のゾーンがあれば置き換える
+func adminPostZones(w http.ResponseWriter, r *http.Request) {
+	ctx := r.Context()
+	if zonesFile != "" {
+		writeError(w, http.StatusConflict, errors.New("zones are loaded from a file"))
+		return
+	}
+
+	req := &zoneConfig{}
+	if err := bindJSON(r, req); err != nil {
+		writeError(w, http.StatusBadRequest, err)
+		return
+	}
+	if err := req.validate(); err != nil {
+		writeError(w, http.StatusBadRequest, err)
+		return
+	}
+
+	if err := upsertZone(ctx, *req); err != nil {
+		writeError(w, http.StatusInternalServerError, err)
+		return
+	}
+
+	writeJSON(w, http.StatusCreated, req)
+}
@@ -9,10 +9,8 @@ import (
 	"log/slog"
 	"net/http"
 	"strconv"
-	"sync"
 	"time"
 
-	"github.com/jmoiron/sqlx"
 	"github.com/oklog/ulid/v2"
 )
 
@@ -61,6 +59,7 @@ func appPostUsers(w http.ResponseWriter, r *http.Request) {
 		DateOfBirth:    req.DateOfBirth,
 		AccessToken:    accessToken,
 		InvitationCode: invitationCode,
+		Tier:           defaultReferralTier,
 		CreatedAt:      now,
 		UpdatedAt:      now,
 	}
@@ -78,16 +77,16 @@ func appPostUsers(w http.ResponseWriter, r *http.Request) {
 	insertUserMapCache(newUser)
 
 	// 初回登録キャンペーンのクーポンを付与
-	_, err = tx.ExecContext(
-		ctx,
-		"INSERT INTO coupons (user_id, code, discount) VALUES (?, ?, ?)",
-		userID, "CP_NEW2024", 3000,
-	)
+	issuedCoupons := []Coupon{}
+	coupon, err := issueCampaignCoupon(ctx, tx, newUserCampaignCode, userID, newUserCampaignCode)
 	if err != nil {
 		writeError(w, http.StatusInternalServerError, err)
 		slog.Error("2", "error", err)
 		return
 	}
+	if coupon != nil {
+		issuedCoupons = append(issuedCoupons, *coupon)
+	}
 
 	// 招待コードを使った登録
 	if req.InvitationCode != nil && *req.InvitationCode != "" {
@@ -105,42 +104,19 @@ func appPostUsers(w http.ResponseWriter, r *http.Request) {
 			return
 		}
 
-		// 招待する側の招待数をチェック
-		var coupons []Coupon
-		err = tx.SelectContext(ctx, &coupons, "SELECT * FROM coupons WHERE code = ? LIMIT 4 FOR UPDATE", "INV_"+*req.InvitationCode)
-		if err != nil {
-			writeError(w, http.StatusInternalServerError, err)
-			slog.Error("5", "error", err)
-			return
-		}
-		if len(coupons) >= 3 {
-			writeError(w, http.StatusBadRequest, errors.New("この招待コードは使用できません。"))
-			slog.Error("6", "error", err)
-			return
-		}
-
-		// 招待クーポン付与
-		_, err = tx.ExecContext(
-			ctx,
-			"INSERT INTO coupons (user_id, code, discount) VALUES (?, ?, ?)",
-			userID, "INV_"+*req.InvitationCode, 1500,
-		)
+		// 招待する側の招待数をチェックして、双方にクーポンを付与
+		referralCoupons, err := registerReferral(ctx, tx, &inviter, userID)
 		if err != nil {
+			if errors.Is(err, errInvitationLimitReached) {
+				writeError(w, http.StatusBadRequest, errors.New("この招待コードは使用できません。"))
+				slog.Error("6", "error", err)
+				return
+			}
 			writeError(w, http.StatusInternalServerError, err)
 			slog.Error("7", "error", err)
 			return
 		}
-		// 招待した人にもRewardを付与
-		_, err = tx.ExecContext(
-			ctx,
-			"INSERT INTO coupons (user_id, code, discount) VALUES (?, CONCAT(?, '_', FLOOR(UNIX_TIMESTAMP(NOW(3))*1000)), ?)",
-			inviter.ID, "RWD_"+*req.InvitationCode, 1000,
-		)
-		if err != nil {
-			writeError(w, http.StatusInternalServerError, err)
-			slog.Error("8", "error", err)
-			return
-		}
+		issuedCoupons = append(issuedCoupons, referralCoupons...)
 	}
 
 	if err := tx.Commit(); err != nil {
@@ -148,6 +124,7 @@ func appPostUsers(w http.ResponseWriter, r *http.Request) {
 		slog.Error("9", "error", err)
 		return
 	}
+	insertCouponCache(issuedCoupons...)
 
 	http.SetCookie(w, &http.Cookie{
 		Path:  "/",
@@ -206,6 +183,7 @@ type getAppRidesResponseItem struct {
 	Evaluation            int                          `json:"evaluation"`
 	RequestedAt           int64                        `json:"requested_at"`
 	CompletedAt           int64                        `json:"completed_at"`
+	Metrics               *rideMetricsResponse         `json:"metrics,omitempty"`
 }
 
 type getAppRidesResponseItemChair struct {
@@ -237,6 +215,16 @@ func appGetRides(w http.ResponseWriter, r *http.Request) {
 		return
 	}
 
+	rideIDs := make([]string, 0, len(rides))
+	for _, ride := range rides {
+		rideIDs = append(rideIDs, ride.ID)
+	}
+	rideMetrics, err := getRideMetrics(ctx, rideIDs)
+	if err != nil {
+		writeError(w, http.StatusInternalServerError, err)
+		return
+	}
+
 	items := []getAppRidesResponseItem{}
 	for _, ride := range rides {
 		status, err := getLatestRideStatus(ctx, tx, ride.ID)
@@ -248,11 +236,7 @@ func appGetRides(w http.ResponseWriter, r *http.Request) {
 			continue
 		}
 
-		fare, err := calculateDiscountedFare(ctx, tx, user.ID, ride.ID, ride.PickupLatitude, ride.PickupLongitude, ride.DestinationLatitude, ride.DestinationLongitude)
-		if err != nil {
-			writeError(w, http.StatusInternalServerError, err)
-			return
-		}
+		fare := calculateDiscountedFare(&ride)
 
 		item := getAppRidesResponseItem{
 			ID:                    ride.ID,
@@ -264,6 +248,10 @@ func appGetRides(w http.ResponseWriter, r *http.Request) {
 			CompletedAt:           ride.UpdatedAt.UnixMilli(),
 		}
 
+		if metrics, ok := rideMetrics[ride.ID]; ok {
+			item.Metrics = metrics.response()
+		}
+
 		item.Chair = getAppRidesResponseItemChair{}
 
 		chair := &Chair{}
@@ -298,11 +286,14 @@ func appGetRides(w http.ResponseWriter, r *http.Request) {
 type appPostRidesRequest struct {
 	PickupCoordinate      *Coordinate `json:"pickup_coordinate"`
 	DestinationCoordinate *Coordinate `json:"destination_coordinate"`
+	// 未指定なら最もお得なクーポン、空文字ならクーポンを使わない
+	CouponCode *string `json:"coupon_code"`
 }
 
 type appPostRidesResponse struct {
-	RideID string `json:"ride_id"`
-	Fare   int    `json:"fare"`
+	RideID     string  `json:"ride_id"`
+	Fare       int     `json:"fare"`
+	CouponCode *string `json:"coupon_code,omitempty"`
 }
 
 type executableGet interface {
@@ -318,42 +309,6 @@ func getLatestRideStatus(ctx context.Context, tx executableGet, rideID string) (
 	return status, nil
 }
 
-var rideIdToCouponMapRWMutex = sync.RWMutex{}
-var rideIdToCouponMap map[string]*Coupon = make(map[string]*Coupon)
-
-func loadRideIdToCouponMap() error {
-	rideIdToCouponMapRWMutex.Lock()
-	defer rideIdToCouponMapRWMutex.Unlock()
-
-	rideIdToCouponMap = make(map[string]*Coupon)
-	coupons := []Coupon{}
-	if err := db.Select(&coupons, "SELECT * FROM coupons WHERE used_by IS NOT NULL"); err != nil {
-		return err
-	}
-
-	for _, coupon := range coupons {
-		if coupon.UsedBy != nil {
-			rideIdToCouponMap[*coupon.UsedBy] = &coupon
-		}
-	}
-	return nil
-}
-
-func updateRideIdToCouponMap(rideID string, coupon *Coupon) {
-	rideIdToCouponMapRWMutex.Lock()
-	defer rideIdToCouponMapRWMutex.Unlock()
-
-	rideIdToCouponMap[rideID] = coupon
-}
-
-func getRideIdToCouponMap(rideID string) (*Coupon, bool) {
-	rideIdToCouponMapRWMutex.RLock()
-	defer rideIdToCouponMapRWMutex.RUnlock()
-
-	coupon, ok := rideIdToCouponMap[rideID]
-	return coupon, ok
-}
-
 func appPostRides(w http.ResponseWriter, r *http.Request) {
 	ctx := r.Context()
 	req := &appPostRidesRequest{}
@@ -366,6 +321,12 @@ func appPostRides(w http.ResponseWriter, r *http.Request) {
 		return
 	}
 
+	pickupZoneID, destinationZoneID, err := rideZoneIDs(*req.PickupCoordinate, *req.DestinationCoordinate)
+	if err != nil {
+		writeError(w, http.StatusBadRequest, err)
+		return
+	}
+
 	user := ctx.Value("user").(*User)
 	rideID := ulid.Make().String()
 
@@ -389,6 +350,25 @@ func appPostRides(w http.ResponseWriter, r *http.Request) {
 	}
 
 	now := time.Now().Truncate(time.Microsecond)
+
+	// クーポンはライドを作る前にロックして検証する
+	coupons, err := selectAvailableCoupons(ctx, tx, user.ID, true)
+	if err != nil {
+		writeError(w, http.StatusInternalServerError, err)
+		return
+	}
+	baseFare, perDistance := fareRatesAt(req.PickupCoordinate.Latitude, req.PickupCoordinate.Longitude)
+	meteredFare := perDistance * calculateDistance(req.PickupCoordinate.Latitude, req.PickupCoordinate.Longitude, req.DestinationCoordinate.Latitude, req.DestinationCoordinate.Longitude)
+	usedCoupon, err := chooseCoupon(coupons, req.CouponCode, baseFare, meteredFare, now)
+	if err != nil {
+		if errors.Is(err, errCouponNotAvailable) {
+			writeError(w, http.StatusBadRequest, err)
+			return
+		}
+		writeError(w, http.StatusInternalServerError, err)
+		return
+	}
+
 	newRide := Ride{
 		ID:                   rideID,
 		UserID:               user.ID,
@@ -400,102 +380,39 @@ func appPostRides(w http.ResponseWriter, r *http.Request) {
 		Evaluation:           nil,
 		CreatedAt:            now,
 		UpdatedAt:            now,
+		PickupZoneID:         pickupZoneID,
+		DestinationZoneID:    destinationZoneID,
+		InitialFare:          &baseFare,
+		FarePerDistance:      &perDistance,
 	}
 	if _, err := tx.ExecContext(
 		ctx,
-		`INSERT INTO rides (id, user_id, pickup_latitude, pickup_longitude, destination_latitude, destination_longitude, created_at, updated_at)
-		VALUES (?, ?, ?, ?, ?, ?, ?, ?)`,
-		newRide.ID, newRide.UserID, newRide.PickupLatitude, newRide.PickupLongitude, newRide.DestinationLatitude, newRide.DestinationLongitude, newRide.CreatedAt, newRide.UpdatedAt,
+		`INSERT INTO rides (id, user_id, pickup_latitude, pickup_longitude, destination_latitude, destination_longitude, created_at, updated_at, pickup_zone_id, destination_zone_id, initial_fare, fare_per_distance)
+		VALUES (?, ?, ?, ?, ?, ?, ?, ?, ?, ?, ?, ?)`,
+		newRide.ID, newRide.UserID, newRide.PickupLatitude, newRide.PickupLongitude, newRide.DestinationLatitude, newRide.DestinationLongitude, newRide.CreatedAt, newRide.UpdatedAt, newRide.PickupZoneID, newRide.DestinationZoneID, newRide.InitialFare, newRide.FarePerDistance,
 	); err != nil {
 		writeError(w, http.StatusInternalServerError, err)
 		return
 	}
 	insertRideCacheMap(newRide)
 
-	if _, err := insertRideStatus(ctx, tx, rideID, "MATCHING"); err != nil {
-		writeError(w, http.StatusInternalServerError, err)
-		return
-	}
-
-	var rideCount int
-	if err := tx.GetContext(ctx, &rideCount, `SELECT COUNT(*) FROM rides WHERE user_id = ? `, user.ID); err != nil {
-		writeError(w, http.StatusInternalServerError, err)
-		return
-	}
-
-	var coupon Coupon
-	if rideCount == 1 {
-		// 初回利用で、初回利用クーポンがあれば必ず使う
-		if err := tx.GetContext(ctx, &coupon, "SELECT * FROM coupons WHERE user_id = ? AND code = 'CP_NEW2024' AND used_by IS NULL FOR UPDATE", user.ID); err != nil {
-			if !errors.Is(err, sql.ErrNoRows) {
-				writeError(w, http.StatusInternalServerError, err)
-				return
-			}
-
-			// 無ければ他のクーポンを付与された順番に使う
-			if err := tx.GetContext(ctx, &coupon, "SELECT * FROM coupons WHERE user_id = ? AND used_by IS NULL ORDER BY created_at LIMIT 1 FOR UPDATE", user.ID); err != nil {
-				if !errors.Is(err, sql.ErrNoRows) {
-					writeError(w, http.StatusInternalServerError, err)
-					return
-				}
-			} else {
-				if _, err := tx.ExecContext(
-					ctx,
-					"UPDATE coupons SET used_by = ? WHERE user_id = ? AND code = ?",
-					rideID, user.ID, coupon.Code,
-				); err != nil {
-					writeError(w, http.StatusInternalServerError, err)
-					return
-				}
-			}
-		} else {
-			if _, err := tx.ExecContext(
-				ctx,
-				"UPDATE coupons SET used_by = ? WHERE user_id = ? AND code = 'CP_NEW2024'",
-				rideID, user.ID,
-			); err != nil {
-				writeError(w, http.StatusInternalServerError, err)
-				return
-			}
-		}
-	} else {
-		// 他のクーポンを付与された順番に使う
-		if err := tx.GetContext(ctx, &coupon, "SELECT * FROM coupons WHERE user_id = ? AND used_by IS NULL ORDER BY created_at LIMIT 1 FOR UPDATE", user.ID); err != nil {
-			if !errors.Is(err, sql.ErrNoRows) {
-				writeError(w, http.StatusInternalServerError, err)
-				return
-			}
-		} else {
-			if _, err := tx.ExecContext(
-				ctx,
-				"UPDATE coupons SET used_by = ? WHERE user_id = ? AND code = ?",
-				rideID, user.ID, coupon.Code,
-			); err != nil {
-				writeError(w, http.StatusInternalServerError, err)
-				return
-			}
-		}
-	}
-
-	usedCoupon, err := func() (*Coupon, error) {
-		coupon := &Coupon{}
-		if err := tx.GetContext(ctx, coupon, "SELECT * FROM coupons WHERE used_by = ?", rideID); err != nil {
-			if errors.Is(err, sql.ErrNoRows) {
-				return nil, nil
-			} else {
-				writeError(w, http.StatusInternalServerError, err)
-				return nil, err
-			}
-		}
-		return coupon, nil
-	}()
+	_, rideStatusCommitted, err := insertRideStatus(ctx, tx, rideID, "MATCHING")
 	if err != nil {
 		writeError(w, http.StatusInternalServerError, err)
 		return
 	}
 
+	var usedCouponCode *string
 	if usedCoupon != nil {
-		updateRideIdToCouponMap(rideID, usedCoupon)
+		if _, err := tx.ExecContext(
+			ctx,
+			"UPDATE coupons SET used_by = ? WHERE user_id = ? AND code = ?",
+			rideID, user.ID, usedCoupon.Code,
+		); err != nil {
+			writeError(w, http.StatusInternalServerError, err)
+			return
+		}
+		usedCouponCode = &usedCoupon.Code
 	}
 
 	_, found := getRideByIDFromCache(rideID)
@@ -504,31 +421,35 @@ func appPostRides(w http.ResponseWriter, r *http.Request) {
 		return
 	}
 
-	fare, err := calculateDiscountedFare(ctx, tx, user.ID, rideID, req.PickupCoordinate.Latitude, req.PickupCoordinate.Longitude, req.DestinationCoordinate.Latitude, req.DestinationCoordinate.Longitude)
-	if err != nil {
-		writeError(w, http.StatusInternalServerError, err)
-		return
-	}
-
 	if err := tx.Commit(); err != nil {
 		writeError(w, http.StatusInternalServerError, err)
 		return
 	}
+	// 通知の運賃計算で使うので、通知を送る前にキャッシュのクーポンを使用済みにする
+	if usedCouponCode != nil {
+		markCouponUsedInCache(user.ID, *usedCouponCode, rideID)
+	}
+	fare := calculateDiscountedFare(&newRide)
+	rideStatusCommitted()
 
 	writeJSON(w, http.StatusAccepted, &appPostRidesResponse{
-		RideID: rideID,
-		Fare:   fare,
+		RideID:     rideID,
+		Fare:       fare,
+		CouponCode: usedCouponCode,
 	})
 }
 
 type appPostRidesEstimatedFareRequest struct {
 	PickupCoordinate      *Coordinate `json:"pickup_coordinate"`
 	DestinationCoordinate *Coordinate `json:"destination_coordinate"`
+	// 未指定なら最もお得なクーポン、空文字ならクーポンを使わない
+	CouponCode *string `json:"coupon_code"`
 }
 
 type appPostRidesEstimatedFareResponse struct {
-	Fare     int `json:"fare"`
-	Discount int `json:"discount"`
+	Fare       int     `json:"fare"`
+	Discount   int     `json:"discount"`
+	CouponCode *string `json:"coupon_code,omitempty"`
 }
 
 func appPostRidesEstimatedFare(w http.ResponseWriter, r *http.Request) {
@@ -543,30 +464,149 @@ func appPostRidesEstimatedFare(w http.ResponseWriter, r *http.Request) {
 		return
 	}
 
+	if _, _, err := rideZoneIDs(*req.PickupCoordinate, *req.DestinationCoordinate); err != nil {
+		writeError(w, http.StatusBadRequest, err)
+		return
+	}
+
 	user := ctx.Value("user").(*User)
 
-	tx, err := db.Beginx()
+	now := time.Now()
+	baseFare, perDistance := fareRatesAt(req.PickupCoordinate.Latitude, req.PickupCoordinate.Longitude)
+	meteredFare := perDistance * calculateDistance(req.PickupCoordinate.Latitude, req.PickupCoordinate.Longitude, req.DestinationCoordinate.Latitude, req.DestinationCoordinate.Longitude)
+	coupon, err := chooseCoupon(getAvailableCouponsFromCache(user.ID, now), req.CouponCode, baseFare, meteredFare, now)
 	if err != nil {
-		writeError(w, http.StatusInternalServerError, err)
+		writeError(w, http.StatusBadRequest, err)
 		return
 	}
-	defer tx.Rollback()
 
-	discounted, err := calculateDiscountedFare(ctx, tx, user.ID, "", req.PickupCoordinate.Latitude, req.PickupCoordinate.Longitude, req.DestinationCoordinate.Latitude, req.DestinationCoordinate.Longitude)
-	if err != nil {
-		writeError(w, http.StatusInternalServerError, err)
-		return
+	res := &appPostRidesEstimatedFareResponse{
+		Fare: baseFare + meteredFare,
 	}
+	if coupon != nil {
+		res.Discount = couponDiscountAmount(coupon, meteredFare)
+		res.Fare -= res.Discount
+		res.CouponCode = &coupon.Code
+	}
+	writeJSON(w, http.StatusOK, res)
+}
 
-	if err := tx.Commit(); err != nil {
+type appGetCouponsResponse struct {
+	Coupons []appGetCouponsResponseItem `json:"coupons"`
+}
+
+type appGetCouponsResponseItem struct {
+	Code         string  `json:"code"`
+	DiscountType string  `json:"discount_type"`
+	Discount     int     `json:"discount"`
+	MaxDiscount  *int    `json:"max_discount"`
+	MinFare      *int    `json:"min_fare"`
+	ExpiresAt    *int64  `json:"expires_at"`
+	Status       string  `json:"status"`
+	UsedBy       *string `json:"used_by"`
+	CreatedAt    int64   `json:"created_at"`
+}
+
+func appGetCoupons(w http.ResponseWriter, r *http.Request) {
+	ctx := r.Context()
+	user := ctx.Value("user").(*User)
+
+	coupons := getCouponsFromCache(user.ID)
+
+	now := time.Now()
+	items := []appGetCouponsResponseItem{}
+	for i := range coupons {
+		items = append(items, newAppGetCouponsResponseItem(&coupons[i], now))
+	}
+
+	writeJSON(w, http.StatusOK, &appGetCouponsResponse{
+		Coupons: items,
+	})
+}
+
+func newAppGetCouponsResponseItem(coupon *Coupon, now time.Time) appGetCouponsResponseItem {
+	item := appGetCouponsResponseItem{
+		Code:         coupon.Code,
+		DiscountType: coupon.DiscountType,
+		Discount:     coupon.Discount,
+		MaxDiscount:  coupon.MaxDiscount,
+		MinFare:      coupon.MinFare,
+		Status:       "AVAILABLE",
+		UsedBy:       coupon.UsedBy,
+		CreatedAt:    coupon.CreatedAt.UnixMilli(),
+	}
+	if coupon.ExpiresAt != nil {
+		t := coupon.ExpiresAt.UnixMilli()
+		item.ExpiresAt = &t
+	}
+	if coupon.UsedBy != nil {
+		item.Status = "USED"
+	} else if coupon.ExpiresAt != nil && !now.Before(*coupon.ExpiresAt) {
+		item.Status = "EXPIRED"
+	}
+	return item
+}
+
+type appGetInvitationsResponse struct {
+	InvitationCode string                          `json:"invitation_code"`
+	Tier           string                          `json:"tier"`
+	MaxReferrals   int                             `json:"max_referrals"`
+	Remaining      int                             `json:"remaining"`
+	Referrals      []appGetInvitationsResponseItem `json:"referrals"`
+}
+
+type appGetInvitationsResponseItem struct {
+	UserID    string                     `json:"user_id"`
+	Username  string                     `json:"username"`
+	InvitedAt int64                      `json:"invited_at"`
+	Reward    *appGetCouponsResponseItem `json:"reward"`
+}
+
+func appGetInvitations(w http.ResponseWriter, r *http.Request) {
+	ctx := r.Context()
+	user := ctx.Value("user").(*User)
+
+	referrals := []Referral{}
+	if err := db.SelectContext(ctx, &referrals, "SELECT * FROM referrals WHERE inviter_id = ? ORDER BY created_at", user.ID); err != nil {
 		writeError(w, http.StatusInternalServerError, err)
 		return
 	}
 
-	writeJSON(w, http.StatusOK, &appPostRidesEstimatedFareResponse{
-		Fare:     discounted,
-		Discount: calculateFare(req.PickupCoordinate.Latitude, req.PickupCoordinate.Longitude, req.DestinationCoordinate.Latitude, req.DestinationCoordinate.Longitude) - discounted,
-	})
+	rewardsByCode := map[string]*Coupon{}
+	coupons := getCouponsFromCache(user.ID)
+	for i := range coupons {
+		rewardsByCode[coupons[i].Code] = &coupons[i]
+	}
+
+	res := appGetInvitationsResponse{
+		InvitationCode: user.InvitationCode,
+		Tier:           user.Tier,
+		Referrals:      []appGetInvitationsResponseItem{},
+	}
+	if tier, ok := getReferralTier(user.Tier); ok {
+		res.MaxReferrals = tier.MaxReferrals
+		res.Remaining = max(tier.MaxReferrals-len(referrals), 0)
+	}
+
+	now := time.Now()
+	for _, referral := range referrals {
+		item := appGetInvitationsResponseItem{
+			UserID:    referral.InviteeID,
+			InvitedAt: referral.CreatedAt.UnixMilli(),
+		}
+		if invitee, ok := getUserByIDFromCache(referral.InviteeID); ok {
+			item.Username = invitee.Username
+		}
+		if referral.InviterCouponCode != nil {
+			if reward, ok := rewardsByCode[*referral.InviterCouponCode]; ok {
+				rewardItem := newAppGetCouponsResponseItem(reward, now)
+				item.Reward = &rewardItem
+			}
+		}
+		res.Referrals = append(res.Referrals, item)
+	}
+
+	writeJSON(w, http.StatusOK, res)
 }
 
 // マンハッタン距離を求める
@@ -657,11 +697,7 @@ func appPostRideEvaluatation(w http.ResponseWriter, r *http.Request) {
 		return
 	}
 
-	fare, err := calculateDiscountedFare(ctx, tx, ride.UserID, ride.ID, ride.PickupLatitude, ride.PickupLongitude, ride.DestinationLatitude, ride.DestinationLongitude)
-	if err != nil {
-		writeError(w, http.StatusInternalServerError, err)
-		return
-	}
+	fare := calculateDiscountedFare(ride)
 	paymentGatewayRequest := &paymentGatewayPostPaymentRequest{
 		Amount: fare,
 	}
@@ -675,7 +711,7 @@ func appPostRideEvaluatation(w http.ResponseWriter, r *http.Request) {
 		return
 	}
 
-	chairGetNotificationResponseData, err := insertRideStatus(ctx, tx, rideID, "COMPLETED")
+	chairGetNotificationResponseData, rideStatusCommitted, err := insertRideStatus(ctx, tx, rideID, "COMPLETED")
 	if err != nil {
 		writeError(w, http.StatusInternalServerError, err)
 		return
@@ -685,11 +721,14 @@ func appPostRideEvaluatation(w http.ResponseWriter, r *http.Request) {
 		writeError(w, http.StatusInternalServerError, err)
 		return
 	}
+	rideStatusCommitted()
 
 	writeJSON(w, http.StatusOK, &appPostRideEvaluationResponse{
 		CompletedAt: updatedAt.UnixMilli(),
 	})
 
+	publishRideWebhookEvent(webhookEventRideEvaluated, ride, nil, &req.Evaluation)
+
 	rideStatusSentAtChan <- RideStatusSentAtRequest{
 		RideStatusID: chairGetNotificationResponseData.RideStatusId,
 		RideID:       chairGetNotificationResponseData.RideID,
@@ -709,6 +748,8 @@ type appGetNotificationResponseData struct {
 	Chair                 *appGetNotificationResponseChair `json:"chair,omitempty"`
 	CreatedAt             int64                            `json:"created_at"`
 	UpdateAt              int64                            `json:"updated_at"`
+	// 他のノードから届いた通知は運賃が埋まっているので計算し直さない
+	fareFixed bool
 }
 
 type appGetNotificationResponseChair struct {
@@ -723,38 +764,84 @@ type appGetNotificationResponseChairStats struct {
 	TotalEvaluationAvg float64 `json:"total_evaluation_avg"`
 }
 
-var unsentRideStatusesToAppRWMutex = sync.RWMutex{}
-var unsentRideStatusesToAppChan map[string](chan *appGetNotificationResponseData) = make(map[string](chan *appGetNotificationResponseData))
+var appNotificationStreams = newNotificationStreamMap(func(data *appGetNotificationResponseData) string {
+	return data.RideID
+})
 
+// loadUnsentRideStatusesToApp はユーザーの最新のライドでまだ送っていないステータスを積み直す
+// ライド、ユーザー、椅子のキャッシュを読み込んだ後に呼ぶ
 func loadUnsentRideStatusesToApp() error {
-	unsentRideStatusesToAppRWMutex.Lock()
-	defer unsentRideStatusesToAppRWMutex.Unlock()
+	appNotificationStreams.reset()
 
-	// all notifications should be sent before the server termination
-	unsentRideStatusesToAppChan = make(map[string](chan *appGetNotificationResponseData))
+	rideStatuses := []RideStatus{}
+	if err := db.Select(&rideStatuses, "SELECT * FROM ride_statuses WHERE app_sent_at IS NULL ORDER BY created_at"); err != nil {
+		return err
+	}
+	for _, rideStatus := range rideStatuses {
+		ride, found := getRideByIDFromCache(rideStatus.RideID)
+		if !found {
+			continue
+		}
+		if latest, found := getLatestRideByUserIdFromCache(ride.UserID); !found || latest.ID != ride.ID {
+			continue
+		}
+		_, data, err := buildAppGetNotificationResponseData(rideStatus.ID, ride.ID, rideStatus.Status)
+		if err != nil {
+			slog.Error("loadUnsentRideStatusesToApp - failed to build", "error", err)
+			continue
+		}
+		// 他のノードも DB から積み直すのでバスには流さない
+		appNotificationStreams.get(ride.UserID).append(data)
+	}
 	return nil
 }
 
+// appendAppGetNotificationResponseData は自ノードのストリームにだけ積む。他のノードにはコミット後に送る
 func appendAppGetNotificationResponseData(userID string, data *appGetNotificationResponseData) {
-	unsentRideStatusesToAppRWMutex.Lock()
-	defer unsentRideStatusesToAppRWMutex.Unlock()
-	if _, ok := unsentRideStatusesToAppChan[userID]; !ok {
-		unsentRideStatusesToAppChan[userID] = make(chan *appGetNotificationResponseData, 10)
+	appNotificationStreams.get(userID).append(data)
+}
+
+type appGetNotificationResponse struct {
+	Data         *appGetNotificationResponseData `json:"data"`
+	RetryAfterMs int                             `json:"retry_after_ms"`
+}
+
+func appGetNotification(w http.ResponseWriter, r *http.Request) {
+	if wantsJSONNotification(r) {
+		appGetNotificationPolling(w, r)
+		return
 	}
-	unsentRideStatusesToAppChan[userID] <- data
+	appGetNotificationSSE(w, r)
 }
 
-func getAppGetNotificationResponseDataChannel(userID string) chan *appGetNotificationResponseData {
-	unsentRideStatusesToAppRWMutex.Lock()
-	defer unsentRideStatusesToAppRWMutex.Unlock()
-	if _, ok := unsentRideStatusesToAppChan[userID]; !ok {
-		unsentRideStatusesToAppChan[userID] = make(chan *appGetNotificationResponseData, 10)
+// appGetNotificationPolling は SSE と同じキューから未送信の通知を1件返し、無ければ現在の状態を返す
+func appGetNotificationPolling(w http.ResponseWriter, r *http.Request) {
+	user := r.Context().Value("user").(*User)
+	stream := appNotificationStreams.get(user.ID)
+
+	if event, ok := stream.nextUnsent(); ok {
+		data := fillAppNotificationFare(user.ID, event.Data)
+		if stream.markSent(event.ID) && stream.markDelivered(data.RideStatusId) {
+			notifyAppNotificationSent(data)
+		}
+		writeJSON(w, http.StatusOK, &appGetNotificationResponse{Data: data, RetryAfterMs: appRetryAfterMs})
+		return
 	}
-	return unsentRideStatusesToAppChan[userID]
+
+	snapshot := buildAppNotificationSnapshot(user.ID)
+	if snapshot != nil {
+		snapshot = fillAppNotificationFare(user.ID, snapshot)
+		// 状態が変わっていなければ、前回のポーリングで送信済みとして記録している
+		if stream.markDelivered(snapshot.RideStatusId) {
+			notifyAppNotificationSent(snapshot)
+		}
+	}
+	writeJSON(w, http.StatusOK, &appGetNotificationResponse{Data: snapshot, RetryAfterMs: appRetryAfterMs})
 }
 
 func appGetNotificationSSE(w http.ResponseWriter, r *http.Request) {
-	ctx := r.Context()
+	ctx, cancel := withShutdown(r.Context())
+	defer cancel()
 	user := ctx.Value("user").(*User)
 
 	w.Header().Set("X-Accel-Buffering", "no")
@@ -764,48 +851,139 @@ func appGetNotificationSSE(w http.ResponseWriter, r *http.Request) {
 	w.Header().Set("Cache-Control", "no-cache")
 	w.Header().Set("Connection", "keep-alive")
 
-	c := getAppGetNotificationResponseDataChannel(user.ID)
+	disconnect := appNotificationStreams.connect(user.ID)
+	defer disconnect()
 
-	for {
-		select {
-		case dataFromChannel := <-c:
-			tx, err := db.Beginx()
-			if err != nil {
-				slog.Error("appGetNotificationSSE - failed to begin transaction", "error", err)
-				return
-			}
-			dataFromChannel.Fare, err = calculateDiscountedFare(ctx, tx, user.ID, dataFromChannel.RideID, dataFromChannel.PickupCoordinate.Latitude, dataFromChannel.PickupCoordinate.Longitude, dataFromChannel.DestinationCoordinate.Latitude, dataFromChannel.DestinationCoordinate.Longitude)
-			tx.Rollback()
-			if err != nil {
-				slog.Error("appGetNotificationSSE - failed to calculate fare", "error", err)
-				return
+	if err := writeSSERetry(w, appRetryAfterMs); err != nil {
+		return
+	}
+
+	stream := appNotificationStreams.get(user.ID)
+	lastEventID := resumeEventID(r.Header.Get("Last-Event-ID"), stream)
+
+	// 未送信の通知が無ければ、最初に現在のライドの状態を送る
+	if r.Header.Get("Last-Event-ID") == "" && !stream.hasEventsAfter(lastEventID) {
+		if snapshot := buildAppNotificationSnapshot(user.ID); snapshot != nil {
+			writeAppNotification(w, user.ID, 0, snapshot)
+			if stream.markDelivered(snapshot.RideStatusId) {
+				notifyAppNotificationSent(snapshot)
 			}
+		}
+	}
+
+	// chair_location=true なら割り当てられた椅子の位置も送る
+	var locationFeed *chairLocationFeed
+	var lastLocation *appChairLocationData
+	if r.URL.Query().Get("chair_location") == "true" {
+		feed, unsubscribe := subscribeChairLocation(user.ID)
+		defer unsubscribe()
+		locationFeed = feed
+	}
 
-			b, _ := json.Marshal(dataFromChannel)
-			fmt.Fprintf(w, "data: %s\n", b)
-			w.(http.Flusher).Flush()
+	heartbeat := time.NewTicker(notificationHeartbeatInterval)
+	defer heartbeat.Stop()
 
-			chairID := ""
-			if dataFromChannel.Chair != nil {
-				chairID = dataFromChannel.Chair.ID
+	for {
+		var locationWakeup <-chan struct{}
+		if locationFeed != nil {
+			var location *appChairLocationData
+			location, locationWakeup = locationFeed.current()
+			if location != nil && location != lastLocation {
+				if err := writeChairLocationEvent(w, location); err != nil {
+					return
+				}
+				lastLocation = location
 			}
+		}
 
-			slog.Info("appGetNotificationSSE - sent", "chair", chairID, "status", dataFromChannel.Status)
+		events, wakeup := stream.eventsAfter(lastEventID)
+		for _, event := range events {
+			data := writeAppNotification(w, user.ID, event.ID, event.Data)
+			lastEventID = event.ID
 
-			rideStatusSentAtChan <- RideStatusSentAtRequest{
-				RideStatusID: dataFromChannel.RideStatusId,
-				RideID:       dataFromChannel.RideID,
-				ChairID:      chairID,
-				Status:       dataFromChannel.Status,
-				SentType:     AppNotification,
+			if !stream.markSent(event.ID) || !stream.markDelivered(data.RideStatusId) {
+				// 再送なので送信済みの記録は不要
+				continue
 			}
+			notifyAppNotificationSent(data)
+		}
 
-		case <-r.Context().Done():
+		select {
+		case <-wakeup:
+		case <-locationWakeup:
+		case <-heartbeat.C:
+			if err := writeSSEHeartbeat(w); err != nil {
+				return
+			}
+		case <-ctx.Done():
+			if isShuttingDown() {
+				// 別のインスタンスや再起動後のサーバーに繋ぎ直してもらう
+				writeSSERetry(w, appRetryAfterMs)
+			}
 			return
 		}
 	}
 }
 
+// buildAppNotificationSnapshot はユーザーの最新のライドとその状態から通知を作る
+func buildAppNotificationSnapshot(userID string) *appGetNotificationResponseData {
+	ride, found := getLatestRideByUserIdFromCache(userID)
+	if !found {
+		return nil
+	}
+	rideStatus, found := getLatestRideStatusEntryFromCache(ride.ID)
+	if !found {
+		return nil
+	}
+	_, data, err := buildAppGetNotificationResponseData(rideStatus.ID, ride.ID, rideStatus.Status)
+	if err != nil {
+		slog.Error("buildAppNotificationSnapshot - failed to build", "error", err)
+		return nil
+	}
+	return data
+}
+
+// writeAppNotification は id が 0 なら id フィールドを付けずに書く
+func writeAppNotification(w http.ResponseWriter, userID string, id int64, original *appGetNotificationResponseData) *appGetNotificationResponseData {
+	data := fillAppNotificationFare(userID, original)
+
+	b, _ := json.Marshal(data)
+	if id != 0 {
+		fmt.Fprintf(w, "id: %d\n", id)
+	}
+	fmt.Fprintf(w, "data: %s\n\n", b)
+	w.(http.Flusher).Flush()
+
+	slog.Info("appGetNotificationSSE - sent", "user", userID, "status", data.Status)
+	return data
+}
+
+// fillAppNotificationFare は履歴が複数の接続から読まれるので、コピーしてから運賃を埋める
+func fillAppNotificationFare(userID string, original *appGetNotificationResponseData) *appGetNotificationResponseData {
+	data := *original
+	if data.fareFixed {
+		return &data
+	}
+	if ride, found := getRideByIDFromCache(data.RideID); found {
+		data.Fare = calculateDiscountedFare(ride)
+	}
+	return &data
+}
+
+func notifyAppNotificationSent(data *appGetNotificationResponseData) {
+	chairID := ""
+	if data.Chair != nil {
+		chairID = data.Chair.ID
+	}
+	rideStatusSentAtChan <- RideStatusSentAtRequest{
+		RideStatusID: data.RideStatusId,
+		RideID:       data.RideID,
+		ChairID:      chairID,
+		Status:       data.Status,
+		SentType:     AppNotification,
+	}
+}
+
 func getChairStats(chairID string) (appGetNotificationResponseChairStats, error) {
 	stats := appGetNotificationResponseChairStats{}
 
@@ -867,6 +1045,10 @@ func appGetNearbyChairs(w http.ResponseWriter, r *http.Request) {
 	}
 
 	coordinate := Coordinate{Latitude: lat, Longitude: lon}
+	if !isInServiceArea(coordinate) {
+		writeError(w, http.StatusBadRequest, errOutOfServiceArea)
+		return
+	}
 
 	// slog.Info("appGetNearbyChairs - start", "coordinate", coordinate, "distance", distance)
 
@@ -889,6 +1071,9 @@ func appGetNearbyChairs(w http.ResponseWriter, r *http.Request) {
 			// slog.Info("  appGetNearbyChairs chair loop - no location found", "coordinate", coordinate, "chair", chair)
 			continue
 		}
+		if !isChairOnline(chair.ID, loc.UpdatedAt, retrievedAt) {
+			continue
+		}
 		currentDist := calculateDistance(coordinate.Latitude, coordinate.Longitude, loc.Latitude, loc.Longitude)
 		if currentDist > distance {
 			// slog.Info("  appGetNearbyChairs chair loop - too far", "chair", chair, "coordinate", coordinate, "loc", loc, "currentDist", currentDist, "distance", distance)
@@ -927,48 +1112,32 @@ func appGetNearbyChairs(w http.ResponseWriter, r *http.Request) {
 	})
 }
 
-func calculateFare(pickupLatitude, pickupLongitude, destLatitude, destLongitude int) int {
-	meteredFare := farePerDistance * calculateDistance(pickupLatitude, pickupLongitude, destLatitude, destLongitude)
-	return initialFare + meteredFare
+// fareRates はライドを予約したときの初乗り運賃と距離あたりの運賃を返す
+// 運賃を記録する前のライドは全体の運賃を使う
+func (r *Ride) fareRates() (int, int) {
+	baseFare, perDistance := initialFare, farePerDistance
+	if r.InitialFare != nil {
+		baseFare = *r.InitialFare
+	}
+	if r.FarePerDistance != nil {
+		perDistance = *r.FarePerDistance
+	}
+	return baseFare, perDistance
 }
 
-func calculateDiscountedFare(ctx context.Context, tx *sqlx.Tx, userID string, rideId string, pickupLatitude, pickupLongitude, destLatitude, destLongitude int) (int, error) {
-	var coupon Coupon
-	discount := 0
-	if rideId != "" {
-		// destLatitude = ride.DestinationLatitude
-		// destLongitude = ride.DestinationLongitude
-		// pickupLatitude = ride.PickupLatitude
-		// pickupLongitude = ride.PickupLongitude
-
-		// すでにクーポンが紐づいているならそれの割引額を参照
-		coupon, couponFound := getRideIdToCouponMap(rideId)
-		if couponFound {
-			discount = coupon.Discount
-			// slog.Info("calculateDiscountedFare - coupon is used when ride is provided", "coupon", coupon, "ride", ride)
-		}
-	} else {
-		// 初回利用クーポンを最優先で使う
-		if err := tx.GetContext(ctx, &coupon, "SELECT * FROM coupons WHERE user_id = ? AND code = 'CP_NEW2024' AND used_by IS NULL", userID); err != nil {
-			if !errors.Is(err, sql.ErrNoRows) {
-				return 0, err
-			}
+// calculateFare は予約時の運賃で計算する
+func calculateFare(ride *Ride) int {
+	baseFare, perDistance := ride.fareRates()
+	return baseFare + perDistance*calculateDistance(ride.PickupLatitude, ride.PickupLongitude, ride.DestinationLatitude, ride.DestinationLongitude)
+}
 
-			// 無いなら他のクーポンを付与された順番に使う
-			if err := tx.GetContext(ctx, &coupon, "SELECT * FROM coupons WHERE user_id = ? AND used_by IS NULL ORDER BY created_at LIMIT 1", userID); err != nil {
-				if !errors.Is(err, sql.ErrNoRows) {
-					return 0, err
-				}
-			} else {
-				discount = coupon.Discount
-			}
-		} else {
-			discount = coupon.Discount
-		}
+// calculateDiscountedFare はライドに紐づいたクーポンの割引を引いた運賃を返す
+func calculateDiscountedFare(ride *Ride) int {
+	baseFare, perDistance := ride.fareRates()
+	meteredFare := perDistance * calculateDistance(ride.PickupLatitude, ride.PickupLongitude, ride.DestinationLatitude, ride.DestinationLongitude)
+	discount := 0
+	if coupon, found := getRideIdToCouponMap(ride.ID); found {
+		discount = couponDiscountAmount(&coupon, meteredFare)
 	}
-
-	meteredFare := farePerDistance * calculateDistance(pickupLatitude, pickupLongitude, destLatitude, destLongitude)
-	discountedMeteredFare := max(meteredFare-discount, 0)
-
-	return initialFare + discountedMeteredFare, nil
+	return baseFare + meteredFare - discount
 }
@@ -0,0 +1,156 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"sync"
+	"time"
+)
+
+// 椅子が座標と一緒に送ってくる電池残量と整備が必要な箇所
+// 電池残量から走れる距離を求め、走り切れないライドや整備の必要な椅子はマッチングしない
+
+// 電池が満タンのときに走れる距離。椅子の仕様で決まるので ISUCON_CHAIR_FULL_BATTERY_RANGE で与える
+// 0 なら分からないものとして、電池残量では走れる距離を制限しない
+var chairFullBatteryRange = 0
+
+const chairMaintenanceFlagsLimit = 16
+
+var chairConditionCacheRWMutex = sync.RWMutex{}
+var chairConditionCache map[string]*ChairCondition = make(map[string]*ChairCondition)
+
+func loadChairConditionCache() error {
+	chairConditionCacheRWMutex.Lock()
+	defer chairConditionCacheRWMutex.Unlock()
+
+	conditions := []*ChairCondition{}
+	if err := db.Select(&conditions, "SELECT * FROM chair_conditions"); err != nil {
+		return err
+	}
+
+	chairConditionCache = make(map[string]*ChairCondition)
+	for _, condition := range conditions {
+		if err := json.Unmarshal([]byte(condition.MaintenanceFlagsJSON), &condition.MaintenanceFlags); err != nil {
+			return err
+		}
+		chairConditionCache[condition.ChairID] = condition
+	}
+	return nil
+}
+
+func validateChairCondition(battery *int, maintenanceFlags []string) error {
+	if battery != nil && (*battery < 0 || *battery > 100) {
+		return errors.New("battery must be between 0 and 100")
+	}
+	if len(maintenanceFlags) > chairMaintenanceFlagsLimit {
+		return errors.New("too many maintenance_flags")
+	}
+	for _, flag := range maintenanceFlags {
+		if flag == "" {
+			return errors.New("maintenance_flags must not contain empty strings")
+		}
+	}
+	return nil
+}
+
+// updateChairCondition は送られてきた項目だけを更新する
+// maintenanceFlags が nil なら前回の値を残し、空のスライスなら整備済みとして消す
+func updateChairCondition(chairID string, battery *int, maintenanceFlags []string, updatedAt time.Time) {
+	if battery == nil && maintenanceFlags == nil {
+		return
+	}
+
+	chairConditionCacheRWMutex.Lock()
+	defer chairConditionCacheRWMutex.Unlock()
+
+	condition, ok := chairConditionCache[chairID]
+	if !ok {
+		condition = &ChairCondition{ChairID: chairID, MaintenanceFlags: []string{}}
+		chairConditionCache[chairID] = condition
+	}
+	if battery != nil {
+		b := *battery
+		condition.Battery = &b
+	}
+	if maintenanceFlags != nil {
+		condition.MaintenanceFlags = append([]string{}, maintenanceFlags...)
+	}
+	condition.UpdatedAt = updatedAt.Truncate(time.Microsecond)
+	condition.isDirty = true
+}
+
+func getChairConditionFromCache(chairID string) (ChairCondition, bool) {
+	chairConditionCacheRWMutex.RLock()
+	defer chairConditionCacheRWMutex.RUnlock()
+
+	condition, ok := chairConditionCache[chairID]
+	if !ok {
+		return ChairCondition{}, false
+	}
+	return *condition, true
+}
+
+// remainingRange は電池残量から走れる距離を返す。電池残量か満タンで走れる距離が分からなければ ok は false
+func (c *ChairCondition) remainingRange() (int, bool) {
+	if c.Battery == nil || chairFullBatteryRange <= 0 {
+		return 0, false
+	}
+	return *c.Battery * chairFullBatteryRange / 100, true
+}
+
+// chairMatchingRange はマッチングで使う、椅子が走れる距離を返す
+// 整備が必要な椅子は available が false、走れる距離が分からない椅子は limited が false
+func chairMatchingRange(chairID string) (remaining int, limited bool, available bool) {
+	condition, ok := getChairConditionFromCache(chairID)
+	if !ok {
+		return 0, false, true
+	}
+	if len(condition.MaintenanceFlags) > 0 {
+		return 0, false, false
+	}
+	remaining, limited = condition.remainingRange()
+	return remaining, limited, true
+}
+
+func flushChairConditions(ctx context.Context) error {
+	chairConditionCacheRWMutex.Lock()
+	conditions := []ChairCondition{}
+	for _, condition := range chairConditionCache {
+		if condition.isDirty {
+			conditions = append(conditions, *condition)
+			condition.isDirty = false
+		}
+	}
+	chairConditionCacheRWMutex.Unlock()
+
+	for i := range conditions {
+		b, err := json.Marshal(conditions[i].MaintenanceFlags)
+		if err != nil {
+			return err
+		}
+		conditions[i].MaintenanceFlagsJSON = string(b)
+	}
+
+	for start := 0; start < len(conditions); start += chairLocationFlushBatchSize {
+		end := min(start+chairLocationFlushBatchSize, len(conditions))
+		if _, err := db.NamedExecContext(
+			ctx,
+			`INSERT INTO chair_conditions (chair_id, battery, maintenance_flags, updated_at)
+			VALUES (:chair_id, :battery, :maintenance_flags, :updated_at)
+			ON DUPLICATE KEY UPDATE battery = VALUES(battery), maintenance_flags = VALUES(maintenance_flags), updated_at = VALUES(updated_at)`,
+			conditions[start:end],
+		); err != nil {
+			// キャッシュには最新の値があるので、印を付け直せば次の周期で書かれる
+			chairConditionCacheRWMutex.Lock()
+			for _, condition := range conditions[start:] {
+				if cached, ok := chairConditionCache[condition.ChairID]; ok {
+					cached.isDirty = true
+				}
+			}
+			chairConditionCacheRWMutex.Unlock()
+			return err
+		}
+	}
+	return nil
+}
@@ -0,0 +1,42 @@
+package main
+
+import "testing"
+
+func TestChairMatchingRange(t *testing.T) {
+	battery := func(b int) *int { return &b }
+
+	tests := []struct {
+		name          string
+		condition     *ChairCondition
+		fullRange     int
+		wantRemaining int
+		wantLimited   bool
+		wantAvailable bool
+	}{
+		{name: "no condition", fullRange: 1000, wantAvailable: true},
+		{name: "needs maintenance", condition: &ChairCondition{Battery: battery(100), MaintenanceFlags: []string{"wheel"}}, fullRange: 1000},
+		{name: "battery unknown", condition: &ChairCondition{MaintenanceFlags: []string{}}, fullRange: 1000, wantAvailable: true},
+		{name: "half battery", condition: &ChairCondition{Battery: battery(50), MaintenanceFlags: []string{}}, fullRange: 1000, wantRemaining: 500, wantLimited: true, wantAvailable: true},
+		{name: "empty battery", condition: &ChairCondition{Battery: battery(0), MaintenanceFlags: []string{}}, fullRange: 1000, wantLimited: true, wantAvailable: true},
+		{name: "full range not configured", condition: &ChairCondition{Battery: battery(50), MaintenanceFlags: []string{}}, wantAvailable: true},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			defer func(cache map[string]*ChairCondition, fullRange int) {
+				chairConditionCache = cache
+				chairFullBatteryRange = fullRange
+			}(chairConditionCache, chairFullBatteryRange)
+			chairConditionCache = make(map[string]*ChairCondition)
+			if tt.condition != nil {
+				chairConditionCache["chair"] = tt.condition
+			}
+			chairFullBatteryRange = tt.fullRange
+
+			remaining, limited, available := chairMatchingRange("chair")
+			if remaining != tt.wantRemaining || limited != tt.wantLimited || available != tt.wantAvailable {
+				t.Errorf("chairMatchingRange = (%d, %v, %v), want (%d, %v, %v)",
+					remaining, limited, available, tt.wantRemaining, tt.wantLimited, tt.wantAvailable)
+			}
+		})
+	}
+}
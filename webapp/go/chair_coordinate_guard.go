@@ -0,0 +1,198 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"log/slog"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+// 椅子から届く座標の検査
+// サービス地域 (isInServiceArea) の外の座標は受け付けない。速度から考えてありえない移動は距離に数えず、椅子に印を付けてマッチングから外す
+
+type serviceAreaBounds struct {
+	MinLatitude  int
+	MinLongitude int
+	MaxLatitude  int
+	MaxLongitude int
+}
+
+// ゾーンが1つもないときのサービス地域。ISUCON_SERVICE_AREA で与え、nil ならどこでも受け付ける
+var serviceArea *serviceAreaBounds
+
+// 椅子の速度から求めた移動距離の何倍までを許すか。0 (デフォルト) なら瞬間移動を検出しない
+// 座標の送信が遅れたりまとめて届いたりすると誤検出するので、ISUCON_TELEPORT_TOLERANCE を設定したときだけ検出する
+var teleportTolerance = 0
+
+// 印の付いた椅子からこの回数続けてありえる移動の座標が届いたら、誤検出とみなして印を外す
+const chairFlagClearReadings = 10
+
+// parseServiceArea は "最小緯度,最小経度,最大緯度,最大経度" を読む
+func parseServiceArea(s string) (*serviceAreaBounds, error) {
+	parts := strings.Split(s, ",")
+	if len(parts) != 4 {
+		return nil, fmt.Errorf("invalid service area: %q", s)
+	}
+	values := make([]int, 4)
+	for i, part := range parts {
+		v, err := strconv.Atoi(strings.TrimSpace(part))
+		if err != nil {
+			return nil, fmt.Errorf("invalid service area: %q", s)
+		}
+		values[i] = v
+	}
+	if values[0] > values[2] || values[1] > values[3] {
+		return nil, fmt.Errorf("invalid service area: %q", s)
+	}
+	return &serviceAreaBounds{
+		MinLatitude:  values[0],
+		MinLongitude: values[1],
+		MaxLatitude:  values[2],
+		MaxLongitude: values[3],
+	}, nil
+}
+
+func (b *serviceAreaBounds) contains(c Coordinate) bool {
+	if b == nil {
+		return true
+	}
+	return b.MinLatitude <= c.Latitude && c.Latitude <= b.MaxLatitude &&
+		b.MinLongitude <= c.Longitude && c.Longitude <= b.MaxLongitude
+}
+
+// isTeleport は前回の座標から経過時間内に移動できない距離を跳んだかを返す
+// 椅子の速度は 1 秒あたりの移動距離として扱う
+func isTeleport(model string, distance int, elapsed time.Duration) bool {
+	if teleportTolerance <= 0 || distance == 0 {
+		return false
+	}
+	speed, ok := getChairModelSpeed(model)
+	if !ok || speed <= 0 {
+		return false
+	}
+	seconds := int((elapsed + time.Second - 1) / time.Second)
+	return distance > speed*max(seconds, 1)*teleportTolerance
+}
+
+var chairFlagCacheRWMutex = sync.RWMutex{}
+var chairFlagCache map[string]*ChairFlag = make(map[string]*ChairFlag)
+
+// 印が付いてから続けて届いたありえる移動の座標の数
+var chairConsistentReadings map[string]int = make(map[string]int)
+
+func loadChairFlagCache() error {
+	chairFlagCacheRWMutex.Lock()
+	defer chairFlagCacheRWMutex.Unlock()
+
+	flags := []*ChairFlag{}
+	if err := db.Select(&flags, "SELECT * FROM chair_flags"); err != nil {
+		return err
+	}
+
+	chairFlagCache = make(map[string]*ChairFlag)
+	chairConsistentReadings = make(map[string]int)
+	for _, flag := range flags {
+		chairFlagCache[flag.ChairID] = flag
+	}
+	return nil
+}
+
+func isChairFlagged(chairID string) bool {
+	chairFlagCacheRWMutex.RLock()
+	defer chairFlagCacheRWMutex.RUnlock()
+
+	_, ok := chairFlagCache[chairID]
+	return ok
+}
+
+func getChairFlagsFromCache() []ChairFlag {
+	chairFlagCacheRWMutex.RLock()
+	defer chairFlagCacheRWMutex.RUnlock()
+
+	flags := make([]ChairFlag, 0, len(chairFlagCache))
+	for _, flag := range chairFlagCache {
+		flags = append(flags, *flag)
+	}
+	return flags
+}
+
+// flagChair は椅子に印を付ける。すでに付いていれば最新の理由で上書きする
+func flagChair(ctx context.Context, flag ChairFlag) error {
+	if _, err := db.ExecContext(
+		ctx,
+		`INSERT INTO chair_flags (chair_id, reason, latitude, longitude, distance, elapsed_ms, created_at) VALUES (?, ?, ?, ?, ?, ?, ?)
+		ON DUPLICATE KEY UPDATE reason = VALUES(reason), latitude = VALUES(latitude), longitude = VALUES(longitude),
+			distance = VALUES(distance), elapsed_ms = VALUES(elapsed_ms), created_at = VALUES(created_at)`,
+		flag.ChairID, flag.Reason, flag.Latitude, flag.Longitude, flag.Distance, flag.ElapsedMs, flag.CreatedAt,
+	); err != nil {
+		return err
+	}
+
+	chairFlagCacheRWMutex.Lock()
+	chairFlagCache[flag.ChairID] = &flag
+	delete(chairConsistentReadings, flag.ChairID)
+	chairFlagCacheRWMutex.Unlock()
+	publishCacheReloadToBus("chair_flags")
+	return nil
+}
+
+func unflagChair(ctx context.Context, chairID string) (bool, error) {
+	result, err := db.ExecContext(ctx, "DELETE FROM chair_flags WHERE chair_id = ?", chairID)
+	if err != nil {
+		return false, err
+	}
+	count, err := result.RowsAffected()
+	if err != nil {
+		return false, err
+	}
+
+	chairFlagCacheRWMutex.Lock()
+	delete(chairFlagCache, chairID)
+	delete(chairConsistentReadings, chairID)
+	chairFlagCacheRWMutex.Unlock()
+	publishCacheReloadToBus("chair_flags")
+	return count > 0, nil
+}
+
+// reportTeleport は瞬間移動を検出した椅子に印を付ける。座標の更新自体は止めない
+func reportTeleport(ctx context.Context, chairID string, c Coordinate, distance int, elapsed time.Duration, detectedAt time.Time) {
+	slog.Warn("chair teleported", "chair_id", chairID, "distance", distance, "elapsed", elapsed)
+	if err := flagChair(ctx, ChairFlag{
+		ChairID:   chairID,
+		Reason:    "teleport",
+		Latitude:  c.Latitude,
+		Longitude: c.Longitude,
+		Distance:  distance,
+		ElapsedMs: elapsed.Milliseconds(),
+		CreatedAt: detectedAt.Truncate(time.Microsecond),
+	}); err != nil {
+		slog.Error("failed to flag chair", "chair_id", chairID, "error", err)
+	}
+}
+
+// countConsistentReading は印の付いた椅子からありえる移動の座標が届いたことを数え、印を外してよければ true を返す
+func countConsistentReading(chairID string) bool {
+	chairFlagCacheRWMutex.Lock()
+	defer chairFlagCacheRWMutex.Unlock()
+
+	if _, ok := chairFlagCache[chairID]; !ok {
+		return false
+	}
+	chairConsistentReadings[chairID]++
+	return chairConsistentReadings[chairID] >= chairFlagClearReadings
+}
+
+// clearChairFlagIfConsistent は印の付いた椅子の座標が続けてありえる移動なら印を外す
+func clearChairFlagIfConsistent(ctx context.Context, chairID string) {
+	if !countConsistentReading(chairID) {
+		return
+	}
+	if _, err := unflagChair(ctx, chairID); err != nil {
+		slog.Error("failed to unflag chair", "chair_id", chairID, "error", err)
+		return
+	}
+	slog.Info("chair unflagged after consistent coordinates", "chair_id", chairID)
+}
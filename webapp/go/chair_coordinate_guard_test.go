@@ -0,0 +1,95 @@
+package main
+
+import (
+	"testing"
+	"time"
+)
+
+func TestIsTeleport(t *testing.T) {
+	chairModelSpeedCacheRWMutex.Lock()
+	saved := chairModelSpeedCache
+	chairModelSpeedCache = map[string]int{"fast": 5, "stopped": 0}
+	chairModelSpeedCacheRWMutex.Unlock()
+	savedTolerance := teleportTolerance
+	t.Cleanup(func() {
+		chairModelSpeedCacheRWMutex.Lock()
+		chairModelSpeedCache = saved
+		chairModelSpeedCacheRWMutex.Unlock()
+		teleportTolerance = savedTolerance
+	})
+
+	tests := []struct {
+		name      string
+		tolerance int
+		model     string
+		distance  int
+		elapsed   time.Duration
+		want      bool
+	}{
+		{name: "within speed", tolerance: 10, model: "fast", distance: 50, elapsed: time.Second, want: false},
+		{name: "over speed", tolerance: 10, model: "fast", distance: 51, elapsed: time.Second, want: true},
+		{name: "elapsed is rounded up to seconds", tolerance: 10, model: "fast", distance: 100, elapsed: 1500 * time.Millisecond, want: false},
+		{name: "no elapsed time counts as one second", tolerance: 10, model: "fast", distance: 50, elapsed: 0, want: false},
+		{name: "not moved", tolerance: 10, model: "fast", distance: 0, elapsed: 0, want: false},
+		{name: "detection disabled", tolerance: 0, model: "fast", distance: 1000, elapsed: time.Second, want: false},
+		{name: "unknown model", tolerance: 10, model: "unknown", distance: 1000, elapsed: time.Second, want: false},
+		{name: "model without speed", tolerance: 10, model: "stopped", distance: 1000, elapsed: time.Second, want: false},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			teleportTolerance = tt.tolerance
+			if got := isTeleport(tt.model, tt.distance, tt.elapsed); got != tt.want {
+				t.Errorf("isTeleport(%q, %d, %v) = %v, want %v", tt.model, tt.distance, tt.elapsed, got, tt.want)
+			}
+		})
+	}
+}
+
+func TestParseServiceArea(t *testing.T) {
+	tests := []struct {
+		input   string
+		want    *serviceAreaBounds
+		wantErr bool
+	}{
+		{input: "-1000,-1000,1000,1000", want: &serviceAreaBounds{MinLatitude: -1000, MinLongitude: -1000, MaxLatitude: 1000, MaxLongitude: 1000}},
+		{input: " 0, 1, 2, 3 ", want: &serviceAreaBounds{MinLatitude: 0, MinLongitude: 1, MaxLatitude: 2, MaxLongitude: 3}},
+		{input: "0,0,1", wantErr: true},
+		{input: "0,0,1,a", wantErr: true},
+		{input: "10,0,0,10", wantErr: true},
+	}
+	for _, tt := range tests {
+		got, err := parseServiceArea(tt.input)
+		if (err != nil) != tt.wantErr {
+			t.Errorf("parseServiceArea(%q) error = %v, wantErr %v", tt.input, err, tt.wantErr)
+			continue
+		}
+		if tt.want != nil && *got != *tt.want {
+			t.Errorf("parseServiceArea(%q) = %+v, want %+v", tt.input, *got, *tt.want)
+		}
+	}
+}
+
+func TestCountConsistentReading(t *testing.T) {
+	chairFlagCacheRWMutex.Lock()
+	savedFlags, savedReadings := chairFlagCache, chairConsistentReadings
+	chairFlagCache = map[string]*ChairFlag{"flagged": {ChairID: "flagged"}}
+	chairConsistentReadings = map[string]int{}
+	chairFlagCacheRWMutex.Unlock()
+	t.Cleanup(func() {
+		chairFlagCacheRWMutex.Lock()
+		chairFlagCache, chairConsistentReadings = savedFlags, savedReadings
+		chairFlagCacheRWMutex.Unlock()
+	})
+
+	if countConsistentReading("unflagged") {
+		t.Error("countConsistentReading returned true for a chair without a flag")
+	}
+	for i := 1; i < chairFlagClearReadings; i++ {
+		if countConsistentReading("flagged") {
+			t.Fatalf("countConsistentReading returned true after %d readings", i)
+		}
+	}
+	if !countConsistentReading("flagged") {
+		t.Errorf("countConsistentReading returned false after %d readings", chairFlagClearReadings)
+	}
+}
@@ -144,6 +144,13 @@ type TotalCountAndTotalEvaluation struct {
 }
 
 var rideCachePerChairAndHasEvaluation map[string]TotalCountAndTotalEvaluation = make(map[string]TotalCountAndTotalEvaluation)
+var userIdToLatestRideCache map[string]*Ride = make(map[string]*Ride)
+
+func updateUserIdToLatestRideCacheIfNeeded(ride *Ride) {
+	if latest, ok := userIdToLatestRideCache[ride.UserID]; !ok || latest.CreatedAt.Before(ride.CreatedAt) {
+		userIdToLatestRideCache[ride.UserID] = ride
+	}
+}
 
 func updateRideCachePerChairAndHasEvaluationIfNeeded(ride *Ride) {
 	if ride.ChairID.Valid && ride.Evaluation != nil {
@@ -172,9 +179,11 @@ func loadRideCacheMap() error {
 
 	rideCacheMap = make(map[string]*Ride)
 	rideCachePerChairAndHasEvaluation = make(map[string]TotalCountAndTotalEvaluation)
+	userIdToLatestRideCache = make(map[string]*Ride)
 	for _, ride := range rides {
 		rideCacheMap[ride.ID] = ride
 		updateRideCachePerChairAndHasEvaluationIfNeeded(ride)
+		updateUserIdToLatestRideCacheIfNeeded(ride)
 	}
 	return nil
 }
@@ -185,6 +194,7 @@ func insertRideCacheMap(ride Ride) {
 
 	rideCacheMap[ride.ID] = &ride
 	updateRideCachePerChairAndHasEvaluationIfNeeded(&ride)
+	updateUserIdToLatestRideCacheIfNeeded(&ride)
 }
 
 var errNoRides = fmt.Errorf("no rides")
@@ -229,6 +239,14 @@ func getRideByIDFromCache(rideID string) (*Ride, bool) {
 	return ride, ok
 }
 
+func getLatestRideByUserIdFromCache(userID string) (*Ride, bool) {
+	rideCacheMapRWMutex.RLock()
+	defer rideCacheMapRWMutex.RUnlock()
+
+	ride, ok := userIdToLatestRideCache[userID]
+	return ride, ok
+}
+
 var userMapRWMutex = sync.RWMutex{}
 var userMapCache map[string]*User = make(map[string]*User)
 var accessTokenToUserCache map[string]*User = make(map[string]*User)
@@ -259,6 +277,15 @@ func insertUserMapCache(user User) {
 	accessTokenToUserCache[user.AccessToken] = &user
 }
 
+func updateUserTierInCache(userID, tier string) {
+	userMapRWMutex.Lock()
+	defer userMapRWMutex.Unlock()
+
+	if user, ok := userMapCache[userID]; ok {
+		user.Tier = tier
+	}
+}
+
 func getUserByIDFromCache(userID string) (*User, bool) {
 	userMapRWMutex.RLock()
 	defer userMapRWMutex.RUnlock()
@@ -275,39 +302,42 @@ func getUserByAccessToken(accessToken string) (*User, bool) {
 	return user, ok
 }
 
-var unsentRideStatusesToChairRWMutex = sync.RWMutex{}
-var unsentRideStatusesToChairChan map[string](chan *chairGetNotificationResponseData) = make(map[string](chan *chairGetNotificationResponseData))
-var sentLastRideStatusToChair map[string]*chairGetNotificationResponseData = make(map[string]*chairGetNotificationResponseData)
+var chairNotificationStreams = newNotificationStreamMap(func(data *chairGetNotificationResponseData) string {
+	return data.RideID
+})
 
+// loadUnsentRideStatusesToChair は椅子に割り当てられた最新のライドでまだ送っていないステータスを積み直す
+// ライド、ユーザー、椅子の割り当てのキャッシュを読み込んだ後に呼ぶ
 func loadUnsentRideStatusesToChair() error {
-	unsentRideStatusesToChairRWMutex.Lock()
-	defer unsentRideStatusesToChairRWMutex.Unlock()
-
-	// all notifications should be sent before the server termination
-	unsentRideStatusesToChairChan = make(map[string](chan *chairGetNotificationResponseData))
-	sentLastRideStatusToChair = make(map[string]*chairGetNotificationResponseData)
+	chairNotificationStreams.reset()
 
+	rideStatuses := []RideStatus{}
+	if err := db.Select(&rideStatuses, "SELECT * FROM ride_statuses WHERE chair_sent_at IS NULL ORDER BY created_at"); err != nil {
+		return err
+	}
+	for _, rideStatus := range rideStatuses {
+		ride, found := getRideByIDFromCache(rideStatus.RideID)
+		if !found || !ride.ChairID.Valid {
+			continue
+		}
+		if latest, found := getLatestRideByChairId(ride.ChairID.String); !found || latest.ID != ride.ID {
+			continue
+		}
+		_, data, err := buildChairGetNotificationResponseData(rideStatus.ID, ride.ID, rideStatus.Status)
+		if err != nil {
+			slog.Error("loadUnsentRideStatusesToChair - failed to build", "error", err)
+			continue
+		}
+		// 他のノードも DB から積み直すのでバスには流さない
+		chairNotificationStreams.get(ride.ChairID.String).append(data)
+	}
 	return nil
 }
 
+// appendChairGetNotificationResponseData は自ノードのストリームにだけ積む。他のノードにはコミット後に送る
 func appendChairGetNotificationResponseData(chairID string, data *chairGetNotificationResponseData) {
-	unsentRideStatusesToChairRWMutex.Lock()
-	defer unsentRideStatusesToChairRWMutex.Unlock()
-
-	if _, ok := unsentRideStatusesToChairChan[chairID]; !ok {
-		unsentRideStatusesToChairChan[chairID] = make(chan *chairGetNotificationResponseData, 10)
-	}
 	slog.Info("appendChairGetNotificationResponseData", "chairID", chairID, "data", data)
-	unsentRideStatusesToChairChan[chairID] <- data
-}
-
-func getChairGetNotificationResponseDataChannel(chairID string) chan *chairGetNotificationResponseData {
-	unsentRideStatusesToChairRWMutex.Lock()
-	defer unsentRideStatusesToChairRWMutex.Unlock()
-	if _, ok := unsentRideStatusesToChairChan[chairID]; !ok {
-		unsentRideStatusesToChairChan[chairID] = make(chan *chairGetNotificationResponseData, 10)
-	}
-	return unsentRideStatusesToChairChan[chairID]
+	chairNotificationStreams.get(chairID).append(data)
 }
 
 var ErrNoChairAssigned = fmt.Errorf("no chair assigned")
@@ -432,7 +462,8 @@ func buildAndAppendAppGetNotificationResponseData(rideStatusId, rideId string, r
 	return responseData, nil
 }
 
-func insertRideStatus(ctx context.Context, tx *sqlx.Tx, ride_id, status string) (*appGetNotificationResponseData, error) {
+// insertRideStatus は返した関数をトランザクションのコミット後に呼ぶ。ロールバックしたライドを外に知らせないため
+func insertRideStatus(ctx context.Context, tx *sqlx.Tx, ride_id, status string) (*appGetNotificationResponseData, func(), error) {
 	id := ulid.Make().String()
 	now := time.Now()
 	_, err := tx.ExecContext(
@@ -440,7 +471,7 @@ func insertRideStatus(ctx context.Context, tx *sqlx.Tx, ride_id, status string)
 		"INSERT INTO ride_statuses (id, ride_id, status, created_at) VALUES (?, ?, ?, ?)",
 		id, ride_id, status, now)
 	if err != nil {
-		return nil, err
+		return nil, nil, err
 	}
 
 	rideStatus := &RideStatus{
@@ -452,11 +483,19 @@ func insertRideStatus(ctx context.Context, tx *sqlx.Tx, ride_id, status string)
 		ChairSentAt: nil,
 	}
 
+	prev, hasPrev := getLatestRideStatusEntryFromCache(ride_id)
 	updateLatestRideStatusCacheMap(rideStatus)
-	buildAndAppendChairGetNotificationResponseData(id, ride_id, status)
+	chairResponse, _ := buildAndAppendChairGetNotificationResponseData(id, ride_id, status)
 	response, _ := buildAndAppendAppGetNotificationResponseData(id, ride_id, status)
 
-	return response, nil
+	committed := func() {
+		if hasPrev {
+			addRideStatusDuration(ride_id, prev.Status, now.Sub(prev.CreatedAt))
+		}
+		publishRideStatusToBus(ride_id, chairResponse, response)
+		publishRideStatusWebhookEvent(ride_id, status)
+	}
+	return response, committed, nil
 }
 
 func insertRideStatusWithoutTransaction(ctx context.Context, ride_id, status string) error {
@@ -466,13 +505,15 @@ func insertRideStatusWithoutTransaction(ctx context.Context, ride_id, status str
 	}
 	defer tx.Rollback()
 
-	if _, err := insertRideStatus(ctx, tx, ride_id, status); err != nil {
+	_, committed, err := insertRideStatus(ctx, tx, ride_id, status)
+	if err != nil {
 		return err
 	}
 
 	if err := tx.Commit(); err != nil {
 		return err
 	}
+	committed()
 	return nil
 }
 
@@ -483,6 +524,17 @@ func updateLatestRideStatusCacheMap(rideStatus *RideStatus) {
 	latestRideStatusCacheMap[rideStatus.RideID] = rideStatus
 }
 
+func getLatestRideStatusEntryFromCache(rideID string) (RideStatus, bool) {
+	latestRideStatusCacheMapRWMutex.RLock()
+	defer latestRideStatusCacheMapRWMutex.RUnlock()
+
+	rideStatus, ok := latestRideStatusCacheMap[rideID]
+	if !ok {
+		return RideStatus{}, false
+	}
+	return *rideStatus, true
+}
+
 func getLatestRideStatusFromCache(ride_id string) (string, error) {
 	latestRideStatusCacheMapRWMutex.RLock()
 	defer latestRideStatusCacheMapRWMutex.RUnlock()
@@ -580,30 +632,80 @@ func chairPostActivity(w http.ResponseWriter, r *http.Request) {
 		return
 	}
 
+	if chair.IsActive && !req.IsActive {
+		publishOwnerWebhookEvent(chair.OwnerID, webhookEventChairDeactivated, &webhookChairData{
+			ChairID: chair.ID,
+			Name:    chair.Name,
+			Model:   chair.Model,
+		})
+	}
+
 	w.WriteHeader(http.StatusNoContent)
 }
 
+type chairPostCoordinateRequest struct {
+	Latitude  int `json:"latitude"`
+	Longitude int `json:"longitude"`
+	// 電池残量 (%) と整備が必要な箇所。送られなければ前回の値を使う
+	Battery          *int     `json:"battery"`
+	MaintenanceFlags []string `json:"maintenance_flags"`
+}
+
 type chairPostCoordinateResponse struct {
 	RecordedAt int64 `json:"recorded_at"`
 }
 
 func chairPostCoordinate(w http.ResponseWriter, r *http.Request) {
 	ctx := r.Context()
-	req := &Coordinate{}
+	req := &chairPostCoordinateRequest{}
 	if err := bindJSON(r, req); err != nil {
 		w.WriteHeader(http.StatusBadRequest)
 		return
 	}
+	if err := validateChairCondition(req.Battery, req.MaintenanceFlags); err != nil {
+		writeError(w, http.StatusBadRequest, err)
+		return
+	}
 
 	chair := ctx.Value("chair").(*Chair)
+	updatedAt, err := recordChairCoordinate(ctx, chair.ID, &Coordinate{Latitude: req.Latitude, Longitude: req.Longitude})
+	if err != nil {
+		if errors.Is(err, errOutOfServiceArea) {
+			writeError(w, http.StatusBadRequest, err)
+			return
+		}
+		writeError(w, http.StatusInternalServerError, err)
+		return
+	}
+	updateChairCondition(chair.ID, req.Battery, req.MaintenanceFlags, updatedAt)
+
+	writeJSON(w, http.StatusOK, &chairPostCoordinateResponse{
+		RecordedAt: updatedAt.UnixMilli(),
+	})
+}
+
+// recordChairCoordinate は椅子の位置を更新し、乗車地や目的地の範囲に入っていればライドの状態を進める
+// サービス地域の外の座標は errOutOfServiceArea を返して受け付けない
+func recordChairCoordinate(ctx context.Context, chairID string, req *Coordinate) (time.Time, error) {
 	updatedAt := time.Now()
 
+	if !isInServiceArea(*req) {
+		return updatedAt, errOutOfServiceArea
+	}
+	chair, err := getChairByID(chairID)
+	if err != nil {
+		return updatedAt, err
+	}
+
 	// メモリ上を更新する
 	chairLocationCacheMapRWMutex.Lock()
-	cll, ok := chairLocationCacheMap[chair.ID]
+	moved := 0
+	teleported := false
+	var elapsed time.Duration
+	cll, ok := chairLocationCacheMap[chairID]
 	if !ok {
 		cll = &ChairLocationLatest{
-			ChairID:       chair.ID,
+			ChairID:       chairID,
 			Latitude:      req.Latitude,
 			Longitude:     req.Longitude,
 			UpdatedAt:     updatedAt,
@@ -611,45 +713,63 @@ func chairPostCoordinate(w http.ResponseWriter, r *http.Request) {
 			isDirty:       true,
 		}
 	} else {
-		cll.TotalDistance += abs(cll.Latitude-req.Latitude) + abs(cll.Longitude-req.Longitude)
+		moved = abs(cll.Latitude-req.Latitude) + abs(cll.Longitude-req.Longitude)
+		elapsed = updatedAt.Sub(cll.UpdatedAt)
+		// ありえない移動は走行距離に数えない
+		if isTeleport(chair.Model, moved, elapsed) {
+			teleported = true
+		} else {
+			cll.TotalDistance += moved
+		}
 		cll.Latitude = req.Latitude
 		cll.Longitude = req.Longitude
 		cll.UpdatedAt = updatedAt
 		cll.isDirty = true
 	}
-	chairLocationCacheMap[chair.ID] = cll
+	chairLocationCacheMap[chairID] = cll
 	chairLocationCacheMapRWMutex.Unlock()
 
-	ride, _ := getLatestRideByChairId(chair.ID)
+	if teleported {
+		reportTeleport(ctx, chairID, *req, moved, elapsed, updatedAt)
+		moved = 0
+	} else {
+		clearChairFlagIfConsistent(ctx, chairID)
+	}
+
+	appendChairLocationHistory(chairID, *req, updatedAt)
+	publishChairLocation(chairID, *req, updatedAt)
+	markChairSeen(chairID, updatedAt)
+
+	ride, _ := getLatestRideByChairId(chairID)
 
 	if ride != nil {
 		// status, err := getLatestRideStatu(ride.ID)
 		status, err := getLatestRideStatusFromCache(ride.ID)
 		if err != nil {
-			writeError(w, http.StatusInternalServerError, err)
-			return
+			return updatedAt, err
 		}
+		addRideDrivenDistance(ride.ID, status, moved)
 
 		if status != "COMPLETED" && status != "CANCELED" {
-			if req.Latitude == ride.PickupLatitude && req.Longitude == ride.PickupLongitude && status == "ENROUTE" {
+			updateChairGeofence(chairID, ride, *req, updatedAt)
+
+			if status == "ENROUTE" && claimGeofenceTransition(chairID, ride.ID, geofencePickup) {
 				if err := insertRideStatusWithoutTransaction(ctx, ride.ID, "PICKUP"); err != nil {
-					writeError(w, http.StatusInternalServerError, err)
-					return
+					releaseGeofenceTransition(chairID, ride.ID, geofencePickup)
+					return updatedAt, err
 				}
 			}
 
-			if req.Latitude == ride.DestinationLatitude && req.Longitude == ride.DestinationLongitude && status == "CARRYING" {
+			if status == "CARRYING" && claimGeofenceTransition(chairID, ride.ID, geofenceDestination) {
 				if err := insertRideStatusWithoutTransaction(ctx, ride.ID, "ARRIVED"); err != nil {
-					writeError(w, http.StatusInternalServerError, err)
-					return
+					releaseGeofenceTransition(chairID, ride.ID, geofenceDestination)
+					return updatedAt, err
 				}
 			}
 		}
 	}
 
-	writeJSON(w, http.StatusOK, &chairPostCoordinateResponse{
-		RecordedAt: updatedAt.UnixMilli(),
-	})
+	return updatedAt, nil
 }
 
 type simpleUser struct {
@@ -671,8 +791,39 @@ type chairGetNotificationResponseData struct {
 	Status                string     `json:"status"`
 }
 
+func chairGetNotification(w http.ResponseWriter, r *http.Request) {
+	if wantsJSONNotification(r) {
+		chairGetNotificationPolling(w, r)
+		return
+	}
+	chairGetNotificationSSE(w, r)
+}
+
+// chairGetNotificationPolling は SSE と同じキューから未送信の通知を1件返し、無ければ現在の状態を返す
+func chairGetNotificationPolling(w http.ResponseWriter, r *http.Request) {
+	chair := r.Context().Value("chair").(*Chair)
+	touchChairPolledAt(chair.ID, time.Now())
+	stream := chairNotificationStreams.get(chair.ID)
+
+	if event, ok := stream.nextUnsent(); ok {
+		if stream.markSent(event.ID) && stream.markDelivered(event.Data.RideStatusId) {
+			notifyChairNotificationSent(chair.ID, event.Data)
+		}
+		writeJSON(w, http.StatusOK, &chairGetNotificationResponse{Data: event.Data, RetryAfterMs: chairRetryAfterMs})
+		return
+	}
+
+	snapshot := buildChairNotificationSnapshot(chair.ID)
+	// 状態が変わっていなければ、前回のポーリングで送信済みとして記録している
+	if snapshot != nil && stream.markDelivered(snapshot.RideStatusId) {
+		notifyChairNotificationSent(chair.ID, snapshot)
+	}
+	writeJSON(w, http.StatusOK, &chairGetNotificationResponse{Data: snapshot, RetryAfterMs: chairRetryAfterMs})
+}
+
 func chairGetNotificationSSE(w http.ResponseWriter, r *http.Request) {
-	ctx := r.Context()
+	ctx, cancel := withShutdown(r.Context())
+	defer cancel()
 	chair := ctx.Value("chair").(*Chair)
 
 	w.Header().Set("X-Accel-Buffering", "no")
@@ -682,30 +833,225 @@ func chairGetNotificationSSE(w http.ResponseWriter, r *http.Request) {
 	w.Header().Set("Cache-Control", "no-cache")
 	w.Header().Set("Connection", "keep-alive")
 
-	c := getChairGetNotificationResponseDataChannel(chair.ID)
+	disconnect := chairNotificationStreams.connect(chair.ID)
+	defer disconnect()
+
+	if err := writeSSERetry(w, chairRetryAfterMs); err != nil {
+		return
+	}
+
+	stream := chairNotificationStreams.get(chair.ID)
+	lastEventIDHeader := r.Header.Get("Last-Event-ID")
+
+	serveChairNotifications(
+		ctx, chair.ID, stream, resumeEventID(lastEventIDHeader, stream), lastEventIDHeader != "",
+		func(id int64, data *chairGetNotificationResponseData) error {
+			return writeChairNotification(w, chair.ID, id, data)
+		},
+		func() error {
+			return writeSSEHeartbeat(w)
+		},
+	)
+
+	if isShuttingDown() {
+		// 別のインスタンスや再起動後のサーバーに繋ぎ直してもらう
+		writeSSERetry(w, chairRetryAfterMs)
+	}
+}
+
+// serveChairNotifications は SSE と WebSocket で共通の送信ループ
+// send や heartbeat が失敗したら切断されているので終了する
+func serveChairNotifications(
+	ctx context.Context,
+	chairID string,
+	stream *notificationStream[chairGetNotificationResponseData],
+	lastEventID int64,
+	resumed bool,
+	send func(id int64, data *chairGetNotificationResponseData) error,
+	heartbeat func() error,
+) {
+	// 未送信の通知が無ければ、最初に現在のライドの状態を送る
+	if !resumed && !stream.hasEventsAfter(lastEventID) {
+		if snapshot := buildChairNotificationSnapshot(chairID); snapshot != nil {
+			if err := send(0, snapshot); err != nil {
+				return
+			}
+			if stream.markDelivered(snapshot.RideStatusId) {
+				notifyChairNotificationSent(chairID, snapshot)
+			}
+		}
+	}
+
+	heartbeatTicker := time.NewTicker(notificationHeartbeatInterval)
+	defer heartbeatTicker.Stop()
 
 	for {
+		events, wakeup := stream.eventsAfter(lastEventID)
+		for _, event := range events {
+			if err := send(event.ID, event.Data); err != nil {
+				return
+			}
+			lastEventID = event.ID
+
+			if !stream.markSent(event.ID) || !stream.markDelivered(event.Data.RideStatusId) {
+				// 再送なので送信済みの記録は不要
+				continue
+			}
+			notifyChairNotificationSent(chairID, event.Data)
+		}
+
 		select {
-		case dataFromChannel := <-c:
-			b, _ := json.Marshal(dataFromChannel)
-			fmt.Fprintf(w, "data: %s\n", b)
-			w.(http.Flusher).Flush()
-
-			slog.Info("chairGetNotification - sent", "chair", chair.ID, "status", dataFromChannel.Status)
-
-			rideStatusSentAtChan <- RideStatusSentAtRequest{
-				RideStatusID: dataFromChannel.RideStatusId,
-				RideID:       dataFromChannel.RideID,
-				ChairID:      chair.ID,
-				Status:       dataFromChannel.Status,
-				SentType:     ChairNotification,
+		case <-wakeup:
+		case <-heartbeatTicker.C:
+			if err := heartbeat(); err != nil {
+				return
 			}
-		case <-r.Context().Done():
+		case <-ctx.Done():
 			return
 		}
 	}
 }
 
+// buildChairNotificationSnapshot は椅子に割り当てられた最新のライドとその状態から通知を作る
+func buildChairNotificationSnapshot(chairID string) *chairGetNotificationResponseData {
+	ride, found := getLatestRideByChairId(chairID)
+	if !found {
+		return nil
+	}
+	rideStatus, found := getLatestRideStatusEntryFromCache(ride.ID)
+	if !found {
+		return nil
+	}
+	_, data, err := buildChairGetNotificationResponseData(rideStatus.ID, ride.ID, rideStatus.Status)
+	if err != nil {
+		slog.Error("buildChairNotificationSnapshot - failed to build", "error", err)
+		return nil
+	}
+	return data
+}
+
+// writeChairNotification は id が 0 なら id フィールドを付けずに書く
+func writeChairNotification(w http.ResponseWriter, chairID string, id int64, data *chairGetNotificationResponseData) error {
+	b, _ := json.Marshal(data)
+	if id != 0 {
+		fmt.Fprintf(w, "id: %d\n", id)
+	}
+	if _, err := fmt.Fprintf(w, "data: %s\n\n", b); err != nil {
+		return err
+	}
+	w.(http.Flusher).Flush()
+
+	slog.Info("chairGetNotification - sent", "chair", chairID, "status", data.Status)
+	return nil
+}
+
+type chairWebSocketRequest struct {
+	Type             string   `json:"type"`
+	Latitude         int      `json:"latitude"`
+	Longitude        int      `json:"longitude"`
+	Battery          *int     `json:"battery"`
+	MaintenanceFlags []string `json:"maintenance_flags"`
+}
+
+type chairWebSocketNotification struct {
+	Type string                            `json:"type"`
+	ID   int64                             `json:"id,omitempty"`
+	Data *chairGetNotificationResponseData `json:"data"`
+}
+
+type chairWebSocketCoordinateResponse struct {
+	Type       string `json:"type"`
+	RecordedAt int64  `json:"recorded_at"`
+}
+
+type chairWebSocketError struct {
+	Type    string `json:"type"`
+	Message string `json:"message"`
+}
+
+// chairGetWebSocket は座標の送信と通知の受信を1つの接続で行う
+// 再接続時は last_event_id クエリで最後に受け取ったイベントIDを渡す
+func chairGetWebSocket(w http.ResponseWriter, r *http.Request) {
+	chair := r.Context().Value("chair").(*Chair)
+
+	conn, err := upgradeWebSocket(w, r)
+	if err != nil {
+		return
+	}
+	defer conn.close()
+
+	// ハイジャックした接続ではリクエストのコンテキストがキャンセルされないので、読み込みが終わるかサーバーが止まるまで続ける
+	ctx, cancel := withShutdown(context.Background())
+	defer cancel()
+
+	disconnect := chairNotificationStreams.connect(chair.ID)
+	defer disconnect()
+
+	go func() {
+		defer cancel()
+		for {
+			msg, err := conn.readMessage()
+			if err != nil {
+				return
+			}
+			if err := handleChairWebSocketMessage(ctx, conn, chair.ID, msg); err != nil {
+				return
+			}
+		}
+	}()
+
+	stream := chairNotificationStreams.get(chair.ID)
+	lastEventIDParam := r.URL.Query().Get("last_event_id")
+
+	serveChairNotifications(
+		ctx, chair.ID, stream, resumeEventID(lastEventIDParam, stream), lastEventIDParam != "",
+		func(id int64, data *chairGetNotificationResponseData) error {
+			return conn.writeJSON(&chairWebSocketNotification{Type: "notification", ID: id, Data: data})
+		},
+		conn.ping,
+	)
+
+	if isShuttingDown() {
+		conn.closeGoingAway()
+	}
+}
+
+func handleChairWebSocketMessage(ctx context.Context, conn *websocketConn, chairID string, msg []byte) error {
+	req := &chairWebSocketRequest{}
+	if err := json.Unmarshal(msg, req); err != nil {
+		return conn.writeJSON(&chairWebSocketError{Type: "error", Message: "invalid message"})
+	}
+
+	switch req.Type {
+	case "coordinate":
+		if err := validateChairCondition(req.Battery, req.MaintenanceFlags); err != nil {
+			return conn.writeJSON(&chairWebSocketError{Type: "error", Message: err.Error()})
+		}
+		updatedAt, err := recordChairCoordinate(ctx, chairID, &Coordinate{Latitude: req.Latitude, Longitude: req.Longitude})
+		if errors.Is(err, errOutOfServiceArea) {
+			return conn.writeJSON(&chairWebSocketError{Type: "error", Message: err.Error()})
+		}
+		if err != nil {
+			slog.Error("chairGetWebSocket - failed to record coordinate", "error", err)
+			return conn.writeJSON(&chairWebSocketError{Type: "error", Message: err.Error()})
+		}
+		updateChairCondition(chairID, req.Battery, req.MaintenanceFlags, updatedAt)
+		return conn.writeJSON(&chairWebSocketCoordinateResponse{Type: "coordinate", RecordedAt: updatedAt.UnixMilli()})
+	default:
+		return conn.writeJSON(&chairWebSocketError{Type: "error", Message: "unknown message type"})
+	}
+}
+
+func notifyChairNotificationSent(chairID string, data *chairGetNotificationResponseData) {
+	rideStatusSentAtChan <- RideStatusSentAtRequest{
+		RideStatusID: data.RideStatusId,
+		RideID:       data.RideID,
+		ChairID:      chairID,
+		Status:       data.Status,
+		SentType:     ChairNotification,
+	}
+}
+
 type postChairRidesRideIDStatusRequest struct {
 	Status string `json:"status"`
 }
@@ -793,10 +1139,29 @@ func chairPostRideStatus(w http.ResponseWriter, r *http.Request) {
 	w.WriteHeader(http.StatusNoContent)
 }
 
+var chairPostRideStatusSyncer *asyncWorker
+
 func launchChairPostRideStatusSyncer() {
+	worker := newAsyncWorker()
+	chairPostRideStatusSyncer = worker
+
 	go func() {
-		for req := range chairPostRideStatusUpdateChan {
-			insertRideStatusWithoutTransaction(context.Background(), req.rideID, req.status)
+		defer close(worker.done)
+		for {
+			select {
+			case req := <-chairPostRideStatusUpdateChan:
+				insertRideStatusWithoutTransaction(context.Background(), req.rideID, req.status)
+			case <-worker.stop:
+				// 停止時はキューに残っている分を書き切る
+				for {
+					select {
+					case req := <-chairPostRideStatusUpdateChan:
+						insertRideStatusWithoutTransaction(context.Background(), req.rideID, req.status)
+					default:
+						return
+					}
+				}
+			}
 		}
 	}()
 }
@@ -0,0 +1,143 @@
+package main
+
+import (
+	"context"
+	"sort"
+	"sync"
+	"time"
+)
+
+// 椅子が生きているかは、通知の接続が開いているか、最後に座標を送ってきた・通知を取りに来た時刻で判断する
+// 落ちた椅子が is_active = 1 のまま残っても、マッチングや周辺の椅子の一覧に出さない
+// 複数台構成 (ISUCON_NOTIFICATION_BUS=mysql) では椅子が別のノードに繋いでいることがあるので、
+// 各ノードが見た時刻を chair_liveness に書き、他のノードが見た時刻も読み込んで判断に加える
+
+// この時間より長く何も届かない椅子はオフラインとみなす
+var chairLivenessTimeout = 60 * time.Second
+
+// chair_liveness を通してノード間で共有するか
+var chairLivenessShared = false
+
+// ポーリングで通知を取りに来た時刻。座標の更新時刻は chairLocationCacheMap にある
+var chairPolledAtMutex = sync.Mutex{}
+var chairPolledAt map[string]time.Time = make(map[string]time.Time)
+
+// chairSeenPending は前回 chair_liveness に書いてから、このノードで椅子を見た時刻
+// chairSharedSeenAt は他のノードも含め chair_liveness に記録されている時刻
+var chairSeenMutex = sync.Mutex{}
+var chairSeenPending map[string]time.Time = make(map[string]time.Time)
+var chairSharedSeenAt map[string]time.Time = make(map[string]time.Time)
+
+func touchChairPolledAt(chairID string, t time.Time) {
+	chairPolledAtMutex.Lock()
+	chairPolledAt[chairID] = t
+	chairPolledAtMutex.Unlock()
+
+	markChairSeen(chairID, t)
+}
+
+// markChairSeen は共有する場合に、次に chair_liveness に書く時刻として記録する
+func markChairSeen(chairID string, t time.Time) {
+	if !chairLivenessShared {
+		return
+	}
+	chairSeenMutex.Lock()
+	defer chairSeenMutex.Unlock()
+
+	if t.After(chairSeenPending[chairID]) {
+		chairSeenPending[chairID] = t
+	}
+}
+
+func resetChairLiveness() {
+	chairPolledAtMutex.Lock()
+	chairPolledAt = make(map[string]time.Time)
+	chairPolledAtMutex.Unlock()
+
+	chairSeenMutex.Lock()
+	chairSeenPending = make(map[string]time.Time)
+	chairSharedSeenAt = make(map[string]time.Time)
+	chairSeenMutex.Unlock()
+}
+
+// chairLastSeenAt は座標の更新時刻、ポーリングの時刻、他のノードが見た時刻のうち最も新しいものを返す
+// 呼び出し側で chairLocationCacheMapRWMutex を取っている前提で、座標の更新時刻は引数で受け取る
+func chairLastSeenAt(chairID string, locationUpdatedAt time.Time) time.Time {
+	chairPolledAtMutex.Lock()
+	polledAt := chairPolledAt[chairID]
+	chairPolledAtMutex.Unlock()
+
+	chairSeenMutex.Lock()
+	sharedAt := chairSharedSeenAt[chairID]
+	chairSeenMutex.Unlock()
+
+	lastSeenAt := locationUpdatedAt
+	if polledAt.After(lastSeenAt) {
+		lastSeenAt = polledAt
+	}
+	if sharedAt.After(lastSeenAt) {
+		lastSeenAt = sharedAt
+	}
+	return lastSeenAt
+}
+
+func isChairOnline(chairID string, locationUpdatedAt time.Time, now time.Time) bool {
+	if chairNotificationStreams.isConnected(chairID) {
+		return true
+	}
+	return now.Sub(chairLastSeenAt(chairID, locationUpdatedAt)) <= chairLivenessTimeout
+}
+
+// syncChairLiveness はこのノードで見た時刻を chair_liveness に書き、タイムアウト内に見られた椅子を読み直す
+func syncChairLiveness(ctx context.Context) error {
+	if !chairLivenessShared {
+		return nil
+	}
+	now := time.Now()
+
+	chairSeenMutex.Lock()
+	seen := chairSeenPending
+	chairSeenPending = make(map[string]time.Time)
+	chairSeenMutex.Unlock()
+
+	// 接続を開いたままの椅子は何も送ってこないので、書くたびに今の時刻で記録する
+	for _, chairID := range chairNotificationStreams.connectedKeys() {
+		seen[chairID] = now
+	}
+
+	rows := make([]ChairLiveness, 0, len(seen))
+	for chairID, t := range seen {
+		rows = append(rows, ChairLiveness{ChairID: chairID, LastSeenAt: t.Truncate(time.Microsecond)})
+	}
+	// 複数のノードが同時に書いてもデッドロックしないよう、ロックを取る順番を揃える
+	sort.Slice(rows, func(i, j int) bool { return rows[i].ChairID < rows[j].ChairID })
+
+	for start := 0; start < len(rows); start += chairLocationFlushBatchSize {
+		end := min(start+chairLocationFlushBatchSize, len(rows))
+		if _, err := db.NamedExecContext(
+			ctx,
+			`INSERT INTO chair_liveness (chair_id, last_seen_at) VALUES (:chair_id, :last_seen_at)
+			ON DUPLICATE KEY UPDATE last_seen_at = GREATEST(last_seen_at, VALUES(last_seen_at))`,
+			rows[start:end],
+		); err != nil {
+			for _, row := range rows[start:] {
+				markChairSeen(row.ChairID, row.LastSeenAt)
+			}
+			return err
+		}
+	}
+
+	shared := []ChairLiveness{}
+	if err := db.SelectContext(ctx, &shared, "SELECT * FROM chair_liveness WHERE last_seen_at > ?", now.Add(-chairLivenessTimeout)); err != nil {
+		return err
+	}
+	sharedSeenAt := make(map[string]time.Time, len(shared))
+	for _, row := range shared {
+		sharedSeenAt[row.ChairID] = row.LastSeenAt
+	}
+
+	chairSeenMutex.Lock()
+	chairSharedSeenAt = sharedSeenAt
+	chairSeenMutex.Unlock()
+	return nil
+}
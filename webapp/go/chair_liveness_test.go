@@ -0,0 +1,41 @@
+package main
+
+import (
+	"testing"
+	"time"
+)
+
+func TestIsChairOnline(t *testing.T) {
+	now := time.Now()
+	stale := now.Add(-2 * chairLivenessTimeout)
+	recent := now.Add(-chairLivenessTimeout / 2)
+
+	tests := []struct {
+		name              string
+		locationUpdatedAt time.Time
+		polledAt          time.Time
+		sharedAt          time.Time
+		want              bool
+	}{
+		{name: "recent coordinate", locationUpdatedAt: recent, want: true},
+		{name: "recent polling", locationUpdatedAt: stale, polledAt: recent, want: true},
+		{name: "seen by another node", locationUpdatedAt: stale, polledAt: stale, sharedAt: recent, want: true},
+		{name: "nothing recent", locationUpdatedAt: stale, polledAt: stale, sharedAt: stale, want: false},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			resetChairLiveness()
+			defer resetChairLiveness()
+			if !tt.polledAt.IsZero() {
+				chairPolledAt["chair"] = tt.polledAt
+			}
+			if !tt.sharedAt.IsZero() {
+				chairSharedSeenAt["chair"] = tt.sharedAt
+			}
+
+			if got := isChairOnline("chair", tt.locationUpdatedAt, now); got != tt.want {
+				t.Errorf("isChairOnline = %v, want %v", got, tt.want)
+			}
+		})
+	}
+}
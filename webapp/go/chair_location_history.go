@@ -0,0 +1,111 @@
+package main
+
+import (
+	"context"
+	"log/slog"
+	"sync"
+	"time"
+
+	"github.com/oklog/ulid/v2"
+)
+
+// 座標の履歴は chair_locations に追記する。リクエストごとには書かず、最新位置と一緒にまとめて書き込む
+
+// DB に書けない状態が続いてもメモリを使い切らないよう、溜める件数に上限を設ける
+const chairLocationHistoryBufferLimit = 100000
+
+const chairLocationHistoryBatchSize = 1000
+
+var chairLocationHistoryMutex = sync.Mutex{}
+var chairLocationHistoryBuffer []ChairLocation
+
+func resetChairLocationHistory() {
+	chairLocationHistoryMutex.Lock()
+	defer chairLocationHistoryMutex.Unlock()
+
+	chairLocationHistoryBuffer = nil
+}
+
+func appendChairLocationHistory(chairID string, coordinate Coordinate, createdAt time.Time) {
+	chairLocationHistoryMutex.Lock()
+	defer chairLocationHistoryMutex.Unlock()
+
+	if len(chairLocationHistoryBuffer) >= chairLocationHistoryBufferLimit {
+		slog.Warn("chair location history buffer is full, dropping the oldest entry")
+		chairLocationHistoryBuffer = chairLocationHistoryBuffer[1:]
+	}
+	chairLocationHistoryBuffer = append(chairLocationHistoryBuffer, ChairLocation{
+		ID:        ulid.Make().String(),
+		ChairID:   chairID,
+		Latitude:  coordinate.Latitude,
+		Longitude: coordinate.Longitude,
+		CreatedAt: createdAt.Truncate(time.Microsecond),
+	})
+}
+
+// getBufferedChairLocations はまだ DB に書いていない履歴のうち、期間内のものを返す
+func getBufferedChairLocations(chairID string, since, until time.Time) []ChairLocation {
+	chairLocationHistoryMutex.Lock()
+	defer chairLocationHistoryMutex.Unlock()
+
+	locations := []ChairLocation{}
+	for _, location := range chairLocationHistoryBuffer {
+		if location.ChairID == chairID && !location.CreatedAt.Before(since) && !location.CreatedAt.After(until) {
+			locations = append(locations, location)
+		}
+	}
+	return locations
+}
+
+// flushChairLocationHistory は溜まっている履歴を書き込む。失敗した分は次の周期で書き直す
+func flushChairLocationHistory(ctx context.Context) error {
+	chairLocationHistoryMutex.Lock()
+	locations := chairLocationHistoryBuffer
+	chairLocationHistoryBuffer = nil
+	chairLocationHistoryMutex.Unlock()
+
+	for start := 0; start < len(locations); start += chairLocationHistoryBatchSize {
+		end := min(start+chairLocationHistoryBatchSize, len(locations))
+		if _, err := db.NamedExecContext(
+			ctx,
+			"INSERT INTO chair_locations (id, chair_id, latitude, longitude, created_at) VALUES (:id, :chair_id, :latitude, :longitude, :created_at)",
+			locations[start:end],
+		); err != nil {
+			chairLocationHistoryMutex.Lock()
+			chairLocationHistoryBuffer = append(locations[start:], chairLocationHistoryBuffer...)
+			if over := len(chairLocationHistoryBuffer) - chairLocationHistoryBufferLimit; over > 0 {
+				chairLocationHistoryBuffer = chairLocationHistoryBuffer[over:]
+			}
+			chairLocationHistoryMutex.Unlock()
+			return err
+		}
+	}
+	return nil
+}
+
+// getChairLocationHistory は DB とまだ書いていない分を合わせ、古い順に最大 limit 件返す
+func getChairLocationHistory(ctx context.Context, chairID string, since, until time.Time, limit int) ([]ChairLocation, error) {
+	locations := []ChairLocation{}
+	if err := db.SelectContext(
+		ctx,
+		&locations,
+		"SELECT * FROM chair_locations WHERE chair_id = ? AND created_at BETWEEN ? AND ? ORDER BY created_at LIMIT ?",
+		chairID, since, until, limit,
+	); err != nil {
+		return nil, err
+	}
+
+	seen := make(map[string]struct{}, len(locations))
+	for _, location := range locations {
+		seen[location.ID] = struct{}{}
+	}
+	for _, location := range getBufferedChairLocations(chairID, since, until) {
+		if len(locations) >= limit {
+			break
+		}
+		if _, ok := seen[location.ID]; !ok {
+			locations = append(locations, location)
+		}
+	}
+	return locations, nil
+}
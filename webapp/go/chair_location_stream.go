@@ -0,0 +1,183 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"sync"
+	"time"
+)
+
+// 乗客に椅子の位置を送る最短の間隔。これより頻繁な座標の更新は間引く
+const chairLocationStreamInterval = 1 * time.Second
+
+// 椅子は1回の移動 (座標の送信) でモデルの speed だけ進むので、その間隔から到着までの時間を見積もる
+const chairMoveInterval = 1 * time.Second
+
+var chairModelSpeedCacheRWMutex = sync.RWMutex{}
+var chairModelSpeedCache map[string]int = make(map[string]int)
+
+func loadChairModelSpeedCache() error {
+	chairModelSpeedCacheRWMutex.Lock()
+	defer chairModelSpeedCacheRWMutex.Unlock()
+
+	models := []ChairModel{}
+	if err := db.Select(&models, "SELECT * FROM chair_models"); err != nil {
+		return err
+	}
+
+	chairModelSpeedCache = make(map[string]int)
+	for _, model := range models {
+		chairModelSpeedCache[model.Name] = model.Speed
+	}
+	return nil
+}
+
+func getChairModelSpeed(model string) (int, bool) {
+	chairModelSpeedCacheRWMutex.RLock()
+	defer chairModelSpeedCacheRWMutex.RUnlock()
+
+	speed, ok := chairModelSpeedCache[model]
+	return speed, ok
+}
+
+type appChairLocationData struct {
+	RideID     string     `json:"ride_id"`
+	ChairID    string     `json:"chair_id"`
+	Coordinate Coordinate `json:"coordinate"`
+	// 向かっている地点。ENROUTE なら PICKUP、CARRYING なら DESTINATION
+	Target     string `json:"target"`
+	Distance   int    `json:"distance"`
+	EtaMs      int64  `json:"eta_ms"`
+	RecordedAt int64  `json:"recorded_at"`
+}
+
+// chairLocationFeed はユーザーごとの最新の椅子の位置だけを持つ。状態の通知と違い再送はしない
+type chairLocationFeed struct {
+	mu          sync.Mutex
+	subscribers int
+	latest      *appChairLocationData
+	publishedAt time.Time
+	wakeup      chan struct{}
+	// 間引いた更新を間隔の終わりに送るためのタイマー。待っている間は nil でない
+	trailing *time.Timer
+}
+
+var chairLocationFeedsMutex = sync.Mutex{}
+var chairLocationFeeds map[string]*chairLocationFeed = make(map[string]*chairLocationFeed)
+
+// subscribeChairLocation は購読を始め、終了時に呼ぶ関数を返す
+func subscribeChairLocation(userID string) (*chairLocationFeed, func()) {
+	chairLocationFeedsMutex.Lock()
+	defer chairLocationFeedsMutex.Unlock()
+
+	feed, ok := chairLocationFeeds[userID]
+	if !ok {
+		feed = &chairLocationFeed{wakeup: make(chan struct{})}
+		chairLocationFeeds[userID] = feed
+	}
+	feed.subscribers++
+
+	return feed, func() {
+		chairLocationFeedsMutex.Lock()
+		defer chairLocationFeedsMutex.Unlock()
+
+		feed.subscribers--
+		if feed.subscribers <= 0 {
+			delete(chairLocationFeeds, userID)
+		}
+	}
+}
+
+func (f *chairLocationFeed) current() (*appChairLocationData, <-chan struct{}) {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+
+	return f.latest, f.wakeup
+}
+
+// publish は常に最新の位置を持ち、購読者を起こすのは chairLocationStreamInterval に1回だけにする
+// 間隔内の更新は間隔の終わりにまとめて送るので、最後の位置が送られないことはない
+func (f *chairLocationFeed) publish(data *appChairLocationData, now time.Time) {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+
+	f.latest = data
+	if f.trailing != nil {
+		return
+	}
+	if wait := chairLocationStreamInterval - now.Sub(f.publishedAt); wait > 0 {
+		f.trailing = time.AfterFunc(wait, func() {
+			f.mu.Lock()
+			defer f.mu.Unlock()
+
+			f.trailing = nil
+			f.notify(time.Now())
+		})
+		return
+	}
+	f.notify(now)
+}
+
+func (f *chairLocationFeed) notify(now time.Time) {
+	f.publishedAt = now
+	close(f.wakeup)
+	f.wakeup = make(chan struct{})
+}
+
+// publishChairLocation は椅子が乗客のもとへ向かっているか乗せて走っているときだけ、購読中の乗客に位置を送る
+func publishChairLocation(chairID string, coordinate Coordinate, recordedAt time.Time) {
+	ride, found := getLatestRideByChairId(chairID)
+	if !found {
+		return
+	}
+
+	chairLocationFeedsMutex.Lock()
+	feed, ok := chairLocationFeeds[ride.UserID]
+	chairLocationFeedsMutex.Unlock()
+	if !ok {
+		return
+	}
+
+	status, err := getLatestRideStatusFromCache(ride.ID)
+	if err != nil {
+		return
+	}
+	data := &appChairLocationData{
+		RideID:     ride.ID,
+		ChairID:    chairID,
+		Coordinate: coordinate,
+		RecordedAt: recordedAt.UnixMilli(),
+	}
+	switch status {
+	case "ENROUTE":
+		data.Target = "PICKUP"
+		data.Distance = abs(coordinate.Latitude-ride.PickupLatitude) + abs(coordinate.Longitude-ride.PickupLongitude)
+	case "CARRYING":
+		data.Target = "DESTINATION"
+		data.Distance = abs(coordinate.Latitude-ride.DestinationLatitude) + abs(coordinate.Longitude-ride.DestinationLongitude)
+	default:
+		return
+	}
+
+	chair, err := getChairByID(chairID)
+	if err != nil {
+		return
+	}
+	if speed, ok := getChairModelSpeed(chair.Model); ok && speed > 0 {
+		moves := (data.Distance + speed - 1) / speed
+		data.EtaMs = int64(moves) * chairMoveInterval.Milliseconds()
+	}
+
+	feed.publish(data, recordedAt)
+}
+
+// writeChairLocationEvent は状態の通知と区別できるよう chair_location という名前付きイベントで送る
+func writeChairLocationEvent(w http.ResponseWriter, data *appChairLocationData) error {
+	b, _ := json.Marshal(data)
+	if _, err := fmt.Fprintf(w, "event: chair_location\ndata: %s\n\n", b); err != nil {
+		return err
+	}
+	w.(http.Flusher).Flush()
+	return nil
+}
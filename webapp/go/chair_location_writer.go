@@ -0,0 +1,124 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"log/slog"
+	"time"
+)
+
+// 椅子の最新位置はメモリ上で更新し、この間隔でまとめて DB に書き戻す
+const chairLocationFlushInterval = 1 * time.Second
+
+// 1回の INSERT に含める行数
+const chairLocationFlushBatchSize = 500
+
+var chairLocationWriter *asyncWorker
+
+// snapshotDirtyChairLocations は更新された位置のコピーを取り、更新済みの印を外す
+// DB への書き込みはロックの外で行う
+func snapshotDirtyChairLocations() []ChairLocationLatest {
+	chairLocationCacheMapRWMutex.Lock()
+	defer chairLocationCacheMapRWMutex.Unlock()
+
+	locations := []ChairLocationLatest{}
+	for _, cll := range chairLocationCacheMap {
+		if cll.isDirty {
+			locations = append(locations, *cll)
+			cll.isDirty = false
+		}
+	}
+	return locations
+}
+
+// markChairLocationsDirty は書き込みに失敗した椅子を次の周期で再び書くようにする
+// その間に更新されていても、キャッシュには最新の値があるのでそれを書けばよい
+func markChairLocationsDirty(locations []ChairLocationLatest) {
+	chairLocationCacheMapRWMutex.Lock()
+	defer chairLocationCacheMapRWMutex.Unlock()
+
+	for _, location := range locations {
+		if cll, ok := chairLocationCacheMap[location.ChairID]; ok {
+			cll.isDirty = true
+		}
+	}
+}
+
+func upsertChairLocations(ctx context.Context, locations []ChairLocationLatest) error {
+	for start := 0; start < len(locations); start += chairLocationFlushBatchSize {
+		end := min(start+chairLocationFlushBatchSize, len(locations))
+		if _, err := db.NamedExecContext(
+			ctx,
+			`INSERT INTO chair_locations_latest (chair_id, latitude, longitude, updated_at, total_distance)
+			VALUES (:chair_id, :latitude, :longitude, :updated_at, :total_distance)
+			ON DUPLICATE KEY UPDATE
+				latitude = VALUES(latitude), longitude = VALUES(longitude), updated_at = VALUES(updated_at), total_distance = VALUES(total_distance)`,
+			locations[start:end],
+		); err != nil {
+			markChairLocationsDirty(locations[start:])
+			return err
+		}
+	}
+	return nil
+}
+
+func flushChairLocations(ctx context.Context) error {
+	locations := snapshotDirtyChairLocations()
+	if len(locations) == 0 {
+		return nil
+	}
+	return upsertChairLocations(ctx, locations)
+}
+
+// chairLocationFlushers は椅子の位置の書き込みに合わせてまとめて DB に書くもの
+// 周期ごとの書き込みと停止時の書き切りの両方でこの順に呼ぶ
+var chairLocationFlushers = []struct {
+	name  string
+	flush func(context.Context) error
+}{
+	{name: "chair locations", flush: flushChairLocations},
+	{name: "chair location history", flush: flushChairLocationHistory},
+	{name: "ride metrics", flush: flushRideMetrics},
+	{name: "ride geofence events", flush: flushRideGeofenceEvents},
+	{name: "chair conditions", flush: flushChairConditions},
+	{name: "chair liveness", flush: syncChairLiveness},
+}
+
+func launchChairLocationWriter() {
+	writer := newAsyncWorker()
+	chairLocationWriter = writer
+
+	go func() {
+		defer close(writer.done)
+		ticker := time.NewTicker(chairLocationFlushInterval)
+		defer ticker.Stop()
+		for {
+			select {
+			case <-ticker.C:
+				for _, f := range chairLocationFlushers {
+					if err := f.flush(context.Background()); err != nil {
+						slog.Error("failed to flush", "target", f.name, "error", err)
+					}
+				}
+			case <-writer.stop:
+				return
+			}
+		}
+	}()
+}
+
+// shutdownChairLocationWriter は定期的な書き込みを止め、chairLocationFlushers に残っているものを書き切る
+// 1つが失敗しても残りは書く
+func shutdownChairLocationWriter(ctx context.Context) error {
+	if err := chairLocationWriter.shutdown(ctx); err != nil {
+		return err
+	}
+	errs := []error{}
+	for _, f := range chairLocationFlushers {
+		if err := f.flush(ctx); err != nil {
+			errs = append(errs, fmt.Errorf("flush %s: %w", f.name, err))
+		}
+	}
+	return errors.Join(errs...)
+}
@@ -0,0 +1,243 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"log/slog"
+	"sort"
+	"sync"
+	"time"
+	_ "time/tzdata"
+)
+
+// オーナーが決めた週ごとの稼働時間に合わせて椅子の稼働状態を切り替える
+// 稼働時間が登録されていない椅子は chairPostActivity でのみ切り替わる
+
+// 稼働時間を確認する間隔
+const chairScheduleCheckInterval = 30 * time.Second
+
+// 稼働時間の終わりがこの時間内に迫っている椅子には新しいライドを割り当てない
+const chairScheduleOffShiftMargin = 10 * time.Minute
+
+const minutesPerDay = 24 * 60
+
+// 稼働時間を解釈するタイムゾーン
+var chairScheduleLocation = time.Local
+
+var chairScheduleCacheRWMutex = sync.RWMutex{}
+var chairScheduleCache map[string][]ChairSchedule = make(map[string][]ChairSchedule)
+
+// 最後に稼働時間から決めた状態。変わったときだけ切り替えるので、稼働時間中の手動の切り替えは上書きしない
+// 再起動しても手動の切り替えを上書きしないよう chair_schedule_applied にも書く
+var chairScheduleAppliedMutex = sync.Mutex{}
+var chairScheduleApplied map[string]bool = make(map[string]bool)
+
+var chairScheduler *asyncWorker
+
+func loadChairScheduleCache() error {
+	schedules := []ChairSchedule{}
+	if err := db.Select(&schedules, "SELECT * FROM chair_schedules ORDER BY chair_id, day_of_week, start_minute"); err != nil {
+		return err
+	}
+
+	chairScheduleCacheRWMutex.Lock()
+	chairScheduleCache = make(map[string][]ChairSchedule)
+	for _, schedule := range schedules {
+		chairScheduleCache[schedule.ChairID] = append(chairScheduleCache[schedule.ChairID], schedule)
+	}
+	chairScheduleCacheRWMutex.Unlock()
+
+	applied := []ChairScheduleApplied{}
+	if err := db.Select(&applied, "SELECT * FROM chair_schedule_applied"); err != nil {
+		return err
+	}
+	chairScheduleAppliedMutex.Lock()
+	chairScheduleApplied = make(map[string]bool)
+	for _, a := range applied {
+		chairScheduleApplied[a.ChairID] = a.IsActive
+	}
+	chairScheduleAppliedMutex.Unlock()
+	return nil
+}
+
+func getChairScheduleFromCache(chairID string) []ChairSchedule {
+	chairScheduleCacheRWMutex.RLock()
+	defer chairScheduleCacheRWMutex.RUnlock()
+
+	return append([]ChairSchedule{}, chairScheduleCache[chairID]...)
+}
+
+// validateChairSchedule は稼働時間を検証し、曜日と開始時刻の順に並べる
+func validateChairSchedule(schedules []ChairSchedule) error {
+	for _, s := range schedules {
+		if s.DayOfWeek < 0 || s.DayOfWeek > 6 {
+			return errors.New("day_of_week must be between 0 and 6")
+		}
+		if s.StartMinute < 0 || s.EndMinute > minutesPerDay || s.StartMinute >= s.EndMinute {
+			return errors.New("start_minute and end_minute must satisfy 0 <= start_minute < end_minute <= 1440")
+		}
+	}
+
+	sort.Slice(schedules, func(i, j int) bool {
+		if schedules[i].DayOfWeek != schedules[j].DayOfWeek {
+			return schedules[i].DayOfWeek < schedules[j].DayOfWeek
+		}
+		return schedules[i].StartMinute < schedules[j].StartMinute
+	})
+	for i := 1; i < len(schedules); i++ {
+		if schedules[i].DayOfWeek == schedules[i-1].DayOfWeek && schedules[i].StartMinute < schedules[i-1].EndMinute {
+			return errors.New("slots must not overlap")
+		}
+	}
+	return nil
+}
+
+// replaceChairSchedule は椅子の稼働時間を置き換える。空なら稼働時間の管理をやめる
+func replaceChairSchedule(ctx context.Context, chairID string, schedules []ChairSchedule) error {
+	tx, err := db.Beginx()
+	if err != nil {
+		return err
+	}
+	defer tx.Rollback()
+
+	if _, err := tx.ExecContext(ctx, "DELETE FROM chair_schedules WHERE chair_id = ?", chairID); err != nil {
+		return err
+	}
+	if _, err := tx.ExecContext(ctx, "DELETE FROM chair_schedule_applied WHERE chair_id = ?", chairID); err != nil {
+		return err
+	}
+	if len(schedules) > 0 {
+		if _, err := tx.NamedExecContext(
+			ctx,
+			"INSERT INTO chair_schedules (chair_id, day_of_week, start_minute, end_minute) VALUES (:chair_id, :day_of_week, :start_minute, :end_minute)",
+			schedules,
+		); err != nil {
+			return err
+		}
+	}
+	if err := tx.Commit(); err != nil {
+		return err
+	}
+
+	chairScheduleCacheRWMutex.Lock()
+	if len(schedules) == 0 {
+		delete(chairScheduleCache, chairID)
+	} else {
+		chairScheduleCache[chairID] = schedules
+	}
+	chairScheduleCacheRWMutex.Unlock()
+
+	// 新しい稼働時間で次の確認のときに状態を決め直す
+	chairScheduleAppliedMutex.Lock()
+	delete(chairScheduleApplied, chairID)
+	chairScheduleAppliedMutex.Unlock()
+	return nil
+}
+
+func isOnShift(schedules []ChairSchedule, t time.Time) bool {
+	t = t.In(chairScheduleLocation)
+	day := int(t.Weekday())
+	minute := t.Hour()*60 + t.Minute()
+	for _, s := range schedules {
+		if s.DayOfWeek == day && s.StartMinute <= minute && minute < s.EndMinute {
+			return true
+		}
+	}
+	return false
+}
+
+// isChairEndingShiftSoon は稼働時間中で、まもなく稼働時間が終わる椅子かを返す
+// 稼働時間の外で手動で稼働している椅子は対象にしない
+func isChairEndingShiftSoon(chairID string, now time.Time) bool {
+	chairScheduleCacheRWMutex.RLock()
+	defer chairScheduleCacheRWMutex.RUnlock()
+
+	schedules, ok := chairScheduleCache[chairID]
+	if !ok {
+		return false
+	}
+	return isOnShift(schedules, now) && !isOnShift(schedules, now.Add(chairScheduleOffShiftMargin))
+}
+
+func setChairActive(ctx context.Context, chair *Chair, isActive bool) error {
+	if _, err := db.ExecContext(ctx, "UPDATE chairs SET is_active = ? WHERE id = ?", isActive, chair.ID); err != nil {
+		return err
+	}
+	if err := updateIsActiveInCache(chair.ID, isActive); err != nil {
+		return err
+	}
+	if !isActive {
+		publishOwnerWebhookEvent(chair.OwnerID, webhookEventChairDeactivated, &webhookChairData{
+			ChairID: chair.ID,
+			Name:    chair.Name,
+			Model:   chair.Model,
+		})
+	}
+	return nil
+}
+
+// applyChairSchedules は稼働時間が始まった椅子を稼働させ、終わった椅子を止める
+func applyChairSchedules(ctx context.Context, now time.Time) {
+	chairScheduleCacheRWMutex.RLock()
+	desired := make(map[string]bool, len(chairScheduleCache))
+	for chairID, schedules := range chairScheduleCache {
+		desired[chairID] = isOnShift(schedules, now)
+	}
+	chairScheduleCacheRWMutex.RUnlock()
+
+	for chairID, onShift := range desired {
+		chairScheduleAppliedMutex.Lock()
+		applied, ok := chairScheduleApplied[chairID]
+		chairScheduleAppliedMutex.Unlock()
+		if ok && applied == onShift {
+			continue
+		}
+
+		chair, err := getChairByID(chairID)
+		if err != nil {
+			continue
+		}
+		chairCacheMapRWMutex.RLock()
+		isActive := chair.IsActive
+		chairCacheMapRWMutex.RUnlock()
+		if isActive != onShift {
+			if err := setChairActive(ctx, chair, onShift); err != nil {
+				slog.Error("failed to apply chair schedule", "chair_id", chairID, "error", err)
+				continue
+			}
+		}
+		if _, err := db.ExecContext(
+			ctx,
+			"INSERT INTO chair_schedule_applied (chair_id, is_active) VALUES (?, ?) ON DUPLICATE KEY UPDATE is_active = VALUES(is_active)",
+			chairID, onShift,
+		); err != nil {
+			// 記録できなければ次の確認で記録し直す
+			slog.Error("failed to record applied chair schedule", "chair_id", chairID, "error", err)
+			continue
+		}
+
+		chairScheduleAppliedMutex.Lock()
+		chairScheduleApplied[chairID] = onShift
+		chairScheduleAppliedMutex.Unlock()
+	}
+}
+
+func launchChairScheduler() {
+	worker := newAsyncWorker()
+	chairScheduler = worker
+
+	go func() {
+		defer close(worker.done)
+		applyChairSchedules(context.Background(), time.Now())
+		ticker := time.NewTicker(chairScheduleCheckInterval)
+		defer ticker.Stop()
+		for {
+			select {
+			case <-ticker.C:
+				applyChairSchedules(context.Background(), time.Now())
+			case <-worker.stop:
+				return
+			}
+		}
+	}()
+}
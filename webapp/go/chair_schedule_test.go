@@ -0,0 +1,96 @@
+package main
+
+import (
+	"testing"
+	"time"
+)
+
+func TestValidateChairSchedule(t *testing.T) {
+	tests := []struct {
+		name      string
+		schedules []ChairSchedule
+		wantErr   bool
+	}{
+		{name: "empty", schedules: []ChairSchedule{}},
+		{name: "whole day", schedules: []ChairSchedule{{DayOfWeek: 0, StartMinute: 0, EndMinute: minutesPerDay}}},
+		{
+			name: "adjacent slots",
+			schedules: []ChairSchedule{
+				{DayOfWeek: 1, StartMinute: 720, EndMinute: 1080},
+				{DayOfWeek: 1, StartMinute: 540, EndMinute: 720},
+			},
+		},
+		{
+			name: "across midnight as two slots",
+			schedules: []ChairSchedule{
+				{DayOfWeek: 1, StartMinute: 1320, EndMinute: minutesPerDay},
+				{DayOfWeek: 2, StartMinute: 0, EndMinute: 120},
+			},
+		},
+		{name: "wrapping slot", schedules: []ChairSchedule{{DayOfWeek: 1, StartMinute: 1320, EndMinute: 120}}, wantErr: true},
+		{name: "empty slot", schedules: []ChairSchedule{{DayOfWeek: 1, StartMinute: 600, EndMinute: 600}}, wantErr: true},
+		{name: "day out of range", schedules: []ChairSchedule{{DayOfWeek: 7, StartMinute: 0, EndMinute: 60}}, wantErr: true},
+		{name: "negative start", schedules: []ChairSchedule{{DayOfWeek: 0, StartMinute: -1, EndMinute: 60}}, wantErr: true},
+		{name: "end after midnight", schedules: []ChairSchedule{{DayOfWeek: 0, StartMinute: 0, EndMinute: minutesPerDay + 1}}, wantErr: true},
+		{
+			name: "overlapping slots",
+			schedules: []ChairSchedule{
+				{DayOfWeek: 3, StartMinute: 600, EndMinute: 800},
+				{DayOfWeek: 3, StartMinute: 540, EndMinute: 601},
+			},
+			wantErr: true,
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			err := validateChairSchedule(tt.schedules)
+			if (err != nil) != tt.wantErr {
+				t.Fatalf("validateChairSchedule() error = %v, wantErr %v", err, tt.wantErr)
+			}
+			for i := 1; err == nil && i < len(tt.schedules); i++ {
+				prev, cur := tt.schedules[i-1], tt.schedules[i]
+				if prev.DayOfWeek > cur.DayOfWeek || (prev.DayOfWeek == cur.DayOfWeek && prev.StartMinute > cur.StartMinute) {
+					t.Errorf("schedules are not sorted: %+v", tt.schedules)
+				}
+			}
+		})
+	}
+}
+
+func TestIsOnShift(t *testing.T) {
+	saved := chairScheduleLocation
+	chairScheduleLocation = time.UTC
+	t.Cleanup(func() { chairScheduleLocation = saved })
+
+	// 月曜 22:00 から火曜 2:00 まで、日をまたいで稼働する
+	schedules := []ChairSchedule{
+		{DayOfWeek: int(time.Monday), StartMinute: 22 * 60, EndMinute: minutesPerDay},
+		{DayOfWeek: int(time.Tuesday), StartMinute: 0, EndMinute: 2 * 60},
+	}
+	// 2024-01-01 は月曜日
+	at := func(day, hour, minute int) time.Time {
+		return time.Date(2024, 1, day, hour, minute, 0, 0, time.UTC)
+	}
+
+	tests := []struct {
+		name string
+		t    time.Time
+		want bool
+	}{
+		{name: "before the slot", t: at(1, 21, 59), want: false},
+		{name: "start is included", t: at(1, 22, 0), want: true},
+		{name: "just before midnight", t: at(1, 23, 59), want: true},
+		{name: "midnight", t: at(2, 0, 0), want: true},
+		{name: "after midnight", t: at(2, 1, 59), want: true},
+		{name: "end is excluded", t: at(2, 2, 0), want: false},
+		{name: "same time on another day", t: at(3, 1, 0), want: false},
+		{name: "time zone is applied", t: time.Date(2024, 1, 2, 9, 0, 0, 0, time.FixedZone("JST", 9*60*60)), want: true},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			if got := isOnShift(schedules, tt.t); got != tt.want {
+				t.Errorf("isOnShift(%v) = %v, want %v", tt.t, got, tt.want)
+			}
+		})
+	}
+}
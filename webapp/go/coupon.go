@@ -0,0 +1,339 @@
+package main
+
+import (
+	"context"
+	"database/sql"
+	"errors"
+	"log/slog"
+	"sync"
+	"time"
+
+	"github.com/jmoiron/sqlx"
+)
+
+const (
+	newUserCampaignCode          = "CP_NEW2024"
+	invitationCampaignCode       = "INV"
+	invitationRewardCampaignCode = "RWD"
+)
+
+const (
+	campaignEligibilityAll           = "ALL"
+	campaignEligibilityNewUsers      = "NEW_USERS"
+	campaignEligibilityExistingUsers = "EXISTING_USERS"
+)
+
+const (
+	couponDiscountTypeAmount  = "AMOUNT"
+	couponDiscountTypePercent = "PERCENT"
+)
+
+const availableCouponCondition = `used_by IS NULL AND (expires_at IS NULL OR expires_at > NOW(6))`
+
+var errCampaignNotFound = errors.New("campaign not found")
+var errCouponNotAvailable = errors.New("coupon is not available")
+
+// クーポンはユーザーごとに全てメモリ上に持ち、DBへの書き込みと同時に更新する
+var couponCacheRWMutex = sync.RWMutex{}
+var userIdToCouponsCache map[string][]*Coupon = make(map[string][]*Coupon)
+var rideIdToCouponMap map[string]*Coupon = make(map[string]*Coupon)
+
+func loadCouponCache() error {
+	coupons := []*Coupon{}
+	if err := db.Select(&coupons, "SELECT * FROM coupons ORDER BY created_at"); err != nil {
+		return err
+	}
+
+	couponCacheRWMutex.Lock()
+	defer couponCacheRWMutex.Unlock()
+
+	userIdToCouponsCache = make(map[string][]*Coupon)
+	rideIdToCouponMap = make(map[string]*Coupon)
+	for _, coupon := range coupons {
+		userIdToCouponsCache[coupon.UserID] = append(userIdToCouponsCache[coupon.UserID], coupon)
+		if coupon.UsedBy != nil {
+			rideIdToCouponMap[*coupon.UsedBy] = coupon
+		}
+	}
+	return nil
+}
+
+// insertCouponCache はコミット後に呼ぶ
+func insertCouponCache(coupons ...Coupon) {
+	couponCacheRWMutex.Lock()
+	defer couponCacheRWMutex.Unlock()
+
+	for _, coupon := range coupons {
+		c := coupon
+		userIdToCouponsCache[c.UserID] = append(userIdToCouponsCache[c.UserID], &c)
+	}
+}
+
+func findCouponInCache(userID, code string) *Coupon {
+	for _, coupon := range userIdToCouponsCache[userID] {
+		if coupon.Code == code {
+			return coupon
+		}
+	}
+	return nil
+}
+
+// markCouponUsedInCache はコミット後に呼ぶ
+func markCouponUsedInCache(userID, code, rideID string) {
+	couponCacheRWMutex.Lock()
+	defer couponCacheRWMutex.Unlock()
+
+	coupon := findCouponInCache(userID, code)
+	if coupon == nil {
+		return
+	}
+	usedBy := rideID
+	coupon.UsedBy = &usedBy
+	rideIdToCouponMap[rideID] = coupon
+}
+
+func getCouponsFromCache(userID string) []Coupon {
+	couponCacheRWMutex.RLock()
+	defer couponCacheRWMutex.RUnlock()
+
+	coupons := make([]Coupon, 0, len(userIdToCouponsCache[userID]))
+	for _, coupon := range userIdToCouponsCache[userID] {
+		coupons = append(coupons, *coupon)
+	}
+	return coupons
+}
+
+func getRideIdToCouponMap(rideID string) (Coupon, bool) {
+	couponCacheRWMutex.RLock()
+	defer couponCacheRWMutex.RUnlock()
+
+	coupon, ok := rideIdToCouponMap[rideID]
+	if !ok {
+		return Coupon{}, false
+	}
+	return *coupon, true
+}
+
+var couponCampaignCacheMapRWMutex = sync.RWMutex{}
+var couponCampaignCacheMap map[string]*CouponCampaign = make(map[string]*CouponCampaign)
+
+func loadCouponCampaignCacheMap() error {
+	couponCampaignCacheMapRWMutex.Lock()
+	defer couponCampaignCacheMapRWMutex.Unlock()
+
+	campaigns := []*CouponCampaign{}
+	if err := db.Select(&campaigns, "SELECT * FROM coupon_campaigns"); err != nil {
+		return err
+	}
+
+	couponCampaignCacheMap = make(map[string]*CouponCampaign)
+	for _, campaign := range campaigns {
+		couponCampaignCacheMap[campaign.Code] = campaign
+	}
+	return nil
+}
+
+func insertCouponCampaignCacheMap(campaign CouponCampaign) {
+	couponCampaignCacheMapRWMutex.Lock()
+	defer couponCampaignCacheMapRWMutex.Unlock()
+
+	couponCampaignCacheMap[campaign.Code] = &campaign
+}
+
+func getCouponCampaignFromCache(code string) (*CouponCampaign, bool) {
+	couponCampaignCacheMapRWMutex.RLock()
+	defer couponCampaignCacheMapRWMutex.RUnlock()
+
+	campaign, ok := couponCampaignCacheMap[code]
+	return campaign, ok
+}
+
+func (c *CouponCampaign) isExpired(now time.Time) bool {
+	return c.ExpiresAt != nil && !now.Before(*c.ExpiresAt)
+}
+
+func isEligibleForCampaign(ctx context.Context, tx *sqlx.Tx, campaign *CouponCampaign, userID string) (bool, error) {
+	if campaign.Eligibility == campaignEligibilityAll {
+		return true, nil
+	}
+
+	rideCount := 0
+	if err := tx.GetContext(ctx, &rideCount, "SELECT COUNT(*) FROM rides WHERE user_id = ?", userID); err != nil {
+		return false, err
+	}
+	if campaign.Eligibility == campaignEligibilityNewUsers {
+		return rideCount == 0, nil
+	}
+	return rideCount > 0, nil
+}
+
+// issueCampaignCoupon はキャンペーンの条件を満たす場合のみクーポンを付与する
+// 期限切れ・発行上限到達・対象外の場合は何もせず nil を返す
+// 返したクーポンはコミット後に insertCouponCache でキャッシュに反映すること
+func issueCampaignCoupon(ctx context.Context, tx *sqlx.Tx, campaignCode, userID, couponCode string) (*Coupon, error) {
+	campaign, ok := getCouponCampaignFromCache(campaignCode)
+	if !ok {
+		slog.Error("issueCampaignCoupon - campaign not found", "campaign", campaignCode)
+		return nil, nil
+	}
+	if campaign.isExpired(time.Now()) {
+		return nil, nil
+	}
+
+	eligible, err := isEligibleForCampaign(ctx, tx, campaign, userID)
+	if err != nil {
+		return nil, err
+	}
+	if !eligible {
+		return nil, nil
+	}
+
+	if campaign.MaxUses != nil {
+		// 発行数の上限チェックはキャンペーンの行をロックして行う
+		if _, err := getCouponCampaignForUpdate(ctx, tx, campaign.Code); err != nil {
+			return nil, err
+		}
+		issued := 0
+		if err := tx.GetContext(ctx, &issued, "SELECT COUNT(*) FROM coupons WHERE campaign_code = ?", campaign.Code); err != nil {
+			return nil, err
+		}
+		if issued >= *campaign.MaxUses {
+			return nil, nil
+		}
+	}
+
+	coupon := campaign.newCoupon(userID, couponCode)
+	if _, err := tx.NamedExecContext(ctx, insertCouponQuery, coupon); err != nil {
+		return nil, err
+	}
+	return &coupon, nil
+}
+
+const insertCouponQuery = `INSERT INTO coupons (user_id, code, campaign_code, discount_type, discount, max_discount, min_fare, expires_at, created_at)
+	VALUES (:user_id, :code, :campaign_code, :discount_type, :discount, :max_discount, :min_fare, :expires_at, :created_at)`
+
+// newCoupon はキャンペーンの割引条件をコピーしたクーポンを作る
+func (c *CouponCampaign) newCoupon(userID, couponCode string) Coupon {
+	campaignCode := c.Code
+	return Coupon{
+		UserID:       userID,
+		Code:         couponCode,
+		CampaignCode: &campaignCode,
+		DiscountType: c.DiscountType,
+		Discount:     c.Discount,
+		MaxDiscount:  c.MaxDiscount,
+		MinFare:      c.MinFare,
+		ExpiresAt:    c.ExpiresAt,
+		CreatedAt:    time.Now().Truncate(time.Microsecond),
+	}
+}
+
+func getCouponCampaignForUpdate(ctx context.Context, tx *sqlx.Tx, code string) (*CouponCampaign, error) {
+	campaign := &CouponCampaign{}
+	if err := tx.GetContext(ctx, campaign, "SELECT * FROM coupon_campaigns WHERE code = ? FOR UPDATE", code); err != nil {
+		if errors.Is(err, sql.ErrNoRows) {
+			return nil, errCampaignNotFound
+		}
+		return nil, err
+	}
+	return campaign, nil
+}
+
+func selectAvailableCoupons(ctx context.Context, tx *sqlx.Tx, userID string, forUpdate bool) ([]Coupon, error) {
+	query := "SELECT * FROM coupons WHERE user_id = ? AND " + availableCouponCondition
+	if forUpdate {
+		query += " FOR UPDATE"
+	}
+	coupons := []Coupon{}
+	if err := tx.SelectContext(ctx, &coupons, query, userID); err != nil {
+		return nil, err
+	}
+	return coupons, nil
+}
+
+func getAvailableCouponsFromCache(userID string, now time.Time) []Coupon {
+	coupons := []Coupon{}
+	for _, coupon := range getCouponsFromCache(userID) {
+		if coupon.UsedBy == nil && (coupon.ExpiresAt == nil || now.Before(*coupon.ExpiresAt)) {
+			coupons = append(coupons, coupon)
+		}
+	}
+	return coupons
+}
+
+// couponDiscountAmount は距離運賃に対する実際の割引額を返す
+func couponDiscountAmount(coupon *Coupon, meteredFare int) int {
+	discount := coupon.Discount
+	if coupon.DiscountType == couponDiscountTypePercent {
+		discount = meteredFare * coupon.Discount / 100
+		if coupon.MaxDiscount != nil {
+			discount = min(discount, *coupon.MaxDiscount)
+		}
+	}
+	return max(min(discount, meteredFare), 0)
+}
+
+func isCouponApplicable(coupon *Coupon, fare int, now time.Time) bool {
+	if coupon.UsedBy != nil {
+		return false
+	}
+	if coupon.ExpiresAt != nil && !now.Before(*coupon.ExpiresAt) {
+		return false
+	}
+	if coupon.MinFare != nil && fare < *coupon.MinFare {
+		return false
+	}
+	return true
+}
+
+// selectBestCoupon は割引額が最大になるクーポンを選ぶ
+// 割引額が同じなら期限の近いもの、次に付与された順番が古いものを優先する
+func selectBestCoupon(coupons []Coupon, baseFare, meteredFare int, now time.Time) *Coupon {
+	fare := baseFare + meteredFare
+	var best *Coupon
+	bestDiscount := 0
+	for i := range coupons {
+		coupon := &coupons[i]
+		if !isCouponApplicable(coupon, fare, now) {
+			continue
+		}
+		discount := couponDiscountAmount(coupon, meteredFare)
+		if best == nil || discount > bestDiscount || (discount == bestDiscount && isPreferredCoupon(coupon, best)) {
+			best = coupon
+			bestDiscount = discount
+		}
+	}
+	return best
+}
+
+func isPreferredCoupon(a, b *Coupon) bool {
+	if a.ExpiresAt != nil && (b.ExpiresAt == nil || a.ExpiresAt.Before(*b.ExpiresAt)) {
+		return true
+	}
+	if b.ExpiresAt != nil && (a.ExpiresAt == nil || b.ExpiresAt.Before(*a.ExpiresAt)) {
+		return false
+	}
+	return a.CreatedAt.Before(b.CreatedAt)
+}
+
+// chooseCoupon はライドに使うクーポンを決める
+// couponCode が nil なら最も割引額が大きいもの、空文字ならクーポンを使わず、それ以外なら指定されたクーポンを使う
+func chooseCoupon(coupons []Coupon, couponCode *string, baseFare, meteredFare int, now time.Time) (*Coupon, error) {
+	if couponCode == nil {
+		return selectBestCoupon(coupons, baseFare, meteredFare, now), nil
+	}
+	if *couponCode == "" {
+		return nil, nil
+	}
+	for i := range coupons {
+		coupon := &coupons[i]
+		if coupon.Code != *couponCode {
+			continue
+		}
+		if !isCouponApplicable(coupon, baseFare+meteredFare, now) {
+			return nil, errCouponNotAvailable
+		}
+		return coupon, nil
+	}
+	return nil, errCouponNotAvailable
+}
@@ -0,0 +1,116 @@
+package main
+
+import (
+	"errors"
+	"testing"
+	"time"
+)
+
+func TestSelectBestCoupon(t *testing.T) {
+	now := time.Now()
+	intPtr := func(v int) *int { return &v }
+	timePtr := func(t time.Time) *time.Time { return &t }
+	used := "ride"
+
+	// 基本運賃 500、距離運賃 1000 のライドに使う
+	tests := []struct {
+		name    string
+		coupons []Coupon
+		want    string
+	}{
+		{name: "no coupons", want: ""},
+		{
+			name: "largest discount",
+			coupons: []Coupon{
+				{Code: "small", DiscountType: couponDiscountTypeAmount, Discount: 100},
+				{Code: "large", DiscountType: couponDiscountTypeAmount, Discount: 300},
+			},
+			want: "large",
+		},
+		{
+			name: "percent discount is capped",
+			coupons: []Coupon{
+				{Code: "percent", DiscountType: couponDiscountTypePercent, Discount: 50, MaxDiscount: intPtr(200)},
+				{Code: "amount", DiscountType: couponDiscountTypeAmount, Discount: 300},
+			},
+			want: "amount",
+		},
+		{
+			name: "discount is limited to the metered fare",
+			coupons: []Coupon{
+				{Code: "older", DiscountType: couponDiscountTypeAmount, Discount: 5000, CreatedAt: now.Add(-2 * time.Hour)},
+				{Code: "newer", DiscountType: couponDiscountTypeAmount, Discount: 1000, CreatedAt: now.Add(-time.Hour)},
+			},
+			want: "older",
+		},
+		{
+			name: "expiring soonest wins a tie",
+			coupons: []Coupon{
+				{Code: "no expiry", DiscountType: couponDiscountTypeAmount, Discount: 300},
+				{Code: "later", DiscountType: couponDiscountTypeAmount, Discount: 300, ExpiresAt: timePtr(now.Add(2 * time.Hour))},
+				{Code: "sooner", DiscountType: couponDiscountTypeAmount, Discount: 300, ExpiresAt: timePtr(now.Add(time.Hour))},
+			},
+			want: "sooner",
+		},
+		{
+			name: "unavailable coupons are skipped",
+			coupons: []Coupon{
+				{Code: "used", DiscountType: couponDiscountTypeAmount, Discount: 900, UsedBy: &used},
+				{Code: "expired", DiscountType: couponDiscountTypeAmount, Discount: 900, ExpiresAt: timePtr(now)},
+				{Code: "min fare", DiscountType: couponDiscountTypeAmount, Discount: 900, MinFare: intPtr(2000)},
+				{Code: "available", DiscountType: couponDiscountTypeAmount, Discount: 100},
+			},
+			want: "available",
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			got := ""
+			if coupon := selectBestCoupon(tt.coupons, 500, 1000, now); coupon != nil {
+				got = coupon.Code
+			}
+			if got != tt.want {
+				t.Errorf("selectBestCoupon = %q, want %q", got, tt.want)
+			}
+		})
+	}
+}
+
+func TestChooseCoupon(t *testing.T) {
+	now := time.Now()
+	code := func(s string) *string { return &s }
+	used := "ride"
+	coupons := []Coupon{
+		{Code: "small", DiscountType: couponDiscountTypeAmount, Discount: 100},
+		{Code: "large", DiscountType: couponDiscountTypeAmount, Discount: 300},
+		{Code: "used", DiscountType: couponDiscountTypeAmount, Discount: 500, UsedBy: &used},
+	}
+
+	tests := []struct {
+		name       string
+		couponCode *string
+		want       string
+		wantErr    error
+	}{
+		{name: "best coupon when not specified", want: "large"},
+		{name: "no coupon when empty", couponCode: code("")},
+		{name: "specified coupon", couponCode: code("small"), want: "small"},
+		{name: "used coupon", couponCode: code("used"), wantErr: errCouponNotAvailable},
+		{name: "unknown coupon", couponCode: code("unknown"), wantErr: errCouponNotAvailable},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			coupon, err := chooseCoupon(coupons, tt.couponCode, 500, 1000, now)
+			if !errors.Is(err, tt.wantErr) {
+				t.Fatalf("err = %v, want %v", err, tt.wantErr)
+			}
+			got := ""
+			if coupon != nil {
+				got = coupon.Code
+			}
+			if got != tt.want {
+				t.Errorf("chooseCoupon = %q, want %q", got, tt.want)
+			}
+		})
+	}
+}
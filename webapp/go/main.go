@@ -4,6 +4,7 @@ import (
 	"context"
 	crand "crypto/rand"
 	"encoding/json"
+	"errors"
 	"fmt"
 	"log/slog"
 	"net"
@@ -11,7 +12,9 @@ import (
 	_ "net/http/pprof"
 	"os"
 	"os/exec"
+	"os/signal"
 	"strconv"
+	"syscall"
 	"time"
 
 	"github.com/go-chi/chi/v5"
@@ -40,8 +43,23 @@ func main() {
 		http.ListenAndServe(":6060", nil)
 	}()
 
-	slog.Info("Listening on :8080")
-	http.ListenAndServe(":8080", mux)
+	server := &http.Server{Addr: ":8080", Handler: mux}
+	server.RegisterOnShutdown(beginShutdown)
+	go func() {
+		slog.Info("Listening on :8080")
+		if err := server.ListenAndServe(); err != nil && !errors.Is(err, http.ErrServerClosed) {
+			slog.Error("failed to listen", "error", err)
+			os.Exit(1)
+		}
+	}()
+
+	sig := make(chan os.Signal, 1)
+	signal.Notify(sig, syscall.SIGTERM, syscall.SIGINT)
+	<-sig
+
+	ctx, cancel := context.WithTimeout(context.Background(), shutdownTimeout)
+	defer cancel()
+	gracefulShutdown(ctx, server)
 }
 
 func setup() http.Handler {
@@ -88,54 +106,73 @@ func setup() http.Handler {
 	db.SetMaxOpenConns(50)
 	db.SetMaxIdleConns(50)
 
+	adminAccessToken = os.Getenv("ISUCON_ADMIN_TOKEN")
+	notificationBusInstance = newNotificationBus(os.Getenv("ISUCON_NOTIFICATION_BUS"))
+	_, chairLivenessShared = notificationBusInstance.(*mysqlNotificationBus)
+
+	if v, err := strconv.Atoi(os.Getenv("APP_RETRY_AFTER_MS")); err == nil && v > 0 {
+		appRetryAfterMs = v
+	}
+	if v, err := strconv.Atoi(os.Getenv("CHAIR_RETRY_AFTER_MS")); err == nil && v > 0 {
+		chairRetryAfterMs = v
+	}
+	if v := os.Getenv("ISUCON_SERVICE_AREA"); v != "" {
+		if area, err := parseServiceArea(v); err != nil {
+			slog.Error("ignoring ISUCON_SERVICE_AREA", "error", err)
+		} else {
+			serviceArea = area
+		}
+	}
+	if v, err := strconv.Atoi(os.Getenv("ISUCON_TELEPORT_TOLERANCE")); err == nil && v >= 0 {
+		teleportTolerance = v
+	}
+	if v, err := strconv.Atoi(os.Getenv("ISUCON_ARRIVAL_RADIUS")); err == nil && v >= 0 {
+		arrivalRadius = v
+	}
+	zonesFile = os.Getenv("ISUCON_ZONES_FILE")
+	if v := os.Getenv("ISUCON_WEBHOOK_ALLOWED_NETWORKS"); v != "" {
+		if networks, err := parseWebhookAllowedNetworks(v); err != nil {
+			slog.Error("ignoring ISUCON_WEBHOOK_ALLOWED_NETWORKS", "error", err)
+		} else {
+			webhookAllowedNetworks = networks
+		}
+	}
+	if v, err := strconv.Atoi(os.Getenv("ISUCON_CHAIR_LIVENESS_TIMEOUT_MS")); err == nil && v > 0 {
+		chairLivenessTimeout = time.Duration(v) * time.Millisecond
+	}
+	if v, err := strconv.Atoi(os.Getenv("ISUCON_PICKUP_PAYOUT_PER_DISTANCE")); err == nil && v >= 0 {
+		pickupPayoutPerDistance = v
+	}
+	if v, err := strconv.Atoi(os.Getenv("ISUCON_CHAIR_FULL_BATTERY_RANGE")); err == nil && v > 0 {
+		chairFullBatteryRange = v
+	}
+	if v := os.Getenv("ISUCON_SCHEDULE_TZ"); v != "" {
+		if loc, err := time.LoadLocation(v); err != nil {
+			slog.Error("ignoring ISUCON_SCHEDULE_TZ, using the local time zone", "error", err)
+		} else {
+			chairScheduleLocation = loc
+		}
+	}
+
 	useMatching := false
 	if os.Getenv("ISUCON_MATCHING") == "true" {
 		useMatching = true
 	}
 
-	// 定期的にChairLocationLatestを保存する処理
-	go func() {
-		ticker := time.NewTicker(5000 * time.Millisecond)
-		for range ticker.C {
-			ctx := context.Background()
-			func() {
-				tx, err := db.Begin()
-				if err != nil {
-					slog.Error("failed to begin tx", "error", err)
-					return
-				}
-				defer tx.Commit()
-
-				chairLocationCacheMapRWMutex.Lock()
-				defer chairLocationCacheMapRWMutex.Unlock()
-
-				for _, cll := range chairLocationCacheMap {
-					if cll.isDirty { // now < cll.UpdatedAt
-						// 更新されているのでDBに保存する
-						if _, err := tx.ExecContext(
-							ctx,
-							`INSERT INTO chair_locations_latest (chair_id, latitude, longitude, updated_at, total_distance) VALUES (?, ?, ?, ?, ?)
-							ON DUPLICATE KEY UPDATE 
-								latitude = ?, longitude = ?, updated_at = ?, total_distance = ?`,
-							cll.ChairID, cll.Latitude, cll.Longitude, cll.UpdatedAt, cll.TotalDistance, cll.Latitude, cll.Longitude, cll.UpdatedAt, cll.TotalDistance,
-						); err != nil {
-							slog.Error("failed to insert chair location", "error", err)
-						}
-						cll.isDirty = false
-					}
-				}
-
-			}()
-		}
-	}()
-
 	// 定期的にマッチングを行う処理
 	if useMatching {
 		slog.Info("use matching")
+		worker := newAsyncWorker()
+		matchingWorker = worker
 		go func() {
+			defer close(worker.done)
 			for {
 				runMatching()
-				<-time.After(50 * time.Millisecond)
+				select {
+				case <-time.After(50 * time.Millisecond):
+				case <-worker.stop:
+					return
+				}
 			}
 		}()
 	} else {
@@ -155,31 +192,77 @@ func setup() http.Handler {
 	if err := loadLatestRideToChairAssignments(); err != nil {
 		slog.Error("failed to load latest ride to chair assignments", "error", err)
 	}
-	if err := loadUnsentRideStatusesToChair(); err != nil {
-		slog.Error("failed to load unsent ride statuses to chair", "error", err)
-	}
-	if err := loadUnsentRideStatusesToApp(); err != nil {
-		slog.Error("failed to load unsent ride statuses to app", "error", err)
-	}
 
 	if err := loadPaymentGatewayURL(context.Background()); err != nil {
 		slog.Error("failed to load payment gateway url", "error", err)
 	}
 
-	if err := loadRideIdToCouponMap(); err != nil {
-		slog.Error("failed to load ride id to coupon map", "error", err)
+	if err := loadCouponCache(); err != nil {
+		slog.Error("failed to load coupon cache", "error", err)
 	}
 
 	if err := loadRideCacheMap(); err != nil {
 		slog.Error("failed to load ride cache map", "error", err)
 	}
 
+	if err := loadCouponCampaignCacheMap(); err != nil {
+		slog.Error("failed to load coupon campaign cache map", "error", err)
+	}
+
+	if err := loadReferralTierCacheMap(); err != nil {
+		slog.Error("failed to load referral tier cache map", "error", err)
+	}
+
 	if err := loadUserMapCache(); err != nil {
 		slog.Error("failed to load user map cache", "error", err)
 	}
 
+	if err := loadChairModelSpeedCache(); err != nil {
+		slog.Error("failed to load chair model speed cache", "error", err)
+	}
+
+	if err := loadOwnerWebhookCache(); err != nil {
+		slog.Error("failed to load owner webhook cache", "error", err)
+	}
+
+	if err := loadRideMetricsCache(); err != nil {
+		slog.Error("failed to load ride metrics cache", "error", err)
+	}
+
+	if err := loadChairFlagCache(); err != nil {
+		slog.Error("failed to load chair flag cache", "error", err)
+	}
+
+	if err := loadZoneCache(); err != nil {
+		slog.Error("failed to load zone cache", "error", err)
+	}
+
+	if err := loadChairScheduleCache(); err != nil {
+		slog.Error("failed to load chair schedule cache", "error", err)
+	}
+
+	if err := loadChairConditionCache(); err != nil {
+		slog.Error("failed to load chair condition cache", "error", err)
+	}
+
+	if err := loadUnsentRideStatusesToChair(); err != nil {
+		slog.Error("failed to load unsent ride statuses to chair", "error", err)
+	}
+	if err := loadUnsentRideStatusesToApp(); err != nil {
+		slog.Error("failed to load unsent ride statuses to app", "error", err)
+	}
+	if err := loadRideStatusSentAtCache(); err != nil {
+		slog.Error("failed to load ride status sent at cache", "error", err)
+	}
+
+	launchChairLocationWriter()
 	launchRideStatusSentAtSyncer()
 	launchChairPostRideStatusSyncer()
+	launchWebhookDeliveryWorkers()
+	launchWebhookRetryPoller()
+	launchChairScheduler()
+	launchNotificationStreamSweeper()
+	notificationBusInstance.start(deliverNotificationBusEvent)
 
 	mux := chi.NewRouter()
 	mux.Use(middleware.Recoverer)
@@ -194,8 +277,10 @@ func setup() http.Handler {
 		authedMux.HandleFunc("GET /api/app/rides", appGetRides)
 		authedMux.HandleFunc("POST /api/app/rides", appPostRides)
 		authedMux.HandleFunc("POST /api/app/rides/estimated-fare", appPostRidesEstimatedFare)
+		authedMux.HandleFunc("GET /api/app/coupons", appGetCoupons)
+		authedMux.HandleFunc("GET /api/app/invitations", appGetInvitations)
 		authedMux.HandleFunc("POST /api/app/rides/{ride_id}/evaluation", appPostRideEvaluatation)
-		authedMux.HandleFunc("GET /api/app/notification", appGetNotificationSSE)
+		authedMux.HandleFunc("GET /api/app/notification", appGetNotification)
 		authedMux.HandleFunc("GET /api/app/nearby-chairs", appGetNearbyChairs)
 	}
 
@@ -206,6 +291,14 @@ func setup() http.Handler {
 		authedMux := mux.With(ownerAuthMiddleware)
 		authedMux.HandleFunc("GET /api/owner/sales", ownerGetSales)
 		authedMux.HandleFunc("GET /api/owner/chairs", ownerGetChairs)
+		authedMux.HandleFunc("GET /api/owner/chairs/{chair_id}/locations", ownerGetChairLocations)
+		authedMux.HandleFunc("GET /api/owner/chairs/{chair_id}/schedule", ownerGetChairSchedule)
+		authedMux.HandleFunc("PUT /api/owner/chairs/{chair_id}/schedule", ownerPutChairSchedule)
+		authedMux.HandleFunc("GET /api/owner/rides/{ride_id}/route", ownerGetRideRoute)
+		authedMux.HandleFunc("GET /api/owner/webhooks", ownerGetWebhooks)
+		authedMux.HandleFunc("POST /api/owner/webhooks", ownerPostWebhooks)
+		authedMux.HandleFunc("DELETE /api/owner/webhooks/{webhook_id}", ownerDeleteWebhook)
+		authedMux.HandleFunc("GET /api/owner/webhooks/{webhook_id}/deliveries", ownerGetWebhookDeliveries)
 	}
 
 	// chair handlers
@@ -215,10 +308,26 @@ func setup() http.Handler {
 		authedMux := mux.With(chairAuthMiddleware)
 		authedMux.HandleFunc("POST /api/chair/activity", chairPostActivity)
 		authedMux.HandleFunc("POST /api/chair/coordinate", chairPostCoordinate)
-		authedMux.HandleFunc("GET /api/chair/notification", chairGetNotificationSSE)
+		authedMux.HandleFunc("GET /api/chair/notification", chairGetNotification)
+		authedMux.HandleFunc("GET /api/chair/ws", chairGetWebSocket)
 		authedMux.HandleFunc("POST /api/chair/rides/{ride_id}/status", chairPostRideStatus)
 	}
 
+	// admin handlers
+	{
+		authedMux := mux.With(adminAuthMiddleware)
+		authedMux.HandleFunc("GET /api/admin/campaigns", adminGetCampaigns)
+		authedMux.HandleFunc("POST /api/admin/campaigns", adminPostCampaigns)
+		authedMux.HandleFunc("POST /api/admin/campaigns/{campaign_code}/coupons", adminPostCampaignCoupons)
+		authedMux.HandleFunc("POST /api/admin/referral-tiers", adminPostReferralTiers)
+		authedMux.HandleFunc("POST /api/admin/users/{user_id}/tier", adminPostUserTier)
+		authedMux.HandleFunc("GET /api/admin/notification-stats", adminGetNotificationStats)
+		authedMux.HandleFunc("GET /api/admin/flagged-chairs", adminGetFlaggedChairs)
+		authedMux.HandleFunc("DELETE /api/admin/flagged-chairs/{chair_id}", adminDeleteFlaggedChair)
+		authedMux.HandleFunc("GET /api/admin/zones", adminGetZones)
+		authedMux.HandleFunc("POST /api/admin/zones", adminPostZones)
+	}
+
 	// internal handlers
 	// {
 	// 	mux.HandleFunc("GET /api/internal/matching", internalGetMatching)
@@ -260,6 +369,11 @@ func postInitialize(w http.ResponseWriter, r *http.Request) {
 		return
 	}
 
+	// 書き戻し待ちの行が作り直した DB に書かれないよう、先に捨てる
+	resetChairLocationHistory()
+	resetRideMetrics()
+	resetRideGeofences()
+
 	if out, err := exec.Command("../sql/init.sh").CombinedOutput(); err != nil {
 		writeError(w, http.StatusInternalServerError, fmt.Errorf("failed to initialize: %s: %w", string(out), err))
 		return
@@ -274,6 +388,7 @@ func postInitialize(w http.ResponseWriter, r *http.Request) {
 		writeError(w, http.StatusInternalServerError, err)
 		return
 	}
+	resetChairLiveness()
 
 	if err := loadLatestRideStatusCacheMap(); err != nil {
 		writeError(w, http.StatusInternalServerError, err)
@@ -290,35 +405,94 @@ func postInitialize(w http.ResponseWriter, r *http.Request) {
 		return
 	}
 
-	if err := loadUnsentRideStatusesToChair(); err != nil {
+	if err := loadPaymentGatewayURL(ctx); err != nil {
 		writeError(w, http.StatusInternalServerError, err)
 		return
 	}
 
-	if err := loadUnsentRideStatusesToApp(); err != nil {
+	if err := loadCouponCache(); err != nil {
+		slog.Error("failed to load coupon cache", "error", err)
 		writeError(w, http.StatusInternalServerError, err)
 		return
 	}
 
-	if err := loadPaymentGatewayURL(ctx); err != nil {
+	if err := loadRideCacheMap(); err != nil {
+		slog.Error("failed to load ride cache map", "error", err)
 		writeError(w, http.StatusInternalServerError, err)
 		return
 	}
 
-	if err := loadRideIdToCouponMap(); err != nil {
-		slog.Error("failed to load ride id to coupon map", "error", err)
+	if err := loadUserMapCache(); err != nil {
+		slog.Error("failed to load user map cache", "error", err)
 		writeError(w, http.StatusInternalServerError, err)
 		return
 	}
 
-	if err := loadRideCacheMap(); err != nil {
-		slog.Error("failed to load ride cache map", "error", err)
+	if err := loadChairModelSpeedCache(); err != nil {
+		slog.Error("failed to load chair model speed cache", "error", err)
 		writeError(w, http.StatusInternalServerError, err)
 		return
 	}
 
-	if err := loadUserMapCache(); err != nil {
-		slog.Error("failed to load user map cache", "error", err)
+	if err := loadOwnerWebhookCache(); err != nil {
+		slog.Error("failed to load owner webhook cache", "error", err)
+		writeError(w, http.StatusInternalServerError, err)
+		return
+	}
+
+	if err := loadRideMetricsCache(); err != nil {
+		slog.Error("failed to load ride metrics cache", "error", err)
+		writeError(w, http.StatusInternalServerError, err)
+		return
+	}
+
+	if err := loadChairFlagCache(); err != nil {
+		slog.Error("failed to load chair flag cache", "error", err)
+		writeError(w, http.StatusInternalServerError, err)
+		return
+	}
+
+	if err := loadZoneCache(); err != nil {
+		slog.Error("failed to load zone cache", "error", err)
+		writeError(w, http.StatusInternalServerError, err)
+		return
+	}
+
+	if err := loadChairScheduleCache(); err != nil {
+		slog.Error("failed to load chair schedule cache", "error", err)
+		writeError(w, http.StatusInternalServerError, err)
+		return
+	}
+
+	if err := loadChairConditionCache(); err != nil {
+		slog.Error("failed to load chair condition cache", "error", err)
+		writeError(w, http.StatusInternalServerError, err)
+		return
+	}
+
+	if err := loadUnsentRideStatusesToChair(); err != nil {
+		writeError(w, http.StatusInternalServerError, err)
+		return
+	}
+
+	if err := loadUnsentRideStatusesToApp(); err != nil {
+		writeError(w, http.StatusInternalServerError, err)
+		return
+	}
+
+	if err := loadRideStatusSentAtCache(); err != nil {
+		writeError(w, http.StatusInternalServerError, err)
+		return
+	}
+
+	if err := loadCouponCampaignCacheMap(); err != nil {
+		slog.Error("failed to load coupon campaign cache map", "error", err)
+		writeError(w, http.StatusInternalServerError, err)
+		return
+	}
+
+	if err := loadReferralTierCacheMap(); err != nil {
+		slog.Error("failed to load referral tier cache map", "error", err)
 		writeError(w, http.StatusInternalServerError, err)
 		return
 	}
@@ -357,7 +531,7 @@ func writeError(w http.ResponseWriter, statusCode int, err error) {
 	}
 	w.Write(buf)
 
-	slog.Error("error response wrote", err)
+	slog.Error("error response wrote", "error", err)
 }
 
 func secureRandomStr(b int) string {
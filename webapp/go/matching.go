@@ -47,6 +47,8 @@ func getLatestRideByChairId(chairId string) (*Ride, bool) {
 	return ride, ok
 }
 
+var matchingWorker *asyncWorker
+
 func runMatching() {
 
 	ctx := context.Background()
@@ -68,17 +70,40 @@ func runMatching() {
 		return
 	}
 
+	startedAt := time.Now()
 	latestChairLocations := []ChairLocationLatest{}
+	// 電池残量から走れる距離が分かっている椅子だけ入れる
+	chairRanges := map[string]int{}
 	chairCacheMapRWMutex.RLock()
 	chairLocationCacheMapRWMutex.RLock()
 	for _, chair := range chairCacheMap {
 		if !chair.IsActive || !chair.IsFree {
 			continue
 		}
+		// 瞬間移動などで印の付いた椅子には割り当てない
+		if isChairFlagged(chair.ID) {
+			continue
+		}
+		// まもなく稼働時間が終わる椅子には割り当てない
+		if isChairEndingShiftSoon(chair.ID, startedAt) {
+			continue
+		}
 		loc, ok := chairLocationCacheMap[chair.ID]
 		if !ok {
 			continue
 		}
+		// 座標も通知の接続も途絶えている椅子には割り当てない
+		if !isChairOnline(chair.ID, loc.UpdatedAt, startedAt) {
+			continue
+		}
+		// 整備が必要な椅子には割り当てない
+		remaining, limited, available := chairMatchingRange(chair.ID)
+		if !available {
+			continue
+		}
+		if limited {
+			chairRanges[chair.ID] = remaining
+		}
 
 		latestChairLocations = append(latestChairLocations, ChairLocationLatest{
 			ChairID:       chair.ID,
@@ -96,21 +121,39 @@ func runMatching() {
 
 	slog.Info("runMatching started", "rides", len(rides), "chairs", len(latestChairLocations))
 	usedChairs := make(map[string]struct{})
+	matchedRides := []Ride{}
+	// 他のノードへの通知はコミットしてから送る
+	matchedNotifications := []func(){}
 	for _, ride := range rides {
 		// nearest chair
 		matchedId := ""
 		nearest := 10000000
+		tripDistance := calculateDistance(ride.PickupLatitude, ride.PickupLongitude, ride.DestinationLatitude, ride.DestinationLongitude)
+		// ゾーンでマッチングの距離が決められていれば、それより遠い椅子は選ばない
+		// 距離や電池の条件で外した椅子があれば、他のライドには割り当てられるかもしれない
+		radius, restricted := matchingRadiusForRide(ride)
+		if restricted {
+			nearest = radius + 1
+		}
 		for _, chair := range latestChairLocations {
 			if _, ok := usedChairs[chair.ChairID]; ok {
 				continue
 			}
 			distance := abs(chair.Latitude-ride.PickupLatitude) + abs(chair.Longitude-ride.PickupLongitude)
+			// 乗車地に向かって目的地まで走り切れない椅子は選ばない
+			if remaining, ok := chairRanges[chair.ChairID]; ok && remaining < distance+tripDistance {
+				restricted = true
+				continue
+			}
 			if distance < nearest {
 				nearest = distance
 				matchedId = chair.ChairID
 			}
 		}
 		if matchedId == "" {
+			if restricted {
+				continue
+			}
 			slog.Info("no chairs left")
 			break
 		}
@@ -147,10 +190,15 @@ func runMatching() {
 			Evaluation:           ride.Evaluation,
 			CreatedAt:            ride.CreatedAt,
 			UpdatedAt:            ride.UpdatedAt, // not need to update "updatedAt"
+			PickupZoneID:         ride.PickupZoneID,
+			DestinationZoneID:    ride.DestinationZoneID,
+			InitialFare:          ride.InitialFare,
+			FarePerDistance:      ride.FarePerDistance,
 		}
 
 		slog.Info("matched", "chair_id", matchedId, "ride_id", ride.ID)
 		assignRideToChair(matchedId, newRide)
+		matchedRides = append(matchedRides, newRide)
 
 		rideStatus := &RideStatus{}
 		if err := tx.GetContext(ctx, rideStatus, `SELECT * FROM ride_statuses WHERE ride_id = ? ORDER BY created_at DESC LIMIT 1`, ride.ID); err != nil {
@@ -162,14 +210,19 @@ func runMatching() {
 			return
 		}
 
-		if _, err := buildAndAppendChairGetNotificationResponseData(rideStatus.ID, ride.ID, "MATCHING"); err != nil {
+		chairData, err := buildAndAppendChairGetNotificationResponseData(rideStatus.ID, ride.ID, "MATCHING")
+		if err != nil {
 			slog.Error("failed to build and append chair get notification response data", "error", err)
 			return
 		}
-		if _, err := buildAndAppendAppGetNotificationResponseData(rideStatus.ID, ride.ID, "MATCHING"); err != nil {
+		appData, err := buildAndAppendAppGetNotificationResponseData(rideStatus.ID, ride.ID, "MATCHING")
+		if err != nil {
 			slog.Error("failed to build and append app get notification response data", "error", err)
 			return
 		}
+		matchedNotifications = append(matchedNotifications, func() {
+			publishRideStatusToBus(ride.ID, chairData, appData)
+		})
 	}
 
 	if err := tx.Commit(); err != nil {
@@ -177,5 +230,12 @@ func runMatching() {
 		return
 	}
 
+	for _, publish := range matchedNotifications {
+		publish()
+	}
+	for _, ride := range matchedRides {
+		publishRideWebhookEvent(webhookEventRideMatched, &ride, nil, nil)
+	}
+
 	slog.Info("runMatching finished")
 }
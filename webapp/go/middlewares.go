@@ -2,6 +2,7 @@ package main
 
 import (
 	"context"
+	"crypto/subtle"
 	"database/sql"
 	"errors"
 	"net/http"
@@ -77,3 +78,20 @@ func chairAuthMiddleware(next http.Handler) http.Handler {
 		next.ServeHTTP(w, r.WithContext(ctx))
 	})
 }
+
+func adminAuthMiddleware(next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		c, err := r.Cookie("admin_session")
+		if errors.Is(err, http.ErrNoCookie) || c.Value == "" {
+			writeError(w, http.StatusUnauthorized, errors.New("admin_session cookie is required"))
+			return
+		}
+		// ISUCON_ADMIN_TOKEN が未設定なら管理APIは使えない
+		if adminAccessToken == "" || subtle.ConstantTimeCompare([]byte(c.Value), []byte(adminAccessToken)) != 1 {
+			writeError(w, http.StatusUnauthorized, errors.New("invalid access token"))
+			return
+		}
+
+		next.ServeHTTP(w, r)
+	})
+}
@@ -0,0 +1,42 @@
+package main
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"testing"
+)
+
+func TestAdminAuthMiddleware(t *testing.T) {
+	tests := []struct {
+		name       string
+		token      string
+		cookie     string
+		wantStatus int
+	}{
+		{name: "valid token", token: "secret", cookie: "secret", wantStatus: http.StatusOK},
+		{name: "wrong token", token: "secret", cookie: "secreT", wantStatus: http.StatusUnauthorized},
+		{name: "prefix of the token", token: "secret", cookie: "sec", wantStatus: http.StatusUnauthorized},
+		{name: "no cookie", token: "secret", wantStatus: http.StatusUnauthorized},
+		{name: "token not configured", cookie: "secret", wantStatus: http.StatusUnauthorized},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			defer func(token string) { adminAccessToken = token }(adminAccessToken)
+			adminAccessToken = tt.token
+
+			handler := adminAuthMiddleware(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+				w.WriteHeader(http.StatusOK)
+			}))
+			req := httptest.NewRequest(http.MethodGet, "/api/admin/campaigns", nil)
+			if tt.cookie != "" {
+				req.AddCookie(&http.Cookie{Name: "admin_session", Value: tt.cookie})
+			}
+			rec := httptest.NewRecorder()
+			handler.ServeHTTP(rec, req)
+
+			if rec.Code != tt.wantStatus {
+				t.Errorf("status = %d, want %d", rec.Code, tt.wantStatus)
+			}
+		})
+	}
+}
@@ -38,6 +38,7 @@ type User struct {
 	DateOfBirth    string    `db:"date_of_birth"`
 	AccessToken    string    `db:"access_token"`
 	InvitationCode string    `db:"invitation_code"`
+	Tier           string    `db:"tier"`
 	CreatedAt      time.Time `db:"created_at"`
 	UpdatedAt      time.Time `db:"updated_at"`
 }
@@ -59,6 +60,11 @@ type Ride struct {
 	Evaluation           *int           `db:"evaluation"`
 	CreatedAt            time.Time      `db:"created_at"`
 	UpdatedAt            time.Time      `db:"updated_at"`
+	PickupZoneID         sql.NullString `db:"pickup_zone_id"`
+	DestinationZoneID    sql.NullString `db:"destination_zone_id"`
+	// 予約時の運賃。ゾーンの運賃を後から変えても過去のライドの運賃は変わらない
+	InitialFare     *int `db:"initial_fare"`
+	FarePerDistance *int `db:"fare_per_distance"`
 }
 
 type RideStatus struct {
@@ -80,11 +86,140 @@ type Owner struct {
 }
 
 type Coupon struct {
-	UserID    string    `db:"user_id"`
-	Code      string    `db:"code"`
-	Discount  int       `db:"discount"`
+	UserID       string     `db:"user_id"`
+	Code         string     `db:"code"`
+	CampaignCode *string    `db:"campaign_code"`
+	DiscountType string     `db:"discount_type"`
+	Discount     int        `db:"discount"`
+	MaxDiscount  *int       `db:"max_discount"`
+	MinFare      *int       `db:"min_fare"`
+	ExpiresAt    *time.Time `db:"expires_at"`
+	CreatedAt    time.Time  `db:"created_at"`
+	UsedBy       *string    `db:"used_by"`
+}
+
+type CouponCampaign struct {
+	Code         string     `db:"code"`
+	DiscountType string     `db:"discount_type"`
+	Discount     int        `db:"discount"`
+	MaxDiscount  *int       `db:"max_discount"`
+	MinFare      *int       `db:"min_fare"`
+	ExpiresAt    *time.Time `db:"expires_at"`
+	MaxUses      *int       `db:"max_uses"`
+	Eligibility  string     `db:"eligibility"`
+	CreatedAt    time.Time  `db:"created_at"`
+}
+
+type ReferralTier struct {
+	Tier                string `db:"tier"`
+	MaxReferrals        int    `db:"max_referrals"`
+	InviteeCampaignCode string `db:"invitee_campaign_code"`
+	InviterCampaignCode string `db:"inviter_campaign_code"`
+}
+
+type Referral struct {
+	InviteeID         string    `db:"invitee_id"`
+	InviterID         string    `db:"inviter_id"`
+	InvitationCode    string    `db:"invitation_code"`
+	InviteeCouponCode *string   `db:"invitee_coupon_code"`
+	InviterCouponCode *string   `db:"inviter_coupon_code"`
+	CreatedAt         time.Time `db:"created_at"`
+}
+
+type RideMetrics struct {
+	RideID           string `db:"ride_id"`
+	EnrouteDistance  int    `db:"enroute_distance"`
+	CarryingDistance int    `db:"carrying_distance"`
+	MatchingMs       int64  `db:"matching_ms"`
+	EnrouteMs        int64  `db:"enroute_ms"`
+	PickupMs         int64  `db:"pickup_ms"`
+	CarryingMs       int64  `db:"carrying_ms"`
+	ArrivedMs        int64  `db:"arrived_ms"`
+	isDirty          bool
+	// ライドが終わったら、書き戻した後にキャッシュから外す
+	isCompleted bool
+}
+
+type ChairCondition struct {
+	ChairID              string    `db:"chair_id"`
+	Battery              *int      `db:"battery"`
+	MaintenanceFlagsJSON string    `db:"maintenance_flags"`
+	UpdatedAt            time.Time `db:"updated_at"`
+	MaintenanceFlags     []string  `db:"-"`
+	isDirty              bool
+}
+
+type ChairSchedule struct {
+	ChairID     string    `db:"chair_id"`
+	DayOfWeek   int       `db:"day_of_week"`
+	StartMinute int       `db:"start_minute"`
+	EndMinute   int       `db:"end_minute"`
+	CreatedAt   time.Time `db:"created_at"`
+}
+
+type ChairScheduleApplied struct {
+	ChairID   string    `db:"chair_id"`
+	IsActive  bool      `db:"is_active"`
+	UpdatedAt time.Time `db:"updated_at"`
+}
+
+type ChairLiveness struct {
+	ChairID    string    `db:"chair_id"`
+	LastSeenAt time.Time `db:"last_seen_at"`
+}
+
+type Zone struct {
+	ID              string    `db:"id"`
+	Name            string    `db:"name"`
+	Polygon         string    `db:"polygon"`
+	Priority        int       `db:"priority"`
+	InitialFare     *int      `db:"initial_fare"`
+	FarePerDistance *int      `db:"fare_per_distance"`
+	MatchingRadius  *int      `db:"matching_radius"`
+	CreatedAt       time.Time `db:"created_at"`
+}
+
+type RideGeofenceEvent struct {
+	ID        string    `db:"id"`
+	RideID    string    `db:"ride_id"`
+	ChairID   string    `db:"chair_id"`
+	Fence     string    `db:"fence"`
+	Event     string    `db:"event"`
+	Latitude  int       `db:"latitude"`
+	Longitude int       `db:"longitude"`
 	CreatedAt time.Time `db:"created_at"`
-	UsedBy    *string   `db:"used_by"`
+}
+
+type ChairFlag struct {
+	ChairID   string    `db:"chair_id"`
+	Reason    string    `db:"reason"`
+	Latitude  int       `db:"latitude"`
+	Longitude int       `db:"longitude"`
+	Distance  int       `db:"distance"`
+	ElapsedMs int64     `db:"elapsed_ms"`
+	CreatedAt time.Time `db:"created_at"`
+}
+
+type OwnerWebhook struct {
+	ID        string    `db:"id"`
+	OwnerID   string    `db:"owner_id"`
+	URL       string    `db:"url"`
+	Secret    string    `db:"secret"`
+	CreatedAt time.Time `db:"created_at"`
+}
+
+type WebhookDelivery struct {
+	ID             string     `db:"id"`
+	WebhookID      string     `db:"webhook_id"`
+	EventType      string     `db:"event_type"`
+	Payload        string     `db:"payload"`
+	Status         string     `db:"status"`
+	Attempts       int        `db:"attempts"`
+	LastStatusCode *int       `db:"last_status_code"`
+	LastError      *string    `db:"last_error"`
+	NextAttemptAt  *time.Time `db:"next_attempt_at"`
+	CreatedAt      time.Time  `db:"created_at"`
+	UpdatedAt      time.Time  `db:"updated_at"`
 }
 
 /**
@@ -0,0 +1,409 @@
+package main
+
+import (
+	"fmt"
+	"log/slog"
+	"net/http"
+	"slices"
+	"strconv"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+// 再接続時に再送できるよう、宛先ごとに直近の通知をこの件数だけ保持する
+const notificationHistorySize = 32
+
+// 未送信の通知がこの件数を超えたら、同じライドの古いステータスをまとめ、それでも多ければ古いものから捨てる
+const notificationPendingLimit = 16
+
+// プロキシにアイドルとみなされて切られないよう、この間隔でコメント行を送る
+const notificationHeartbeatInterval = 15 * time.Second
+
+// 溢れたことの警告はこの間隔に1回だけ出す。件数は stats に残る
+const notificationOverflowLogInterval = 10 * time.Second
+
+// 接続が無く、この時間使われていない宛先のストリームは捨てる。再接続時は現在の状態から送り直す
+const notificationStreamIdleTimeout = 10 * time.Minute
+
+const notificationStreamSweepInterval = 1 * time.Minute
+
+// 切断時にクライアントが再接続するまでの待ち時間 (retry:) で、setup で環境変数から上書きする
+var appRetryAfterMs = 500
+var chairRetryAfterMs = 500
+
+// イベントIDは再起動後も増え続けるように起動時刻から採番する
+var notificationEventIDCounter atomic.Int64
+
+func init() {
+	notificationEventIDCounter.Store(time.Now().UnixMicro())
+}
+
+type notificationEvent[T any] struct {
+	ID   int64
+	Data *T
+}
+
+type notificationStats struct {
+	Appended  atomic.Int64
+	Coalesced atomic.Int64
+	Dropped   atomic.Int64
+	Evicted   atomic.Int64
+	// 最後に溢れたことを警告した時刻 (UnixNano)
+	overflowLoggedAt atomic.Int64
+}
+
+func (s *notificationStats) logOverflow(pending int) {
+	now := time.Now().UnixNano()
+	last := s.overflowLoggedAt.Load()
+	if now-last < int64(notificationOverflowLogInterval) || !s.overflowLoggedAt.CompareAndSwap(last, now) {
+		return
+	}
+	slog.Warn("notification overflow", "pending", pending, "coalesced", s.Coalesced.Load(), "dropped", s.Dropped.Load())
+}
+
+type notificationStream[T any] struct {
+	mu sync.Mutex
+	// 同じキーの未送信イベントは最新のものだけ残せばよい
+	coalesceKey func(*T) string
+	stats       *notificationStats
+	history     []notificationEvent[T]
+	// いずれかの接続に一度でも送った最大のイベントID
+	sentID int64
+	// 最後に送ったライドのステータスID。ポーリングで同じ状態を何度返しても送信済みの記録は一度だけにする
+	deliveredStatusID string
+	// 新しいイベントが来たら close して待っている接続を起こす
+	wakeup chan struct{}
+	// 最後に取得または追記された時刻 (UnixNano)。使われていないストリームを捨てるのに使う
+	usedAt atomic.Int64
+}
+
+func newNotificationStream[T any](coalesceKey func(*T) string, stats *notificationStats) *notificationStream[T] {
+	s := &notificationStream[T]{
+		coalesceKey: coalesceKey,
+		stats:       stats,
+		wakeup:      make(chan struct{}),
+	}
+	s.usedAt.Store(time.Now().UnixNano())
+	return s
+}
+
+// append は受信側が読んでいなくてもブロックしない
+func (s *notificationStream[T]) append(data *T) int64 {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	id := notificationEventIDCounter.Add(1)
+	s.usedAt.Store(time.Now().UnixNano())
+	s.history = append(s.history, notificationEvent[T]{ID: id, Data: data})
+	s.stats.Appended.Add(1)
+	s.enforcePendingLimit()
+	if len(s.history) > notificationHistorySize {
+		s.history = append([]notificationEvent[T]{}, s.history[len(s.history)-notificationHistorySize:]...)
+	}
+	close(s.wakeup)
+	s.wakeup = make(chan struct{})
+	return id
+}
+
+func (s *notificationStream[T]) pendingCount() int {
+	count := 0
+	for _, e := range s.history {
+		if e.ID > s.sentID {
+			count++
+		}
+	}
+	return count
+}
+
+func (s *notificationStream[T]) enforcePendingLimit() {
+	pending := s.pendingCount()
+	if pending <= notificationPendingLimit {
+		return
+	}
+
+	// 新しい方から見て、同じキーのより古い未送信イベントを捨てる
+	seen := map[string]struct{}{}
+	kept := make([]notificationEvent[T], 0, len(s.history))
+	for i := len(s.history) - 1; i >= 0; i-- {
+		e := s.history[i]
+		if e.ID > s.sentID {
+			key := s.coalesceKey(e.Data)
+			if _, ok := seen[key]; ok {
+				pending--
+				s.stats.Coalesced.Add(1)
+				continue
+			}
+			seen[key] = struct{}{}
+		}
+		kept = append(kept, e)
+	}
+	slices.Reverse(kept)
+
+	// それでも多ければ古い未送信イベントから捨てる
+	history := make([]notificationEvent[T], 0, len(kept))
+	for _, e := range kept {
+		if e.ID > s.sentID && pending > notificationPendingLimit {
+			pending--
+			s.stats.Dropped.Add(1)
+			continue
+		}
+		history = append(history, e)
+	}
+	s.history = history
+	s.stats.logOverflow(pending)
+}
+
+// eventsAfter は lastID より後のイベントと、次のイベントを待つためのチャネルを返す
+func (s *notificationStream[T]) eventsAfter(lastID int64) ([]notificationEvent[T], <-chan struct{}) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	events := []notificationEvent[T]{}
+	for _, e := range s.history {
+		if e.ID > lastID {
+			events = append(events, e)
+		}
+	}
+	return events, s.wakeup
+}
+
+func (s *notificationStream[T]) hasEventsAfter(lastID int64) bool {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	return len(s.history) > 0 && s.history[len(s.history)-1].ID > lastID
+}
+
+// nextUnsent はまだどの接続にも送っていない最も古いイベントを返す
+func (s *notificationStream[T]) nextUnsent() (notificationEvent[T], bool) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	for _, e := range s.history {
+		if e.ID > s.sentID {
+			return e, true
+		}
+	}
+	return notificationEvent[T]{}, false
+}
+
+// markSent は初めて送ったイベントなら true を返す
+func (s *notificationStream[T]) markSent(id int64) bool {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	if id <= s.sentID {
+		return false
+	}
+	s.sentID = id
+	return true
+}
+
+// markDelivered はライドのステータスを初めて送ったなら true を返す
+// ステータスは宛先ごとに順に進むので、直前に送ったものだけ覚えていればよい
+func (s *notificationStream[T]) markDelivered(rideStatusID string) bool {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	if rideStatusID == s.deliveredStatusID {
+		return false
+	}
+	s.deliveredStatusID = rideStatusID
+	return true
+}
+
+func (s *notificationStream[T]) lastSentID() int64 {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	return s.sentID
+}
+
+type notificationStreamMap[T any] struct {
+	mu          sync.Mutex
+	streams     map[string]*notificationStream[T]
+	coalesceKey func(*T) string
+	stats       notificationStats
+	// 宛先ごとの接続中のクライアント数。初期化で streams を作り直しても接続は残るので別に持つ
+	connections map[string]int
+}
+
+func newNotificationStreamMap[T any](coalesceKey func(*T) string) *notificationStreamMap[T] {
+	return &notificationStreamMap[T]{
+		streams:     make(map[string]*notificationStream[T]),
+		coalesceKey: coalesceKey,
+		connections: make(map[string]int),
+	}
+}
+
+// connect は接続を記録し、切断時に呼ぶ関数を返す
+func (m *notificationStreamMap[T]) connect(key string) func() {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	m.connections[key]++
+	slog.Info("notification connected", "key", key, "connections", m.connections[key])
+	return func() {
+		m.mu.Lock()
+		defer m.mu.Unlock()
+
+		m.connections[key]--
+		if m.connections[key] <= 0 {
+			delete(m.connections, key)
+		}
+	}
+}
+
+func (m *notificationStreamMap[T]) isConnected(key string) bool {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	return m.connections[key] > 0
+}
+
+// connectedKeys は接続が開いている宛先を返す
+func (m *notificationStreamMap[T]) connectedKeys() []string {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	keys := make([]string, 0, len(m.connections))
+	for key := range m.connections {
+		keys = append(keys, key)
+	}
+	return keys
+}
+
+func (m *notificationStreamMap[T]) connectionStats() (clients int, connections int) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	for _, count := range m.connections {
+		clients++
+		connections += count
+	}
+	return clients, connections
+}
+
+func (m *notificationStreamMap[T]) get(key string) *notificationStream[T] {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	stream, ok := m.streams[key]
+	if !ok {
+		stream = newNotificationStream(m.coalesceKey, &m.stats)
+		m.streams[key] = stream
+	} else {
+		stream.usedAt.Store(time.Now().UnixNano())
+	}
+	return stream
+}
+
+// evictIdle は接続が無く、idleTimeout の間使われていないストリームを捨てる
+func (m *notificationStreamMap[T]) evictIdle(now time.Time, idleTimeout time.Duration) int {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	evicted := 0
+	threshold := now.Add(-idleTimeout).UnixNano()
+	for key, stream := range m.streams {
+		if m.connections[key] > 0 || stream.usedAt.Load() > threshold {
+			continue
+		}
+		delete(m.streams, key)
+		evicted++
+	}
+	m.stats.Evicted.Add(int64(evicted))
+	return evicted
+}
+
+func (m *notificationStreamMap[T]) reset() {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	m.streams = make(map[string]*notificationStream[T])
+}
+
+// resumeEventID はクライアントが最後に受け取ったイベントIDがあればそこから、無ければ未送信のイベントから再開する
+func resumeEventID[T any](lastEventID string, stream *notificationStream[T]) int64 {
+	if lastEventID != "" {
+		if id, err := strconv.ParseInt(lastEventID, 10, 64); err == nil {
+			return id
+		}
+	}
+	return stream.lastSentID()
+}
+
+// wantsJSONNotification はポーリングのクライアントかどうかを Accept ヘッダーで判定する
+func wantsJSONNotification(r *http.Request) bool {
+	return strings.Contains(r.Header.Get("Accept"), "application/json")
+}
+
+// writeSSERetry は再接続の待ち時間を伝える
+func writeSSERetry(w http.ResponseWriter, retryAfterMs int) error {
+	if _, err := fmt.Fprintf(w, "retry: %d\n\n", retryAfterMs); err != nil {
+		return err
+	}
+	w.(http.Flusher).Flush()
+	return nil
+}
+
+// writeSSEHeartbeat はクライアントには無視されるコメント行を送る
+// 書き込みに失敗したら切断されているので、呼び出し側は接続を閉じる
+func writeSSEHeartbeat(w http.ResponseWriter) error {
+	if _, err := fmt.Fprint(w, ": heartbeat\n\n"); err != nil {
+		return err
+	}
+	w.(http.Flusher).Flush()
+	return nil
+}
+
+type notificationStatsResponse struct {
+	Appended         int64 `json:"appended"`
+	Coalesced        int64 `json:"coalesced"`
+	Dropped          int64 `json:"dropped"`
+	Evicted          int64 `json:"evicted"`
+	Streams          int   `json:"streams"`
+	ConnectedClients int   `json:"connected_clients"`
+	Connections      int   `json:"connections"`
+}
+
+func (m *notificationStreamMap[T]) statsResponse() notificationStatsResponse {
+	clients, connections := m.connectionStats()
+	m.mu.Lock()
+	streams := len(m.streams)
+	m.mu.Unlock()
+	return notificationStatsResponse{
+		Appended:         m.stats.Appended.Load(),
+		Coalesced:        m.stats.Coalesced.Load(),
+		Dropped:          m.stats.Dropped.Load(),
+		Evicted:          m.stats.Evicted.Load(),
+		Streams:          streams,
+		ConnectedClients: clients,
+		Connections:      connections,
+	}
+}
+
+var notificationStreamSweeper *asyncWorker
+
+func launchNotificationStreamSweeper() {
+	worker := newAsyncWorker()
+	notificationStreamSweeper = worker
+
+	go func() {
+		defer close(worker.done)
+		ticker := time.NewTicker(notificationStreamSweepInterval)
+		defer ticker.Stop()
+		for {
+			select {
+			case <-ticker.C:
+				now := time.Now()
+				appNotificationStreams.evictIdle(now, notificationStreamIdleTimeout)
+				chairNotificationStreams.evictIdle(now, notificationStreamIdleTimeout)
+			case <-worker.stop:
+				return
+			}
+		}
+	}()
+}
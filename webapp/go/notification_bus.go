@@ -0,0 +1,451 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"log/slog"
+	"sort"
+	"sync/atomic"
+	"time"
+
+	"github.com/jmoiron/sqlx"
+	"github.com/oklog/ulid/v2"
+)
+
+// 複数台で動かすときに、あるノードで発生した通知を他のノードに接続しているクライアントへ届けるための仕組み
+// ISUCON_NOTIFICATION_BUS で実装を選ぶ
+//   - inprocess (デフォルト): 1台で動かす前提で何もしない
+//   - mysql: notification_bus_events テーブルに書き込み、各ノードがポーリングして取り込む
+//
+// 共有するのは通知と送信済みの印、管理者やオーナーが変更する設定のキャッシュ (reloadableCaches) の読み直しだけ
+// ライドやライドのステータス、椅子の位置などのキャッシュはノードごとに持つので、
+// 同じライドに関わるユーザーと椅子のリクエストは同じノードで受ける必要がある
+
+const (
+	notificationBusKindApp   = "app"
+	notificationBusKindChair = "chair"
+	// 通知を送ったことを他のノードに知らせる。椅子を空きに戻すかはライドを進めたノードでも判断するため
+	notificationBusKindSentAt = "sent_at"
+	// 設定を変えたことを他のノードに知らせ、キャッシュを読み直させる。recipient_id はキャッシュの名前
+	notificationBusKindReload = "reload"
+)
+
+type notificationBusEvent struct {
+	ID           int64     `db:"id"`
+	Origin       string    `db:"origin"`
+	Kind         string    `db:"kind"`
+	RecipientID  string    `db:"recipient_id"`
+	RideStatusID string    `db:"ride_status_id"`
+	Payload      []byte    `db:"payload"`
+	CreatedAt    time.Time `db:"created_at"`
+}
+
+type notificationBus interface {
+	// publish は他のノードに通知を送る。自ノードのストリームへの追加は呼び出し側で済ませる
+	// コミット後に呼び、書き込みは別の goroutine で行うのでリクエストを待たせない
+	publish(event *notificationBusEvent)
+	// start は他のノードから届いた通知を deliver に渡し始める
+	start(deliver func(event *notificationBusEvent))
+	// stopReceiving は他のノードからの通知の取り込みを止める
+	stopReceiving(ctx context.Context) error
+	// shutdown は送りかけの通知を書き切ってから止める
+	shutdown(ctx context.Context) error
+}
+
+// 自ノードが書いたイベントを取り込まないよう起動ごとに ID を振る
+var notificationBusNodeID = ulid.Make().String()
+
+var notificationBusInstance notificationBus = &inProcessNotificationBus{}
+
+func newNotificationBus(kind string) notificationBus {
+	switch kind {
+	case "mysql":
+		return newMySQLNotificationBus()
+	case "", "inprocess":
+		return &inProcessNotificationBus{}
+	default:
+		slog.Error("unknown notification bus, falling back to inprocess", "kind", kind)
+		return &inProcessNotificationBus{}
+	}
+}
+
+type inProcessNotificationBus struct{}
+
+func (b *inProcessNotificationBus) publish(event *notificationBusEvent) {}
+
+func (b *inProcessNotificationBus) start(deliver func(event *notificationBusEvent)) {}
+
+func (b *inProcessNotificationBus) stopReceiving(ctx context.Context) error { return nil }
+
+func (b *inProcessNotificationBus) shutdown(ctx context.Context) error { return nil }
+
+// 他のノードの通知はこの間隔で取り込む
+const mysqlNotificationBusPollInterval = 100 * time.Millisecond
+
+// 取り込み終わった古いイベントはこの時間が経ったら消す
+const mysqlNotificationBusRetention = 1 * time.Minute
+
+// AUTO_INCREMENT の ID はコミットの順に見えるとは限らないので、飛ばした ID はこの時間だけ待って取り込む
+// 書き込みに失敗した ID は埋まらないので、この時間が経ったら諦める
+const mysqlNotificationBusGapTimeout = 5 * time.Second
+
+// 一度に待つ飛ばした ID の上限。初期化などで ID が大きく飛んだときに際限なく覚えないため
+const mysqlNotificationBusGapLimit = 1000
+
+const mysqlNotificationBusQueueSize = 10000
+const mysqlNotificationBusBatchSize = 100
+
+// 書き込みに失敗したイベントはこの間隔で書き直す。溜めておくのは上限までで、超えたら古いものから捨てる
+const mysqlNotificationBusRetryInterval = 1 * time.Second
+const mysqlNotificationBusRetryLimit = 10000
+
+// 他のノードに送れずに捨てた通知の数
+var notificationBusDropped atomic.Int64
+
+// notificationBusCursor はどこまで取り込んだかと、まだ見えていない ID を覚える
+type notificationBusCursor struct {
+	lastID int64
+	gaps   map[int64]time.Time
+}
+
+func newNotificationBusCursor(lastID int64) *notificationBusCursor {
+	return &notificationBusCursor{lastID: lastID, gaps: make(map[int64]time.Time)}
+}
+
+func (c *notificationBusCursor) gapIDs() []int64 {
+	ids := make([]int64, 0, len(c.gaps))
+	for id := range c.gaps {
+		ids = append(ids, id)
+	}
+	return ids
+}
+
+// accept は初めて見たイベントだけを ID 順に返し、飛ばした ID を待つ対象に加える
+func (c *notificationBusCursor) accept(events []*notificationBusEvent, now time.Time) []*notificationBusEvent {
+	sort.Slice(events, func(i, j int) bool { return events[i].ID < events[j].ID })
+
+	fresh := []*notificationBusEvent{}
+	for _, event := range events {
+		if event.ID <= c.lastID {
+			if _, ok := c.gaps[event.ID]; ok {
+				delete(c.gaps, event.ID)
+				fresh = append(fresh, event)
+			}
+			continue
+		}
+		for id := c.lastID + 1; id < event.ID && len(c.gaps) < mysqlNotificationBusGapLimit; id++ {
+			c.gaps[id] = now
+		}
+		c.lastID = event.ID
+		fresh = append(fresh, event)
+	}
+
+	for id, since := range c.gaps {
+		if now.Sub(since) > mysqlNotificationBusGapTimeout {
+			delete(c.gaps, id)
+		}
+	}
+	return fresh
+}
+
+type mysqlNotificationBus struct {
+	queue     chan *notificationBusEvent
+	poller    *asyncWorker
+	publisher *asyncWorker
+}
+
+func newMySQLNotificationBus() *mysqlNotificationBus {
+	return &mysqlNotificationBus{queue: make(chan *notificationBusEvent, mysqlNotificationBusQueueSize)}
+}
+
+func (b *mysqlNotificationBus) publish(event *notificationBusEvent) {
+	event.Origin = notificationBusNodeID
+	select {
+	case b.queue <- event:
+	default:
+		dropped := notificationBusDropped.Add(1)
+		slog.Error("notification bus queue is full", "kind", event.Kind, "recipient", event.RecipientID, "total_dropped", dropped)
+	}
+}
+
+// insert は書き込めなかったイベントを古い順に返す。呼び出し側で次に書くときに先頭に付ける
+func (b *mysqlNotificationBus) insert(events []*notificationBusEvent) []*notificationBusEvent {
+	for start := 0; start < len(events); start += mysqlNotificationBusBatchSize {
+		end := min(start+mysqlNotificationBusBatchSize, len(events))
+		if _, err := db.NamedExec(
+			"INSERT INTO notification_bus_events (origin, kind, recipient_id, ride_status_id, payload) VALUES (:origin, :kind, :recipient_id, :ride_status_id, :payload)",
+			events[start:end],
+		); err != nil {
+			failed := events[start:]
+			if over := len(failed) - mysqlNotificationBusRetryLimit; over > 0 {
+				dropped := notificationBusDropped.Add(int64(over))
+				slog.Error("notification bus retry buffer is full, dropping the oldest events", "dropped", over, "total_dropped", dropped)
+				failed = failed[over:]
+			}
+			slog.Error("failed to publish notification bus events, retrying", "count", len(failed), "error", err)
+			return failed
+		}
+	}
+	return nil
+}
+
+func (b *mysqlNotificationBus) start(deliver func(event *notificationBusEvent)) {
+	b.launchPublisher()
+	b.launchPoller(deliver)
+}
+
+// launchPublisher はキューに溜まった通知をまとめて書き込む。書けなかった分は retry に残して書き直す
+func (b *mysqlNotificationBus) launchPublisher() {
+	worker := newAsyncWorker()
+	b.publisher = worker
+
+	go func() {
+		defer close(worker.done)
+		ticker := time.NewTicker(mysqlNotificationBusRetryInterval)
+		defer ticker.Stop()
+		var retry []*notificationBusEvent
+		for {
+			select {
+			case event := <-b.queue:
+				events := append(retry, event)
+			collect:
+				for len(events) < len(retry)+mysqlNotificationBusBatchSize {
+					select {
+					case event := <-b.queue:
+						events = append(events, event)
+					default:
+						break collect
+					}
+				}
+				retry = b.insert(events)
+			case <-ticker.C:
+				if len(retry) > 0 {
+					retry = b.insert(retry)
+				}
+			case <-worker.stop:
+				// 停止時はキューに残っている分も書いてから終わる
+				events := retry
+			drain:
+				for {
+					select {
+					case event := <-b.queue:
+						events = append(events, event)
+					default:
+						break drain
+					}
+				}
+				if failed := b.insert(events); len(failed) > 0 {
+					dropped := notificationBusDropped.Add(int64(len(failed)))
+					slog.Error("dropping notification bus events on shutdown", "dropped", len(failed), "total_dropped", dropped)
+				}
+				return
+			}
+		}
+	}()
+}
+
+func (b *mysqlNotificationBus) launchPoller(deliver func(event *notificationBusEvent)) {
+	lastID := int64(0)
+	if err := db.Get(&lastID, "SELECT COALESCE(MAX(id), 0) FROM notification_bus_events"); err != nil {
+		slog.Error("failed to get last notification bus event id", "error", err)
+	}
+	cursor := newNotificationBusCursor(lastID)
+
+	worker := newAsyncWorker()
+	b.poller = worker
+
+	go func() {
+		defer close(worker.done)
+		ticker := time.NewTicker(mysqlNotificationBusPollInterval)
+		defer ticker.Stop()
+		lastCleanup := time.Now()
+		for {
+			select {
+			case <-ticker.C:
+			case <-worker.stop:
+				return
+			}
+
+			maxID := int64(0)
+			if err := db.Get(&maxID, "SELECT COALESCE(MAX(id), 0) FROM notification_bus_events"); err != nil {
+				slog.Error("failed to get last notification bus event id", "error", err)
+				continue
+			}
+			if maxID < cursor.lastID {
+				// 初期化でテーブルが作り直された
+				cursor = newNotificationBusCursor(0)
+			}
+
+			events, err := pollNotificationBusEvents(cursor)
+			if err != nil {
+				slog.Error("failed to poll notification bus events", "error", err)
+				continue
+			}
+			for _, event := range cursor.accept(events, time.Now()) {
+				if event.Origin == notificationBusNodeID {
+					continue
+				}
+				deliver(event)
+			}
+
+			if time.Since(lastCleanup) > mysqlNotificationBusRetention {
+				lastCleanup = time.Now()
+				if _, err := db.Exec("DELETE FROM notification_bus_events WHERE created_at < ?", time.Now().Add(-mysqlNotificationBusRetention)); err != nil {
+					slog.Error("failed to clean up notification bus events", "error", err)
+				}
+			}
+		}
+	}()
+}
+
+// pollNotificationBusEvents は前回より新しいイベントと、飛ばした ID のうち後から見えるようになったイベントを読む
+func pollNotificationBusEvents(cursor *notificationBusCursor) ([]*notificationBusEvent, error) {
+	events := []*notificationBusEvent{}
+	if err := db.Select(
+		&events,
+		"SELECT * FROM notification_bus_events WHERE id > ? ORDER BY id LIMIT 1000",
+		cursor.lastID,
+	); err != nil {
+		return nil, err
+	}
+
+	gapIDs := cursor.gapIDs()
+	if len(gapIDs) == 0 {
+		return events, nil
+	}
+	query, args, err := sqlx.In("SELECT * FROM notification_bus_events WHERE id IN (?)", gapIDs)
+	if err != nil {
+		return nil, err
+	}
+	filled := []*notificationBusEvent{}
+	if err := db.Select(&filled, db.Rebind(query), args...); err != nil {
+		return nil, err
+	}
+	return append(events, filled...), nil
+}
+
+func (b *mysqlNotificationBus) stopReceiving(ctx context.Context) error {
+	return b.poller.shutdown(ctx)
+}
+
+func (b *mysqlNotificationBus) shutdown(ctx context.Context) error {
+	return b.publisher.shutdown(ctx)
+}
+
+// publishRideStatusToBus はコミットしたライドのステータスの通知を他のノードに送る
+func publishRideStatusToBus(rideID string, chairData *chairGetNotificationResponseData, appData *appGetNotificationResponseData) {
+	ride, found := getRideByIDFromCache(rideID)
+	if !found {
+		return
+	}
+	if chairData != nil && ride.ChairID.Valid {
+		publishChairNotificationToBus(ride.ChairID.String, chairData)
+	}
+	if appData != nil {
+		publishAppNotificationToBus(ride.UserID, appData)
+	}
+}
+
+// publishAppNotificationToBus は運賃を埋めてから送る。受け取ったノードのクーポンのキャッシュは古いかもしれないため
+func publishAppNotificationToBus(userID string, data *appGetNotificationResponseData) {
+	data = fillAppNotificationFare(userID, data)
+	payload, err := json.Marshal(data)
+	if err != nil {
+		slog.Error("failed to marshal app notification", "error", err)
+		return
+	}
+	notificationBusInstance.publish(&notificationBusEvent{
+		Kind:         notificationBusKindApp,
+		RecipientID:  userID,
+		RideStatusID: data.RideStatusId,
+		Payload:      payload,
+	})
+}
+
+func publishChairNotificationToBus(chairID string, data *chairGetNotificationResponseData) {
+	payload, err := json.Marshal(data)
+	if err != nil {
+		slog.Error("failed to marshal chair notification", "error", err)
+		return
+	}
+	notificationBusInstance.publish(&notificationBusEvent{
+		Kind:         notificationBusKindChair,
+		RecipientID:  chairID,
+		RideStatusID: data.RideStatusId,
+		Payload:      payload,
+	})
+}
+
+// deliverNotificationBusEvent は他のノードで発生した通知を自ノードのストリームに積む
+func deliverNotificationBusEvent(event *notificationBusEvent) {
+	switch event.Kind {
+	case notificationBusKindApp:
+		data := &appGetNotificationResponseData{}
+		if err := json.Unmarshal(event.Payload, data); err != nil {
+			slog.Error("failed to unmarshal app notification", "error", err)
+			return
+		}
+		data.RideStatusId = event.RideStatusID
+		data.fareFixed = true
+		appNotificationStreams.get(event.RecipientID).append(data)
+	case notificationBusKindChair:
+		data := &chairGetNotificationResponseData{}
+		if err := json.Unmarshal(event.Payload, data); err != nil {
+			slog.Error("failed to unmarshal chair notification", "error", err)
+			return
+		}
+		data.RideStatusId = event.RideStatusID
+		chairNotificationStreams.get(event.RecipientID).append(data)
+	case notificationBusKindSentAt:
+		req := RideStatusSentAtRequest{}
+		if err := json.Unmarshal(event.Payload, &req); err != nil {
+			slog.Error("failed to unmarshal ride status sent at", "error", err)
+			return
+		}
+		req.FromBus = true
+		rideStatusSentAtChan <- req
+	case notificationBusKindReload:
+		load, ok := reloadableCaches[event.RecipientID]
+		if !ok {
+			slog.Error("unknown cache to reload", "cache", event.RecipientID)
+			return
+		}
+		if err := load(); err != nil {
+			slog.Error("failed to reload cache", "cache", event.RecipientID, "error", err)
+		}
+	}
+}
+
+// reloadableCaches は他のノードで変更されたときに読み直すキャッシュ
+// どれも変更が少ないので、差分を送らずにまるごと読み直す
+var reloadableCaches = map[string]func() error{
+	"coupon_campaigns": loadCouponCampaignCacheMap,
+	"owner_webhooks":   loadOwnerWebhookCache,
+	"chair_flags":      loadChairFlagCache,
+	"zones":            loadZoneCache,
+}
+
+// publishCacheReloadToBus は reloadableCaches のキャッシュを変更したあとに呼ぶ
+func publishCacheReloadToBus(cache string) {
+	notificationBusInstance.publish(&notificationBusEvent{
+		Kind:        notificationBusKindReload,
+		RecipientID: cache,
+		Payload:     []byte{},
+	})
+}
+
+// publishRideStatusSentAtToBus は送信済みの印を他のノードにも付けさせる
+// 通知を送ったノードとライドを進めたノードが違っても、どちらかで3つの印が揃えば椅子が空きに戻る
+func publishRideStatusSentAtToBus(req RideStatusSentAtRequest) {
+	payload, err := json.Marshal(req)
+	if err != nil {
+		slog.Error("failed to marshal ride status sent at", "error", err)
+		return
+	}
+	notificationBusInstance.publish(&notificationBusEvent{
+		Kind:         notificationBusKindSentAt,
+		RecipientID:  req.RideID,
+		RideStatusID: req.RideStatusID,
+		Payload:      payload,
+	})
+}
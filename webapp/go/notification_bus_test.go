@@ -0,0 +1,68 @@
+package main
+
+import (
+	"slices"
+	"testing"
+	"time"
+)
+
+func TestNotificationBusCursorAccept(t *testing.T) {
+	now := time.Now()
+	tests := []struct {
+		name     string
+		polls    [][]int64
+		elapsed  time.Duration
+		wantIDs  [][]int64
+		wantGaps []int64
+	}{
+		{
+			name:    "in order",
+			polls:   [][]int64{{1, 2}, {3}},
+			wantIDs: [][]int64{{1, 2}, {3}},
+		},
+		{
+			name:     "late commit is picked up once",
+			polls:    [][]int64{{1, 3}, {2, 3, 4}, {2}},
+			wantIDs:  [][]int64{{1, 3}, {2, 4}, {}},
+			wantGaps: []int64{},
+		},
+		{
+			name:     "gap is kept until it is filled",
+			polls:    [][]int64{{1, 4}},
+			wantIDs:  [][]int64{{1, 4}},
+			wantGaps: []int64{2, 3},
+		},
+		{
+			name:     "gap is given up after the timeout",
+			polls:    [][]int64{{1, 4}, {}},
+			elapsed:  mysqlNotificationBusGapTimeout + time.Second,
+			wantIDs:  [][]int64{{1, 4}, {}},
+			wantGaps: []int64{},
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			cursor := newNotificationBusCursor(0)
+			for i, poll := range tt.polls {
+				events := []*notificationBusEvent{}
+				for _, id := range poll {
+					events = append(events, &notificationBusEvent{ID: id})
+				}
+				got := []int64{}
+				for _, event := range cursor.accept(events, now.Add(time.Duration(i)*tt.elapsed)) {
+					got = append(got, event.ID)
+				}
+				if !slices.Equal(got, tt.wantIDs[i]) {
+					t.Errorf("poll %d: accepted %v, want %v", i, got, tt.wantIDs[i])
+				}
+			}
+			if tt.wantGaps != nil {
+				gaps := cursor.gapIDs()
+				slices.Sort(gaps)
+				if !slices.Equal(gaps, tt.wantGaps) {
+					t.Errorf("gaps = %v, want %v", gaps, tt.wantGaps)
+				}
+			}
+		})
+	}
+}
@@ -0,0 +1,136 @@
+package main
+
+import (
+	"fmt"
+	"testing"
+	"time"
+)
+
+type testNotification struct {
+	RideID string
+	Status string
+}
+
+func testNotificationKey(n *testNotification) string {
+	return n.RideID
+}
+
+func TestNotificationStreamPendingLimit(t *testing.T) {
+	tests := []struct {
+		name          string
+		rides         int
+		perRide       int
+		wantPending   int
+		wantCoalesced bool
+		wantDropped   int64
+	}{
+		{name: "within limit", rides: 1, perRide: notificationPendingLimit, wantPending: notificationPendingLimit},
+		{name: "same ride is coalesced", rides: 1, perRide: notificationPendingLimit + 4, wantPending: 4, wantCoalesced: true},
+		{name: "distinct rides are dropped", rides: notificationPendingLimit + 3, perRide: 1, wantPending: notificationPendingLimit, wantDropped: 3},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			stats := &notificationStats{}
+			s := newNotificationStream(testNotificationKey, stats)
+			for r := 0; r < tt.rides; r++ {
+				for i := 0; i < tt.perRide; i++ {
+					s.append(&testNotification{RideID: fmt.Sprint(r), Status: fmt.Sprint(i)})
+				}
+			}
+
+			s.mu.Lock()
+			pending := s.pendingCount()
+			s.mu.Unlock()
+			if pending != tt.wantPending {
+				t.Errorf("pending = %d, want %d", pending, tt.wantPending)
+			}
+			if got := stats.Dropped.Load(); got != tt.wantDropped {
+				t.Errorf("dropped = %d, want %d", got, tt.wantDropped)
+			}
+			if got := stats.Coalesced.Load() > 0; got != tt.wantCoalesced {
+				t.Errorf("coalesced = %d, want coalesced %v", stats.Coalesced.Load(), tt.wantCoalesced)
+			}
+		})
+	}
+}
+
+func TestNotificationStreamCoalesceKeepsLatest(t *testing.T) {
+	s := newNotificationStream(testNotificationKey, &notificationStats{})
+	for i := 0; i <= notificationPendingLimit; i++ {
+		s.append(&testNotification{RideID: "ride", Status: fmt.Sprint(i)})
+	}
+
+	events, _ := s.eventsAfter(0)
+	if len(events) != 1 {
+		t.Fatalf("len(events) = %d, want 1", len(events))
+	}
+	if got, want := events[0].Data.Status, fmt.Sprint(notificationPendingLimit); got != want {
+		t.Errorf("status = %s, want %s", got, want)
+	}
+}
+
+func TestNotificationStreamMarkSent(t *testing.T) {
+	s := newNotificationStream(testNotificationKey, &notificationStats{})
+	first := s.append(&testNotification{RideID: "a"})
+	second := s.append(&testNotification{RideID: "b"})
+
+	tests := []struct {
+		id   int64
+		want bool
+	}{
+		{id: first, want: true},
+		{id: first, want: false},
+		{id: second, want: true},
+		{id: first, want: false},
+	}
+	for _, tt := range tests {
+		if got := s.markSent(tt.id); got != tt.want {
+			t.Errorf("markSent(%d) = %v, want %v", tt.id, got, tt.want)
+		}
+	}
+	if _, ok := s.nextUnsent(); ok {
+		t.Error("nextUnsent returned an event after all were sent")
+	}
+}
+
+func TestNotificationStreamMapEvictIdle(t *testing.T) {
+	m := newNotificationStreamMap(testNotificationKey)
+	m.get("idle")
+	m.get("connected")
+	disconnect := m.connect("connected")
+	defer disconnect()
+
+	now := time.Now()
+	if got := m.evictIdle(now, time.Hour); got != 0 {
+		t.Errorf("evicted %d recently used streams", got)
+	}
+	if got := m.evictIdle(now.Add(2*time.Hour), time.Hour); got != 1 {
+		t.Errorf("evicted = %d, want 1", got)
+	}
+	if _, ok := m.streams["connected"]; !ok {
+		t.Error("a stream with a connection was evicted")
+	}
+	if _, ok := m.streams["idle"]; ok {
+		t.Error("an idle stream was not evicted")
+	}
+}
+
+func TestNotificationStreamMarkDelivered(t *testing.T) {
+	s := newNotificationStream(testNotificationKey, &notificationStats{})
+
+	tests := []struct {
+		rideStatusID string
+		want         bool
+	}{
+		{rideStatusID: "enroute", want: true},
+		{rideStatusID: "enroute", want: false},
+		{rideStatusID: "enroute", want: false},
+		{rideStatusID: "pickup", want: true},
+		{rideStatusID: "pickup", want: false},
+	}
+	for _, tt := range tests {
+		if got := s.markDelivered(tt.rideStatusID); got != tt.want {
+			t.Errorf("markDelivered(%s) = %v, want %v", tt.rideStatusID, got, tt.want)
+		}
+	}
+}
@@ -63,9 +63,11 @@ func ownerPostOwners(w http.ResponseWriter, r *http.Request) {
 }
 
 type chairSales struct {
-	ID    string `json:"id"`
-	Name  string `json:"name"`
-	Sales int    `json:"sales"`
+	ID             string `json:"id"`
+	Name           string `json:"name"`
+	Sales          int    `json:"sales"`
+	DrivenDistance int    `json:"driven_distance"`
+	Payout         int    `json:"payout"`
 }
 
 type modelSales struct {
@@ -74,9 +76,10 @@ type modelSales struct {
 }
 
 type ownerGetSalesResponse struct {
-	TotalSales int          `json:"total_sales"`
-	Chairs     []chairSales `json:"chairs"`
-	Models     []modelSales `json:"models"`
+	TotalSales  int          `json:"total_sales"`
+	TotalPayout int          `json:"total_payout"`
+	Chairs      []chairSales `json:"chairs"`
+	Models      []modelSales `json:"models"`
 }
 
 func ownerGetSales(w http.ResponseWriter, r *http.Request) {
@@ -130,10 +133,24 @@ func ownerGetSales(w http.ResponseWriter, r *http.Request) {
 		sales := sumSales(rides)
 		res.TotalSales += sales
 
+		rideIDs := make([]string, 0, len(rides))
+		for _, ride := range rides {
+			rideIDs = append(rideIDs, ride.ID)
+		}
+		rideMetrics, err := getRideMetrics(ctx, rideIDs)
+		if err != nil {
+			writeError(w, http.StatusInternalServerError, err)
+			return
+		}
+		drivenDistance, payout := sumPayouts(rides, rideMetrics)
+		res.TotalPayout += payout
+
 		res.Chairs = append(res.Chairs, chairSales{
-			ID:    chair.ID,
-			Name:  chair.Name,
-			Sales: sales,
+			ID:             chair.ID,
+			Name:           chair.Name,
+			Sales:          sales,
+			DrivenDistance: drivenDistance,
+			Payout:         payout,
 		})
 
 		modelSalesByModel[chair.Model] += sales
@@ -159,8 +176,22 @@ func sumSales(rides []Ride) int {
 	return sale
 }
 
+// sumPayouts は実際に走った距離と、売上に迎車の距離分を加えた支払額を返す
+// 計測値のないライドは売上だけを支払う
+func sumPayouts(rides []Ride, rideMetrics map[string]RideMetrics) (int, int) {
+	drivenDistance, payout := 0, 0
+	for _, ride := range rides {
+		payout += calculateSale(ride)
+		if metrics, ok := rideMetrics[ride.ID]; ok {
+			drivenDistance += metrics.EnrouteDistance + metrics.CarryingDistance
+			payout += metrics.EnrouteDistance * pickupPayoutPerDistance
+		}
+	}
+	return drivenDistance, payout
+}
+
 func calculateSale(ride Ride) int {
-	return calculateFare(ride.PickupLatitude, ride.PickupLongitude, ride.DestinationLatitude, ride.DestinationLongitude)
+	return calculateFare(&ride)
 }
 
 type chairWithDetail struct {
@@ -181,13 +212,18 @@ type ownerGetChairResponse struct {
 }
 
 type ownerGetChairResponseChair struct {
-	ID                     string `json:"id"`
-	Name                   string `json:"name"`
-	Model                  string `json:"model"`
-	Active                 bool   `json:"active"`
-	RegisteredAt           int64  `json:"registered_at"`
-	TotalDistance          int    `json:"total_distance"`
-	TotalDistanceUpdatedAt *int64 `json:"total_distance_updated_at,omitempty"`
+	ID                     string   `json:"id"`
+	Name                   string   `json:"name"`
+	Model                  string   `json:"model"`
+	Active                 bool     `json:"active"`
+	RegisteredAt           int64    `json:"registered_at"`
+	TotalDistance          int      `json:"total_distance"`
+	TotalDistanceUpdatedAt *int64   `json:"total_distance_updated_at,omitempty"`
+	Online                 bool     `json:"online"`
+	LastSeenAt             *int64   `json:"last_seen_at,omitempty"`
+	Battery                *int     `json:"battery,omitempty"`
+	RemainingRange         *int     `json:"remaining_range,omitempty"`
+	MaintenanceFlags       []string `json:"maintenance_flags"`
 }
 
 func ownerGetChairs(w http.ResponseWriter, r *http.Request) {
@@ -206,14 +242,22 @@ func ownerGetChairs(w http.ResponseWriter, r *http.Request) {
 	chairLocationCacheMapRWMutex.RLock()
 	defer chairLocationCacheMapRWMutex.RUnlock()
 
+	now := time.Now()
 	res := ownerGetChairResponse{}
 	for _, chair := range chairs {
 		totalDistance := 0
 		totalDistanceUpdatedAt := (*int64)(nil)
+		locationUpdatedAt := time.Time{}
 		if location, ok := chairLocationCacheMap[chair.ID]; ok {
 			totalDistance = location.TotalDistance
 			t := location.UpdatedAt.UnixMilli()
 			totalDistanceUpdatedAt = &t
+			locationUpdatedAt = location.UpdatedAt
+		}
+		lastSeenAt := (*int64)(nil)
+		if seen := chairLastSeenAt(chair.ID, locationUpdatedAt); !seen.IsZero() {
+			t := seen.UnixMilli()
+			lastSeenAt = &t
 		}
 		c := ownerGetChairResponseChair{
 			ID:                     chair.ID,
@@ -223,8 +267,423 @@ func ownerGetChairs(w http.ResponseWriter, r *http.Request) {
 			RegisteredAt:           chair.CreatedAt.UnixMilli(),
 			TotalDistance:          totalDistance,
 			TotalDistanceUpdatedAt: totalDistanceUpdatedAt,
+			Online:                 isChairOnline(chair.ID, locationUpdatedAt, now),
+			LastSeenAt:             lastSeenAt,
+			MaintenanceFlags:       []string{},
+		}
+		if condition, ok := getChairConditionFromCache(chair.ID); ok {
+			c.Battery = condition.Battery
+			if remaining, ok := condition.remainingRange(); ok {
+				c.RemainingRange = &remaining
+			}
+			c.MaintenanceFlags = condition.MaintenanceFlags
 		}
 		res.Chairs = append(res.Chairs, c)
 	}
 	writeJSON(w, http.StatusOK, res)
 }
+
+type ownerPostWebhooksRequest struct {
+	URL string `json:"url"`
+}
+
+type ownerWebhookResponse struct {
+	ID        string `json:"id"`
+	URL       string `json:"url"`
+	CreatedAt int64  `json:"created_at"`
+}
+
+type ownerGetWebhooksResponse struct {
+	Webhooks []ownerWebhookResponse `json:"webhooks"`
+}
+
+type ownerPostWebhooksResponse struct {
+	ID     string `json:"id"`
+	URL    string `json:"url"`
+	Secret string `json:"secret"`
+}
+
+// ownerPostWebhooks は署名の検証に使う秘密鍵を登録時にだけ返す
+func ownerPostWebhooks(w http.ResponseWriter, r *http.Request) {
+	ctx := r.Context()
+	owner := ctx.Value("owner").(*Owner)
+
+	req := &ownerPostWebhooksRequest{}
+	if err := bindJSON(r, req); err != nil {
+		writeError(w, http.StatusBadRequest, err)
+		return
+	}
+	if err := validateWebhookURL(ctx, req.URL); err != nil {
+		writeError(w, http.StatusBadRequest, err)
+		return
+	}
+
+	webhook := OwnerWebhook{
+		ID:        ulid.Make().String(),
+		OwnerID:   owner.ID,
+		URL:       req.URL,
+		Secret:    secureRandomStr(32),
+		CreatedAt: time.Now().Truncate(time.Microsecond),
+	}
+	if _, err := db.NamedExecContext(
+		ctx,
+		"INSERT INTO owner_webhooks (id, owner_id, url, secret, created_at) VALUES (:id, :owner_id, :url, :secret, :created_at)",
+		webhook,
+	); err != nil {
+		writeError(w, http.StatusInternalServerError, err)
+		return
+	}
+	insertOwnerWebhookCache(webhook)
+	publishCacheReloadToBus("owner_webhooks")
+
+	writeJSON(w, http.StatusCreated, &ownerPostWebhooksResponse{
+		ID:     webhook.ID,
+		URL:    webhook.URL,
+		Secret: webhook.Secret,
+	})
+}
+
+func ownerGetWebhooks(w http.ResponseWriter, r *http.Request) {
+	owner := r.Context().Value("owner").(*Owner)
+
+	res := []ownerWebhookResponse{}
+	for _, webhook := range getOwnerWebhooksFromCache(owner.ID) {
+		res = append(res, ownerWebhookResponse{
+			ID:        webhook.ID,
+			URL:       webhook.URL,
+			CreatedAt: webhook.CreatedAt.UnixMilli(),
+		})
+	}
+	writeJSON(w, http.StatusOK, &ownerGetWebhooksResponse{Webhooks: res})
+}
+
+func ownerDeleteWebhook(w http.ResponseWriter, r *http.Request) {
+	ctx := r.Context()
+	owner := ctx.Value("owner").(*Owner)
+	webhookID := r.PathValue("webhook_id")
+
+	result, err := db.ExecContext(ctx, "DELETE FROM owner_webhooks WHERE id = ? AND owner_id = ?", webhookID, owner.ID)
+	if err != nil {
+		writeError(w, http.StatusInternalServerError, err)
+		return
+	}
+	if count, err := result.RowsAffected(); err != nil {
+		writeError(w, http.StatusInternalServerError, err)
+		return
+	} else if count == 0 {
+		writeError(w, http.StatusNotFound, errors.New("webhook not found"))
+		return
+	}
+	deleteOwnerWebhookCache(owner.ID, webhookID)
+	publishCacheReloadToBus("owner_webhooks")
+
+	w.WriteHeader(http.StatusNoContent)
+}
+
+type ownerWebhookDeliveryResponse struct {
+	ID             string  `json:"id"`
+	EventType      string  `json:"event_type"`
+	Payload        string  `json:"payload"`
+	Status         string  `json:"status"`
+	Attempts       int     `json:"attempts"`
+	LastStatusCode *int    `json:"last_status_code"`
+	LastError      *string `json:"last_error"`
+	CreatedAt      int64   `json:"created_at"`
+	UpdatedAt      int64   `json:"updated_at"`
+}
+
+type ownerGetWebhookDeliveriesResponse struct {
+	Deliveries []ownerWebhookDeliveryResponse `json:"deliveries"`
+}
+
+// ownerGetWebhookDeliveries は新しい順に最大100件の配信履歴を返す
+func ownerGetWebhookDeliveries(w http.ResponseWriter, r *http.Request) {
+	ctx := r.Context()
+	owner := ctx.Value("owner").(*Owner)
+	webhookID := r.PathValue("webhook_id")
+
+	found := false
+	for _, webhook := range getOwnerWebhooksFromCache(owner.ID) {
+		if webhook.ID == webhookID {
+			found = true
+			break
+		}
+	}
+	if !found {
+		writeError(w, http.StatusNotFound, errors.New("webhook not found"))
+		return
+	}
+
+	deliveries, err := webhookDeliveries.listByWebhook(ctx, webhookID, 100)
+	if err != nil {
+		writeError(w, http.StatusInternalServerError, err)
+		return
+	}
+
+	res := []ownerWebhookDeliveryResponse{}
+	for _, delivery := range deliveries {
+		res = append(res, ownerWebhookDeliveryResponse{
+			ID:             delivery.ID,
+			EventType:      delivery.EventType,
+			Payload:        delivery.Payload,
+			Status:         delivery.Status,
+			Attempts:       delivery.Attempts,
+			LastStatusCode: delivery.LastStatusCode,
+			LastError:      delivery.LastError,
+			CreatedAt:      delivery.CreatedAt.UnixMilli(),
+			UpdatedAt:      delivery.UpdatedAt.UnixMilli(),
+		})
+	}
+	writeJSON(w, http.StatusOK, &ownerGetWebhookDeliveriesResponse{Deliveries: res})
+}
+
+// 1回の応答に含める座標の上限
+const ownerChairLocationsLimit = 10000
+
+type ownerChairLocation struct {
+	Latitude   int   `json:"latitude"`
+	Longitude  int   `json:"longitude"`
+	RecordedAt int64 `json:"recorded_at"`
+}
+
+type ownerGetChairLocationsResponse struct {
+	ChairID   string               `json:"chair_id"`
+	Locations []ownerChairLocation `json:"locations"`
+}
+
+func newOwnerChairLocations(locations []ChairLocation) []ownerChairLocation {
+	res := make([]ownerChairLocation, 0, len(locations))
+	for _, location := range locations {
+		res = append(res, ownerChairLocation{
+			Latitude:   location.Latitude,
+			Longitude:  location.Longitude,
+			RecordedAt: location.CreatedAt.UnixMilli(),
+		})
+	}
+	return res
+}
+
+// ownerGetChairLocations は椅子が通った座標を古い順に返す。期間を省略した場合は直近1時間
+func ownerGetChairLocations(w http.ResponseWriter, r *http.Request) {
+	ctx := r.Context()
+	owner := ctx.Value("owner").(*Owner)
+	chairID := r.PathValue("chair_id")
+
+	chair, err := getChairByID(chairID)
+	if err != nil || chair.OwnerID != owner.ID {
+		writeError(w, http.StatusNotFound, errors.New("chair not found"))
+		return
+	}
+
+	until := time.Now()
+	since := until.Add(-1 * time.Hour)
+	if r.URL.Query().Get("since") != "" {
+		parsed, err := strconv.ParseInt(r.URL.Query().Get("since"), 10, 64)
+		if err != nil {
+			writeError(w, http.StatusBadRequest, err)
+			return
+		}
+		since = time.UnixMilli(parsed)
+	}
+	if r.URL.Query().Get("until") != "" {
+		parsed, err := strconv.ParseInt(r.URL.Query().Get("until"), 10, 64)
+		if err != nil {
+			writeError(w, http.StatusBadRequest, err)
+			return
+		}
+		until = time.UnixMilli(parsed)
+	}
+
+	locations, err := getChairLocationHistory(ctx, chairID, since, until, ownerChairLocationsLimit)
+	if err != nil {
+		writeError(w, http.StatusInternalServerError, err)
+		return
+	}
+
+	writeJSON(w, http.StatusOK, &ownerGetChairLocationsResponse{
+		ChairID:   chairID,
+		Locations: newOwnerChairLocations(locations),
+	})
+}
+
+type ownerRideRouteStatus struct {
+	Status    string `json:"status"`
+	ChangedAt int64  `json:"changed_at"`
+}
+
+type ownerRideGeofenceEvent struct {
+	Fence      string     `json:"fence"`
+	Event      string     `json:"event"`
+	Coordinate Coordinate `json:"coordinate"`
+	OccurredAt int64      `json:"occurred_at"`
+}
+
+type ownerGetRideRouteResponse struct {
+	RideID         string                   `json:"ride_id"`
+	ChairID        string                   `json:"chair_id"`
+	Statuses       []ownerRideRouteStatus   `json:"statuses"`
+	Path           []ownerChairLocation     `json:"path"`
+	GeofenceEvents []ownerRideGeofenceEvent `json:"geofence_events"`
+}
+
+// ownerGetRideRoute は椅子が乗車地に向かい始めてから目的地に着くまでの経路を返す
+// 走行中のライドは現在までの経路を返す
+func ownerGetRideRoute(w http.ResponseWriter, r *http.Request) {
+	ctx := r.Context()
+	owner := ctx.Value("owner").(*Owner)
+	rideID := r.PathValue("ride_id")
+
+	ride, found := getRideByIDFromCache(rideID)
+	if !found || !ride.ChairID.Valid {
+		writeError(w, http.StatusNotFound, errors.New("ride not found"))
+		return
+	}
+	chair, err := getChairByID(ride.ChairID.String)
+	if err != nil || chair.OwnerID != owner.ID {
+		writeError(w, http.StatusNotFound, errors.New("ride not found"))
+		return
+	}
+
+	rideStatuses := []RideStatus{}
+	if err := db.SelectContext(ctx, &rideStatuses, "SELECT * FROM ride_statuses WHERE ride_id = ? ORDER BY created_at", rideID); err != nil {
+		writeError(w, http.StatusInternalServerError, err)
+		return
+	}
+
+	statuses := make([]ownerRideRouteStatus, 0, len(rideStatuses))
+	var since, until *time.Time
+	for _, rideStatus := range rideStatuses {
+		statuses = append(statuses, ownerRideRouteStatus{
+			Status:    rideStatus.Status,
+			ChangedAt: rideStatus.CreatedAt.UnixMilli(),
+		})
+		switch rideStatus.Status {
+		case "ENROUTE":
+			if since == nil {
+				t := rideStatus.CreatedAt
+				since = &t
+			}
+		case "ARRIVED":
+			t := rideStatus.CreatedAt
+			until = &t
+		}
+	}
+
+	path := []ownerChairLocation{}
+	if since != nil {
+		if until == nil {
+			now := time.Now()
+			until = &now
+		}
+		locations, err := getChairLocationHistory(ctx, chair.ID, *since, *until, ownerChairLocationsLimit)
+		if err != nil {
+			writeError(w, http.StatusInternalServerError, err)
+			return
+		}
+		path = newOwnerChairLocations(locations)
+	}
+
+	events, err := getRideGeofenceEvents(ctx, ride.ID)
+	if err != nil {
+		writeError(w, http.StatusInternalServerError, err)
+		return
+	}
+	geofenceEvents := make([]ownerRideGeofenceEvent, 0, len(events))
+	for _, event := range events {
+		geofenceEvents = append(geofenceEvents, ownerRideGeofenceEvent{
+			Fence:      event.Fence,
+			Event:      event.Event,
+			Coordinate: Coordinate{Latitude: event.Latitude, Longitude: event.Longitude},
+			OccurredAt: event.CreatedAt.UnixMilli(),
+		})
+	}
+
+	writeJSON(w, http.StatusOK, &ownerGetRideRouteResponse{
+		RideID:         ride.ID,
+		ChairID:        chair.ID,
+		Statuses:       statuses,
+		Path:           path,
+		GeofenceEvents: geofenceEvents,
+	})
+}
+
+type ownerChairScheduleSlot struct {
+	// 0 が日曜日
+	DayOfWeek int `json:"day_of_week"`
+	// 0 時からの分。end_minute の時刻は含まない
+	StartMinute int `json:"start_minute"`
+	EndMinute   int `json:"end_minute"`
+}
+
+type ownerChairScheduleResponse struct {
+	ChairID string                   `json:"chair_id"`
+	Slots   []ownerChairScheduleSlot `json:"slots"`
+}
+
+type ownerPutChairScheduleRequest struct {
+	Slots []ownerChairScheduleSlot `json:"slots"`
+}
+
+func newOwnerChairScheduleResponse(chairID string, schedules []ChairSchedule) *ownerChairScheduleResponse {
+	res := &ownerChairScheduleResponse{ChairID: chairID, Slots: make([]ownerChairScheduleSlot, 0, len(schedules))}
+	for _, s := range schedules {
+		res.Slots = append(res.Slots, ownerChairScheduleSlot{
+			DayOfWeek:   s.DayOfWeek,
+			StartMinute: s.StartMinute,
+			EndMinute:   s.EndMinute,
+		})
+	}
+	return res
+}
+
+func ownerGetChairSchedule(w http.ResponseWriter, r *http.Request) {
+	owner := r.Context().Value("owner").(*Owner)
+	chairID := r.PathValue("chair_id")
+
+	chair, err := getChairByID(chairID)
+	if err != nil || chair.OwnerID != owner.ID {
+		writeError(w, http.StatusNotFound, errors.New("chair not found"))
+		return
+	}
+
+	writeJSON(w, http.StatusOK, newOwnerChairScheduleResponse(chair.ID, getChairScheduleFromCache(chair.ID)))
+}
+
+// ownerPutChairSchedule は椅子の週ごとの稼働時間を置き換える。slots が空なら稼働時間による切り替えをやめる
+func ownerPutChairSchedule(w http.ResponseWriter, r *http.Request) {
+	ctx := r.Context()
+	owner := ctx.Value("owner").(*Owner)
+	chairID := r.PathValue("chair_id")
+
+	chair, err := getChairByID(chairID)
+	if err != nil || chair.OwnerID != owner.ID {
+		writeError(w, http.StatusNotFound, errors.New("chair not found"))
+		return
+	}
+
+	req := &ownerPutChairScheduleRequest{}
+	if err := bindJSON(r, req); err != nil {
+		writeError(w, http.StatusBadRequest, err)
+		return
+	}
+	schedules := make([]ChairSchedule, 0, len(req.Slots))
+	for _, slot := range req.Slots {
+		schedules = append(schedules, ChairSchedule{
+			ChairID:     chair.ID,
+			DayOfWeek:   slot.DayOfWeek,
+			StartMinute: slot.StartMinute,
+			EndMinute:   slot.EndMinute,
+		})
+	}
+	if err := validateChairSchedule(schedules); err != nil {
+		writeError(w, http.StatusBadRequest, err)
+		return
+	}
+
+	if err := replaceChairSchedule(ctx, chair.ID, schedules); err != nil {
+		writeError(w, http.StatusInternalServerError, err)
+		return
+	}
+
+	writeJSON(w, http.StatusOK, newOwnerChairScheduleResponse(chair.ID, schedules))
+}
@@ -0,0 +1,112 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"sync"
+	"time"
+
+	"github.com/jmoiron/sqlx"
+)
+
+const defaultReferralTier = "STANDARD"
+
+var errInvitationLimitReached = errors.New("invitation limit reached")
+
+var referralTierCacheMapRWMutex = sync.RWMutex{}
+var referralTierCacheMap map[string]*ReferralTier = make(map[string]*ReferralTier)
+
+func loadReferralTierCacheMap() error {
+	referralTierCacheMapRWMutex.Lock()
+	defer referralTierCacheMapRWMutex.Unlock()
+
+	tiers := []*ReferralTier{}
+	if err := db.Select(&tiers, "SELECT * FROM referral_tiers"); err != nil {
+		return err
+	}
+
+	referralTierCacheMap = make(map[string]*ReferralTier)
+	for _, tier := range tiers {
+		referralTierCacheMap[tier.Tier] = tier
+	}
+	return nil
+}
+
+func upsertReferralTierCacheMap(tier ReferralTier) {
+	referralTierCacheMapRWMutex.Lock()
+	defer referralTierCacheMapRWMutex.Unlock()
+
+	referralTierCacheMap[tier.Tier] = &tier
+}
+
+// getReferralTier は設定が無いランクの場合 STANDARD の設定を返す
+func getReferralTier(tier string) (*ReferralTier, bool) {
+	referralTierCacheMapRWMutex.RLock()
+	defer referralTierCacheMapRWMutex.RUnlock()
+
+	if t, ok := referralTierCacheMap[tier]; ok {
+		return t, true
+	}
+	t, ok := referralTierCacheMap[defaultReferralTier]
+	return t, ok
+}
+
+// registerReferral は招待コードを使った登録を記録し、双方にクーポンを付与する
+// 招待した側の行をロックしてから数えるので、同じ招待コードの同時利用でも上限を超えない
+func registerReferral(ctx context.Context, tx *sqlx.Tx, inviter *User, inviteeID string) ([]Coupon, error) {
+	lockedID := ""
+	if err := tx.GetContext(ctx, &lockedID, "SELECT id FROM users WHERE id = ? FOR UPDATE", inviter.ID); err != nil {
+		return nil, err
+	}
+
+	tier, ok := getReferralTier(inviter.Tier)
+	if !ok {
+		return nil, errInvitationLimitReached
+	}
+
+	referralCount := 0
+	if err := tx.GetContext(ctx, &referralCount, "SELECT COUNT(*) FROM referrals WHERE inviter_id = ?", inviter.ID); err != nil {
+		return nil, err
+	}
+	if referralCount >= tier.MaxReferrals {
+		return nil, errInvitationLimitReached
+	}
+
+	issuedCoupons := []Coupon{}
+
+	referral := Referral{
+		InviteeID:      inviteeID,
+		InviterID:      inviter.ID,
+		InvitationCode: inviter.InvitationCode,
+	}
+
+	inviteeCouponCode := "INV_" + inviter.InvitationCode
+	issued, err := issueCampaignCoupon(ctx, tx, tier.InviteeCampaignCode, inviteeID, inviteeCouponCode)
+	if err != nil {
+		return nil, err
+	}
+	if issued != nil {
+		referral.InviteeCouponCode = &inviteeCouponCode
+		issuedCoupons = append(issuedCoupons, *issued)
+	}
+
+	inviterCouponCode := fmt.Sprintf("RWD_%s_%d", inviter.InvitationCode, time.Now().UnixMilli())
+	issued, err = issueCampaignCoupon(ctx, tx, tier.InviterCampaignCode, inviter.ID, inviterCouponCode)
+	if err != nil {
+		return nil, err
+	}
+	if issued != nil {
+		referral.InviterCouponCode = &inviterCouponCode
+		issuedCoupons = append(issuedCoupons, *issued)
+	}
+
+	if _, err := tx.NamedExecContext(
+		ctx,
+		"INSERT INTO referrals (invitee_id, inviter_id, invitation_code, invitee_coupon_code, inviter_coupon_code) VALUES (:invitee_id, :inviter_id, :invitation_code, :invitee_coupon_code, :inviter_coupon_code)",
+		referral,
+	); err != nil {
+		return nil, err
+	}
+	return issuedCoupons, nil
+}
@@ -4,6 +4,8 @@ import (
 	"context"
 	"errors"
 	"log/slog"
+	"strings"
+	"sync"
 	"time"
 )
 
@@ -21,6 +23,8 @@ type RideStatusSentAtRequest struct {
 	ChairID      string
 	Status       string
 	SentType     RideStatusSentType
+	// 他のノードから届いた印。送り返さない
+	FromBus bool `json:"-"`
 }
 
 var rideStatusSentAtChan = make(chan RideStatusSentAtRequest, 1000)
@@ -31,11 +35,54 @@ type RideStatusSentAt struct {
 	EvaluationResultFlushed bool
 }
 
+var rideStatusSentAtCacheMutex = sync.Mutex{}
 var rideStatusSentAtCache = make(map[string]*RideStatusSentAt)
 
+// markRideStatusSentAt は送信済みの印を付け、更新後の状態のコピーを返す
+func markRideStatusSentAt(rideStatusID string, sentType RideStatusSentType) RideStatusSentAt {
+	rideStatusSentAtCacheMutex.Lock()
+	defer rideStatusSentAtCacheMutex.Unlock()
+
+	if rideStatusSentAtCache[rideStatusID] == nil {
+		rideStatusSentAtCache[rideStatusID] = &RideStatusSentAt{}
+	}
+	rideStatusSentAt := rideStatusSentAtCache[rideStatusID]
+	switch sentType {
+	case AppNotification:
+		rideStatusSentAt.AppNotificationDone = true
+	case ChairNotification:
+		rideStatusSentAt.ChairNotificationDone = true
+	case EvaluationResultFlushed:
+		rideStatusSentAt.EvaluationResultFlushed = true
+	}
+	return *rideStatusSentAt
+}
+
+// loadRideStatusSentAtCache は椅子の解放を待っている COMPLETED のステータスについて送信済みの印を DB から復元する
+// COMPLETED は評価のコミット後にしか記録されないので、評価結果は反映済みとみなす
+func loadRideStatusSentAtCache() error {
+	rideStatusSentAtCacheMutex.Lock()
+	defer rideStatusSentAtCacheMutex.Unlock()
+
+	rideStatuses := []RideStatus{}
+	if err := db.Select(&rideStatuses, "SELECT * FROM ride_statuses WHERE status = 'COMPLETED' AND (app_sent_at IS NULL OR chair_sent_at IS NULL)"); err != nil {
+		return err
+	}
+
+	rideStatusSentAtCache = make(map[string]*RideStatusSentAt)
+	for _, rideStatus := range rideStatuses {
+		rideStatusSentAtCache[rideStatus.ID] = &RideStatusSentAt{
+			AppNotificationDone:     rideStatus.AppSentAt != nil,
+			ChairNotificationDone:   rideStatus.ChairSentAt != nil,
+			EvaluationResultFlushed: true,
+		}
+	}
+	return nil
+}
+
 var errNoNeedToUpdate = errors.New("no need to update")
 
-func checkStatusAndUpdateChairFreeFlag(ctx context.Context, request RideStatusSentAtRequest) error {
+func checkStatusAndUpdateChairFreeFlag(ctx context.Context, request RideStatusSentAtRequest, rideStatusSentAt RideStatusSentAt) error {
 	if request.Status != "COMPLETED" {
 		return errNoNeedToUpdate
 	}
@@ -43,11 +90,6 @@ func checkStatusAndUpdateChairFreeFlag(ctx context.Context, request RideStatusSe
 		return errNoNeedToUpdate
 	}
 
-	if rideStatusSentAtCache[request.RideStatusID] == nil {
-		rideStatusSentAtCache[request.RideStatusID] = &RideStatusSentAt{}
-	}
-	rideStatusSentAt := rideStatusSentAtCache[request.RideStatusID]
-
 	if !rideStatusSentAt.AppNotificationDone || !rideStatusSentAt.ChairNotificationDone || !rideStatusSentAt.EvaluationResultFlushed {
 		return errNoNeedToUpdate
 	}
@@ -63,13 +105,10 @@ func checkStatusAndUpdateChairFreeFlag(ctx context.Context, request RideStatusSe
 
 func updateRideStatusAppSentAt(ctx context.Context, request RideStatusSentAtRequest) (time.Time, error) {
 	time := time.Now()
-	if rideStatusSentAtCache[request.RideStatusID] == nil {
-		rideStatusSentAtCache[request.RideStatusID] = &RideStatusSentAt{}
-	}
-	rideStatusSentAtCache[request.RideStatusID].AppNotificationDone = true
+	rideStatusSentAt := markRideStatusSentAt(request.RideStatusID, AppNotification)
 	slog.Info("updateRideStatusAppSentAt", "rideStatusId", request.RideStatusID, "time", time)
 
-	if err := checkStatusAndUpdateChairFreeFlag(ctx, request); err != nil {
+	if err := checkStatusAndUpdateChairFreeFlag(ctx, request, rideStatusSentAt); err != nil {
 		if errors.Is(err, errNoNeedToUpdate) {
 			return time, nil
 		} else {
@@ -82,13 +121,10 @@ func updateRideStatusAppSentAt(ctx context.Context, request RideStatusSentAtRequ
 
 func updateRideStatusChairSentAt(ctx context.Context, request RideStatusSentAtRequest) (time.Time, error) {
 	time := time.Now()
-	if rideStatusSentAtCache[request.RideStatusID] == nil {
-		rideStatusSentAtCache[request.RideStatusID] = &RideStatusSentAt{}
-	}
-	rideStatusSentAtCache[request.RideStatusID].ChairNotificationDone = true
+	rideStatusSentAt := markRideStatusSentAt(request.RideStatusID, ChairNotification)
 	slog.Info("updateRideStatusChairSentAt", "rideStatusId", request.RideStatusID, "time", time)
 
-	if err := checkStatusAndUpdateChairFreeFlag(ctx, request); err != nil {
+	if err := checkStatusAndUpdateChairFreeFlag(ctx, request, rideStatusSentAt); err != nil {
 		if errors.Is(err, errNoNeedToUpdate) {
 			return time, nil
 		} else {
@@ -102,13 +138,10 @@ func updateRideStatusChairSentAt(ctx context.Context, request RideStatusSentAtRe
 func updateRideStatusEvaluationResultFlushed(ctx context.Context, request RideStatusSentAtRequest) (time.Time, error) {
 	time := time.Now()
 
-	if rideStatusSentAtCache[request.RideStatusID] == nil {
-		rideStatusSentAtCache[request.RideStatusID] = &RideStatusSentAt{}
-	}
-	rideStatusSentAtCache[request.RideStatusID].EvaluationResultFlushed = true
+	rideStatusSentAt := markRideStatusSentAt(request.RideStatusID, EvaluationResultFlushed)
 	slog.Info("updateRideStatusEvaluationResultFlushed", "rideStatusId", request.RideStatusID)
 
-	if err := checkStatusAndUpdateChairFreeFlag(ctx, request); err != nil {
+	if err := checkStatusAndUpdateChairFreeFlag(ctx, request, rideStatusSentAt); err != nil {
 		if errors.Is(err, errNoNeedToUpdate) {
 			return time, nil
 		} else {
@@ -119,20 +152,106 @@ func updateRideStatusEvaluationResultFlushed(ctx context.Context, request RideSt
 	return time, nil
 }
 
+// 送信日時はまとめて DB に書き戻す
+const rideStatusSentAtFlushInterval = 100 * time.Millisecond
+const rideStatusSentAtBatchSize = 500
+
+// DB に書けない間に溜めておく送信日時の上限と、諦めるまでに書き戻しを試す回数
+const rideStatusSentAtPendingLimit = 10000
+const rideStatusSentAtMaxAttempts = 50
+
+// rideStatusSentAtPending は書き戻し待ちの送信日時。書き戻しに失敗した分は次の周期で再試行する
+type rideStatusSentAtPending struct {
+	column   string
+	sentAt   map[string]time.Time
+	failures int
+}
+
+func newRideStatusSentAtPending(column string) *rideStatusSentAtPending {
+	return &rideStatusSentAtPending{column: column, sentAt: map[string]time.Time{}}
+}
+
+// add は最初に送った日時だけを残す。上限に達していれば捨てる
+func (p *rideStatusSentAtPending) add(rideStatusID string, t time.Time) {
+	if _, ok := p.sentAt[rideStatusID]; ok {
+		return
+	}
+	if len(p.sentAt) >= rideStatusSentAtPendingLimit {
+		slog.Error("ride status sent at buffer is full, dropping", "column", p.column, "ride_status_id", rideStatusID)
+		return
+	}
+	p.sentAt[rideStatusID] = t
+}
+
+// flush は失敗が rideStatusSentAtMaxAttempts 回続いたら、溜まっている分を捨てる
+func (p *rideStatusSentAtPending) flush(ctx context.Context) {
+	if err := flushRideStatusSentAt(ctx, p.column, p.sentAt); err != nil {
+		p.failures++
+		if p.failures < rideStatusSentAtMaxAttempts {
+			slog.Error("failed to flush ride status sent at", "column", p.column, "count", len(p.sentAt), "attempts", p.failures, "error", err)
+			return
+		}
+		slog.Error("giving up flushing ride status sent at", "column", p.column, "dropped", len(p.sentAt), "attempts", p.failures, "error", err)
+	}
+	p.sentAt = map[string]time.Time{}
+	p.failures = 0
+}
+
+// flushRideStatusSentAt は column が未設定の行だけを更新する。最初に送った日時を残すため
+func flushRideStatusSentAt(ctx context.Context, column string, sentAt map[string]time.Time) error {
+	if len(sentAt) == 0 {
+		return nil
+	}
+
+	query := "UPDATE ride_statuses SET " + column + " = CASE id"
+	args := make([]interface{}, 0, len(sentAt)*3)
+	for id, t := range sentAt {
+		query += " WHEN ? THEN ?"
+		args = append(args, id, t)
+	}
+	query += " END WHERE " + column + " IS NULL AND id IN (?" + strings.Repeat(", ?", len(sentAt)-1) + ")"
+	for id := range sentAt {
+		args = append(args, id)
+	}
+
+	_, err := db.ExecContext(ctx, query, args...)
+	return err
+}
+
+var rideStatusSentAtSyncer *asyncWorker
+
 func launchRideStatusSentAtSyncer() {
+	worker := newAsyncWorker()
+	rideStatusSentAtSyncer = worker
+
 	go func() {
-		for req := range rideStatusSentAtChan {
+		defer close(worker.done)
+
+		appSentAt := newRideStatusSentAtPending("app_sent_at")
+		chairSentAt := newRideStatusSentAtPending("chair_sent_at")
+		flush := func() {
+			ctx := context.Background()
+			appSentAt.flush(ctx)
+			chairSentAt.flush(ctx)
+		}
+
+		handle := func(req RideStatusSentAtRequest) {
 			ctx := context.Background()
+			if !req.FromBus {
+				publishRideStatusSentAtToBus(req)
+			}
 			if req.SentType == AppNotification {
 				if time, err := updateRideStatusAppSentAt(ctx, req); err != nil {
 					slog.Error("failed to update app sent at", "error", err)
 				} else {
+					appSentAt.add(req.RideStatusID, time)
 					slog.Info("updated app sent at", "rideId", req.RideID, "app_sent_at", time)
 				}
 			} else if req.SentType == ChairNotification {
 				if time, err := updateRideStatusChairSentAt(ctx, req); err != nil {
 					slog.Error("failed to update chair sent at", "error", err)
 				} else {
+					chairSentAt.add(req.RideStatusID, time)
 					slog.Info("updated chair sent at", "rideId", req.RideID, "chair_sent_at", time)
 				}
 			} else if req.SentType == EvaluationResultFlushed {
@@ -143,5 +262,30 @@ func launchRideStatusSentAtSyncer() {
 				}
 			}
 		}
+
+		ticker := time.NewTicker(rideStatusSentAtFlushInterval)
+		defer ticker.Stop()
+		for {
+			select {
+			case <-ticker.C:
+				flush()
+			case req := <-rideStatusSentAtChan:
+				handle(req)
+				if len(appSentAt.sentAt)+len(chairSentAt.sentAt) >= rideStatusSentAtBatchSize {
+					flush()
+				}
+			case <-worker.stop:
+				// 停止時はキューに残っている分も記録してから書き戻す
+				for {
+					select {
+					case req := <-rideStatusSentAtChan:
+						handle(req)
+					default:
+						flush()
+						return
+					}
+				}
+			}
+		}
 	}()
 }
@@ -0,0 +1,201 @@
+package main
+
+import (
+	"context"
+	"log/slog"
+	"sync"
+	"time"
+
+	"github.com/oklog/ulid/v2"
+)
+
+// 乗車地と目的地のまわりに半径 arrivalRadius の範囲を設け、椅子が入った・出たときに記録する
+// 範囲に入れば、座標がぴったり一致しなくても PICKUP / ARRIVED に進める
+
+const (
+	geofencePickup      = "PICKUP"
+	geofenceDestination = "DESTINATION"
+
+	geofenceEnter = "ENTER"
+	geofenceExit  = "EXIT"
+)
+
+// 乗車地や目的地に着いたとみなすマンハッタン距離。0 なら座標が一致したときだけ
+var arrivalRadius = 0
+
+func isWithinArrivalRadius(c Coordinate, latitude, longitude int) bool {
+	return abs(c.Latitude-latitude)+abs(c.Longitude-longitude) <= arrivalRadius
+}
+
+type chairGeofenceState struct {
+	RideID            string
+	InsidePickup      bool
+	InsideDestination bool
+	// 範囲に入ってステータスを進めたか。同時に座標が届いても一度しか進めない
+	PickupTransitioned      bool
+	DestinationTransitioned bool
+}
+
+var chairGeofenceStateMutex = sync.Mutex{}
+var chairGeofenceStates = make(map[string]*chairGeofenceState)
+
+// updateChairGeofence は椅子の範囲の出入りを更新し、起きたイベントを記録する
+// 新しいライドに切り替わったら、どちらの範囲にもいない状態から始める
+func updateChairGeofence(chairID string, ride *Ride, c Coordinate, now time.Time) {
+	insidePickup := isWithinArrivalRadius(c, ride.PickupLatitude, ride.PickupLongitude)
+	insideDestination := isWithinArrivalRadius(c, ride.DestinationLatitude, ride.DestinationLongitude)
+
+	chairGeofenceStateMutex.Lock()
+	state, ok := chairGeofenceStates[chairID]
+	if !ok || state.RideID != ride.ID {
+		state = &chairGeofenceState{RideID: ride.ID}
+		chairGeofenceStates[chairID] = state
+	}
+	pickupChanged := state.InsidePickup != insidePickup
+	destinationChanged := state.InsideDestination != insideDestination
+	state.InsidePickup = insidePickup
+	state.InsideDestination = insideDestination
+	chairGeofenceStateMutex.Unlock()
+
+	events := []RideGeofenceEvent{}
+	if pickupChanged {
+		events = append(events, newRideGeofenceEvent(chairID, ride.ID, geofencePickup, insidePickup, c, now))
+	}
+	if destinationChanged {
+		events = append(events, newRideGeofenceEvent(chairID, ride.ID, geofenceDestination, insideDestination, c, now))
+	}
+	if len(events) > 0 {
+		appendRideGeofenceEvents(events)
+	}
+}
+
+// claimGeofenceTransition は範囲に入ったことによるステータスの変更をまだ行っていなければ true を返す
+func claimGeofenceTransition(chairID, rideID, fence string) bool {
+	chairGeofenceStateMutex.Lock()
+	defer chairGeofenceStateMutex.Unlock()
+
+	state, ok := chairGeofenceStates[chairID]
+	if !ok || state.RideID != rideID {
+		return false
+	}
+	switch fence {
+	case geofencePickup:
+		if !state.InsidePickup || state.PickupTransitioned {
+			return false
+		}
+		state.PickupTransitioned = true
+	case geofenceDestination:
+		if !state.InsideDestination || state.DestinationTransitioned {
+			return false
+		}
+		state.DestinationTransitioned = true
+	default:
+		return false
+	}
+	return true
+}
+
+// releaseGeofenceTransition はステータスの変更に失敗したときに呼び、次の座標でもう一度進められるようにする
+func releaseGeofenceTransition(chairID, rideID, fence string) {
+	chairGeofenceStateMutex.Lock()
+	defer chairGeofenceStateMutex.Unlock()
+
+	state, ok := chairGeofenceStates[chairID]
+	if !ok || state.RideID != rideID {
+		return
+	}
+	switch fence {
+	case geofencePickup:
+		state.PickupTransitioned = false
+	case geofenceDestination:
+		state.DestinationTransitioned = false
+	}
+}
+
+func newRideGeofenceEvent(chairID, rideID, fence string, inside bool, c Coordinate, now time.Time) RideGeofenceEvent {
+	event := geofenceExit
+	if inside {
+		event = geofenceEnter
+	}
+	return RideGeofenceEvent{
+		ID:        ulid.Make().String(),
+		RideID:    rideID,
+		ChairID:   chairID,
+		Fence:     fence,
+		Event:     event,
+		Latitude:  c.Latitude,
+		Longitude: c.Longitude,
+		CreatedAt: now.Truncate(time.Microsecond),
+	}
+}
+
+// イベントは座標の履歴と同じく、椅子の位置の書き込みに合わせてまとめて書く
+var rideGeofenceEventMutex = sync.Mutex{}
+var rideGeofenceEventBuffer []RideGeofenceEvent
+
+// resetRideGeofences は範囲の出入りの状態と書き戻し待ちのイベントを捨てる
+func resetRideGeofences() {
+	chairGeofenceStateMutex.Lock()
+	chairGeofenceStates = make(map[string]*chairGeofenceState)
+	chairGeofenceStateMutex.Unlock()
+
+	rideGeofenceEventMutex.Lock()
+	rideGeofenceEventBuffer = nil
+	rideGeofenceEventMutex.Unlock()
+}
+
+func appendRideGeofenceEvents(events []RideGeofenceEvent) {
+	rideGeofenceEventMutex.Lock()
+	defer rideGeofenceEventMutex.Unlock()
+
+	if over := len(rideGeofenceEventBuffer) + len(events) - chairLocationHistoryBufferLimit; over > 0 {
+		slog.Warn("ride geofence event buffer is full, dropping the oldest entries", "dropped", over)
+		rideGeofenceEventBuffer = rideGeofenceEventBuffer[min(over, len(rideGeofenceEventBuffer)):]
+	}
+	rideGeofenceEventBuffer = append(rideGeofenceEventBuffer, events...)
+}
+
+func flushRideGeofenceEvents(ctx context.Context) error {
+	rideGeofenceEventMutex.Lock()
+	events := rideGeofenceEventBuffer
+	rideGeofenceEventBuffer = nil
+	rideGeofenceEventMutex.Unlock()
+
+	for start := 0; start < len(events); start += chairLocationHistoryBatchSize {
+		end := min(start+chairLocationHistoryBatchSize, len(events))
+		if _, err := db.NamedExecContext(
+			ctx,
+			`INSERT INTO ride_geofence_events (id, ride_id, chair_id, fence, event, latitude, longitude, created_at)
+			VALUES (:id, :ride_id, :chair_id, :fence, :event, :latitude, :longitude, :created_at)`,
+			events[start:end],
+		); err != nil {
+			rideGeofenceEventMutex.Lock()
+			rideGeofenceEventBuffer = append(events[start:], rideGeofenceEventBuffer...)
+			rideGeofenceEventMutex.Unlock()
+			return err
+		}
+	}
+	return nil
+}
+
+// getRideGeofenceEvents は DB とまだ書いていない分を合わせ、ライドのイベントを古い順に返す
+func getRideGeofenceEvents(ctx context.Context, rideID string) ([]RideGeofenceEvent, error) {
+	events := []RideGeofenceEvent{}
+	if err := db.SelectContext(ctx, &events, "SELECT * FROM ride_geofence_events WHERE ride_id = ? ORDER BY created_at", rideID); err != nil {
+		return nil, err
+	}
+
+	seen := make(map[string]struct{}, len(events))
+	for _, event := range events {
+		seen[event.ID] = struct{}{}
+	}
+
+	rideGeofenceEventMutex.Lock()
+	defer rideGeofenceEventMutex.Unlock()
+	for _, event := range rideGeofenceEventBuffer {
+		if _, ok := seen[event.ID]; !ok && event.RideID == rideID {
+			events = append(events, event)
+		}
+	}
+	return events, nil
+}
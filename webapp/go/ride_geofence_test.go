@@ -0,0 +1,32 @@
+package main
+
+import "testing"
+
+func TestGeofenceTransitionClaimAndRelease(t *testing.T) {
+	t.Cleanup(resetRideGeofences)
+	resetRideGeofences()
+	chairGeofenceStates["chair"] = &chairGeofenceState{RideID: "ride", InsidePickup: true}
+
+	steps := []struct {
+		name    string
+		release bool
+		rideID  string
+		want    bool
+	}{
+		{name: "first claim", rideID: "ride", want: true},
+		{name: "second claim", rideID: "ride", want: false},
+		{name: "other ride", rideID: "other", want: false},
+		{name: "claim after release", release: true, rideID: "ride", want: true},
+	}
+	for _, step := range steps {
+		if step.release {
+			releaseGeofenceTransition("chair", "ride", geofencePickup)
+		}
+		if got := claimGeofenceTransition("chair", step.rideID, geofencePickup); got != step.want {
+			t.Errorf("%s: claimGeofenceTransition = %v, want %v", step.name, got, step.want)
+		}
+	}
+	if claimGeofenceTransition("chair", "ride", geofenceDestination) {
+		t.Error("claimed the destination transition outside the destination fence")
+	}
+}
@@ -0,0 +1,197 @@
+package main
+
+import (
+	"context"
+	"sync"
+	"time"
+
+	"github.com/jmoiron/sqlx"
+)
+
+// ライドごとの実際の走行距離と各ステータスでかかった時間
+// 座標の更新とステータスの変更のたびにメモリ上で加算し、椅子の位置と一緒に DB へ書き戻す
+// キャッシュには走行中のライドだけを持ち、終わったライドは DB から読む
+
+// 迎車の走行距離 1 あたりに、売上に上乗せしてオーナーへ支払う額
+// 料金体系で決める値なので ISUCON_PICKUP_PAYOUT_PER_DISTANCE で与える。未設定なら 0 で、売上だけを支払う
+var pickupPayoutPerDistance = 0
+
+var rideMetricsCacheMutex = sync.Mutex{}
+var rideMetricsCache map[string]*RideMetrics = make(map[string]*RideMetrics)
+
+func loadRideMetricsCache() error {
+	rideMetricsCacheMutex.Lock()
+	defer rideMetricsCacheMutex.Unlock()
+
+	metrics := []*RideMetrics{}
+	if err := db.Select(&metrics, "SELECT * FROM ride_metrics WHERE ride_id NOT IN (SELECT ride_id FROM ride_statuses WHERE status = 'COMPLETED')"); err != nil {
+		return err
+	}
+
+	rideMetricsCache = make(map[string]*RideMetrics)
+	for _, m := range metrics {
+		rideMetricsCache[m.RideID] = m
+	}
+	return nil
+}
+
+func resetRideMetrics() {
+	rideMetricsCacheMutex.Lock()
+	defer rideMetricsCacheMutex.Unlock()
+
+	rideMetricsCache = make(map[string]*RideMetrics)
+}
+
+func getOrCreateRideMetrics(rideID string) *RideMetrics {
+	m, ok := rideMetricsCache[rideID]
+	if !ok {
+		m = &RideMetrics{RideID: rideID}
+		rideMetricsCache[rideID] = m
+	}
+	return m
+}
+
+// addRideDrivenDistance は椅子が動いたときのステータスに応じて距離を加算する
+func addRideDrivenDistance(rideID, status string, distance int) {
+	if distance == 0 || (status != "ENROUTE" && status != "CARRYING") {
+		return
+	}
+
+	rideMetricsCacheMutex.Lock()
+	defer rideMetricsCacheMutex.Unlock()
+
+	m := getOrCreateRideMetrics(rideID)
+	switch status {
+	case "ENROUTE":
+		m.EnrouteDistance += distance
+	case "CARRYING":
+		m.CarryingDistance += distance
+	}
+	m.isDirty = true
+}
+
+// addRideStatusDuration はステータスが変わったときに、直前のステータスにいた時間を加算する
+func addRideStatusDuration(rideID, status string, duration time.Duration) {
+	rideMetricsCacheMutex.Lock()
+	defer rideMetricsCacheMutex.Unlock()
+
+	m := getOrCreateRideMetrics(rideID)
+	ms := duration.Milliseconds()
+	switch status {
+	case "MATCHING":
+		m.MatchingMs += ms
+	case "ENROUTE":
+		m.EnrouteMs += ms
+	case "PICKUP":
+		m.PickupMs += ms
+	case "CARRYING":
+		m.CarryingMs += ms
+	case "ARRIVED":
+		m.ArrivedMs += ms
+		// ARRIVED の次は COMPLETED で、それ以上は加算しない
+		m.isCompleted = true
+	default:
+		return
+	}
+	m.isDirty = true
+}
+
+// getRideMetrics はライドの計測値を返す。キャッシュに無いライドはまとめて DB から読む
+func getRideMetrics(ctx context.Context, rideIDs []string) (map[string]RideMetrics, error) {
+	result := make(map[string]RideMetrics, len(rideIDs))
+	missing := []string{}
+
+	rideMetricsCacheMutex.Lock()
+	for _, rideID := range rideIDs {
+		if m, ok := rideMetricsCache[rideID]; ok {
+			result[rideID] = *m
+		} else {
+			missing = append(missing, rideID)
+		}
+	}
+	rideMetricsCacheMutex.Unlock()
+
+	if len(missing) == 0 {
+		return result, nil
+	}
+	query, args, err := sqlx.In("SELECT * FROM ride_metrics WHERE ride_id IN (?)", missing)
+	if err != nil {
+		return nil, err
+	}
+	metrics := []RideMetrics{}
+	if err := db.SelectContext(ctx, &metrics, db.Rebind(query), args...); err != nil {
+		return nil, err
+	}
+	for _, m := range metrics {
+		result[m.RideID] = m
+	}
+	return result, nil
+}
+
+func flushRideMetrics(ctx context.Context) error {
+	rideMetricsCacheMutex.Lock()
+	metrics := []RideMetrics{}
+	for _, m := range rideMetricsCache {
+		if m.isDirty {
+			metrics = append(metrics, *m)
+			m.isDirty = false
+		}
+	}
+	rideMetricsCacheMutex.Unlock()
+
+	for start := 0; start < len(metrics); start += chairLocationFlushBatchSize {
+		end := min(start+chairLocationFlushBatchSize, len(metrics))
+		if _, err := db.NamedExecContext(
+			ctx,
+			`INSERT INTO ride_metrics (ride_id, enroute_distance, carrying_distance, matching_ms, enroute_ms, pickup_ms, carrying_ms, arrived_ms)
+			VALUES (:ride_id, :enroute_distance, :carrying_distance, :matching_ms, :enroute_ms, :pickup_ms, :carrying_ms, :arrived_ms)
+			ON DUPLICATE KEY UPDATE
+				enroute_distance = VALUES(enroute_distance), carrying_distance = VALUES(carrying_distance),
+				matching_ms = VALUES(matching_ms), enroute_ms = VALUES(enroute_ms), pickup_ms = VALUES(pickup_ms),
+				carrying_ms = VALUES(carrying_ms), arrived_ms = VALUES(arrived_ms)`,
+			metrics[start:end],
+		); err != nil {
+			// キャッシュには最新の値があるので、印を付け直せば次の周期で書かれる
+			rideMetricsCacheMutex.Lock()
+			for _, m := range metrics[start:] {
+				if cached, ok := rideMetricsCache[m.RideID]; ok {
+					cached.isDirty = true
+				}
+			}
+			rideMetricsCacheMutex.Unlock()
+			return err
+		}
+	}
+
+	// 終わったライドは書き戻せたらキャッシュから外す
+	rideMetricsCacheMutex.Lock()
+	for _, m := range metrics {
+		if cached, ok := rideMetricsCache[m.RideID]; ok && cached.isCompleted && !cached.isDirty {
+			delete(rideMetricsCache, m.RideID)
+		}
+	}
+	rideMetricsCacheMutex.Unlock()
+	return nil
+}
+
+type rideMetricsResponse struct {
+	DrivenDistance    int              `json:"driven_distance"`
+	EnrouteDistance   int              `json:"enroute_distance"`
+	CarryingDistance  int              `json:"carrying_distance"`
+	StatusDurationsMs map[string]int64 `json:"status_durations_ms"`
+}
+
+func (m *RideMetrics) response() *rideMetricsResponse {
+	return &rideMetricsResponse{
+		DrivenDistance:   m.EnrouteDistance + m.CarryingDistance,
+		EnrouteDistance:  m.EnrouteDistance,
+		CarryingDistance: m.CarryingDistance,
+		StatusDurationsMs: map[string]int64{
+			"MATCHING": m.MatchingMs,
+			"ENROUTE":  m.EnrouteMs,
+			"PICKUP":   m.PickupMs,
+			"CARRYING": m.CarryingMs,
+			"ARRIVED":  m.ArrivedMs,
+		},
+	}
+}
@@ -0,0 +1,24 @@
+package main
+
+import (
+	"fmt"
+	"testing"
+	"time"
+)
+
+func TestRideStatusSentAtPendingAdd(t *testing.T) {
+	p := newRideStatusSentAtPending("app_sent_at")
+	first := time.Now()
+	p.add("status", first)
+	p.add("status", first.Add(time.Second))
+	if got := p.sentAt["status"]; !got.Equal(first) {
+		t.Errorf("sentAt = %v, want the first time %v", got, first)
+	}
+
+	for i := len(p.sentAt); i < rideStatusSentAtPendingLimit+10; i++ {
+		p.add(fmt.Sprint(i), first)
+	}
+	if len(p.sentAt) != rideStatusSentAtPendingLimit {
+		t.Errorf("len(sentAt) = %d, want %d", len(p.sentAt), rideStatusSentAtPendingLimit)
+	}
+}
@@ -0,0 +1,118 @@
+package main
+
+import (
+	"context"
+	"log/slog"
+	"net/http"
+	"sync"
+	"time"
+)
+
+// SIGTERM を受けてから非同期の処理を書き切るまでの上限。systemd の TimeoutStopSec より短くする
+const shutdownTimeout = 20 * time.Second
+
+// サーバーの停止を始めたら close する。SSE や WebSocket の接続はこれを見て再接続を促して閉じる
+var serverShutdownCh = make(chan struct{})
+var serverShutdownOnce = sync.Once{}
+
+func beginShutdown() {
+	serverShutdownOnce.Do(func() {
+		close(serverShutdownCh)
+	})
+}
+
+func isShuttingDown() bool {
+	select {
+	case <-serverShutdownCh:
+		return true
+	default:
+		return false
+	}
+}
+
+// withShutdown はサーバーの停止時にもキャンセルされるコンテキストを返す
+func withShutdown(parent context.Context) (context.Context, context.CancelFunc) {
+	ctx, cancel := context.WithCancel(parent)
+	go func() {
+		select {
+		case <-serverShutdownCh:
+			cancel()
+		case <-ctx.Done():
+		}
+	}()
+	return ctx, cancel
+}
+
+// asyncWorker は停止の指示を受けたら、残っている仕事を片付けてから終わるゴルーチン
+type asyncWorker struct {
+	stop chan struct{}
+	done chan struct{}
+}
+
+func newAsyncWorker() *asyncWorker {
+	return &asyncWorker{
+		stop: make(chan struct{}),
+		done: make(chan struct{}),
+	}
+}
+
+func (w *asyncWorker) shutdown(ctx context.Context) error {
+	if w == nil {
+		return nil
+	}
+	close(w.stop)
+	select {
+	case <-w.done:
+		return nil
+	case <-ctx.Done():
+		return ctx.Err()
+	}
+}
+
+// gracefulShutdown は新しいリクエストを止め、非同期の処理を書き切ってから戻る
+// 後の段階は前の段階が積んだ仕事を処理するので順番に止める
+func gracefulShutdown(ctx context.Context, server *http.Server) {
+	slog.Info("shutting down")
+
+	if err := matchingWorker.shutdown(ctx); err != nil {
+		slog.Error("failed to stop matching", "error", err)
+	}
+	if err := chairScheduler.shutdown(ctx); err != nil {
+		slog.Error("failed to stop chair scheduler", "error", err)
+	}
+	if err := notificationStreamSweeper.shutdown(ctx); err != nil {
+		slog.Error("failed to stop notification stream sweeper", "error", err)
+	}
+	if err := webhookRetryPoller.shutdown(ctx); err != nil {
+		slog.Error("failed to stop webhook retry poller", "error", err)
+	}
+
+	// RegisterOnShutdown で beginShutdown が呼ばれ、通知の接続が閉じられる
+	if err := server.Shutdown(ctx); err != nil {
+		slog.Error("failed to shut down http server", "error", err)
+	}
+	beginShutdown()
+
+	if err := notificationBusInstance.stopReceiving(ctx); err != nil {
+		slog.Error("failed to stop notification bus poller", "error", err)
+	}
+	if err := chairPostRideStatusSyncer.shutdown(ctx); err != nil {
+		slog.Error("failed to drain ride status updates", "error", err)
+	}
+	if err := rideStatusSentAtSyncer.shutdown(ctx); err != nil {
+		slog.Error("failed to drain ride status sent at", "error", err)
+	}
+	// ここまでに予約された Webhook を送るか、送れなかった分を記録する
+	if err := webhookDeliveryWorker.shutdown(ctx); err != nil {
+		slog.Error("failed to drain webhook deliveries", "error", err)
+	}
+	// ライドのステータスと送信済みの印の処理が積んだ通知を他のノードに送り切る
+	if err := notificationBusInstance.shutdown(ctx); err != nil {
+		slog.Error("failed to flush notification bus", "error", err)
+	}
+	if err := shutdownChairLocationWriter(ctx); err != nil {
+		slog.Error("failed to flush chair locations", "error", err)
+	}
+
+	slog.Info("shut down")
+}
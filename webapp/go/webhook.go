@@ -0,0 +1,530 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"crypto/hmac"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"log/slog"
+	"net"
+	"net/http"
+	"net/url"
+	"strconv"
+	"strings"
+	"sync"
+	"syscall"
+	"time"
+
+	"github.com/oklog/ulid/v2"
+)
+
+const (
+	webhookEventRideMatched      = "ride.matched"
+	webhookEventRideCompleted    = "ride.completed"
+	webhookEventRideEvaluated    = "ride.evaluated"
+	webhookEventChairDeactivated = "chair.deactivated"
+)
+
+const (
+	webhookDeliveryStatusPending   = "PENDING"
+	webhookDeliveryStatusSucceeded = "SUCCEEDED"
+	webhookDeliveryStatusFailed    = "FAILED"
+)
+
+// 失敗したら 1秒, 2秒, 4秒, 8秒 と間隔を空けて再送し、それでも失敗したら諦める
+// 再送は webhook_deliveries の next_attempt_at を見て行うので、再起動しても続きから送る
+const webhookMaxAttempts = 5
+const webhookRetryBaseInterval = 1 * time.Second
+
+const webhookWorkerCount = 4
+
+// 再送する配信を探す間隔と、1回に取り出す件数
+const webhookRetryPollInterval = 1 * time.Second
+const webhookRetryBatchSize = 100
+
+// 再送のために取り出した配信は、この時間が経つまで他のノードや次の周期では取り出さない
+const webhookRetryClaimTimeout = 1 * time.Minute
+
+const webhookTimeout = 5 * time.Second
+
+var errWebhookURLNotAllowed = errors.New("url must not point to a loopback, private or link-local address")
+
+// 内部のアドレスでも送ってよいネットワーク。ISUCON_WEBHOOK_ALLOWED_NETWORKS に CIDR をカンマ区切りで与える
+// 手元に受け口を立てて試すときなどに使う
+var webhookAllowedNetworks []*net.IPNet
+
+func parseWebhookAllowedNetworks(s string) ([]*net.IPNet, error) {
+	networks := []*net.IPNet{}
+	for _, cidr := range strings.Split(s, ",") {
+		_, network, err := net.ParseCIDR(strings.TrimSpace(cidr))
+		if err != nil {
+			return nil, err
+		}
+		networks = append(networks, network)
+	}
+	return networks, nil
+}
+
+// 登録後に名前解決の結果が変わっても内部のアドレスには送らないよう、接続するときにも確かめる
+var webhookHTTPClient = &http.Client{
+	Timeout: webhookTimeout,
+	Transport: &http.Transport{
+		DialContext: (&net.Dialer{
+			Timeout: webhookTimeout,
+			Control: func(network, address string, _ syscall.RawConn) error {
+				host, _, err := net.SplitHostPort(address)
+				if err != nil {
+					return err
+				}
+				if ip := net.ParseIP(host); ip == nil || !isWebhookIPAllowed(ip) {
+					return errWebhookURLNotAllowed
+				}
+				return nil
+			},
+		}).DialContext,
+	},
+}
+
+func isWebhookIPAllowed(ip net.IP) bool {
+	for _, network := range webhookAllowedNetworks {
+		if network.Contains(ip) {
+			return true
+		}
+	}
+	return !ip.IsLoopback() && !ip.IsPrivate() && !ip.IsLinkLocalUnicast() && !ip.IsLinkLocalMulticast() &&
+		!ip.IsInterfaceLocalMulticast() && !ip.IsMulticast() && !ip.IsUnspecified()
+}
+
+// validateWebhookURL は http(s) の絶対 URL で、ホストが外部のアドレスだけに解決されることを確かめる
+func validateWebhookURL(ctx context.Context, rawURL string) error {
+	u, err := url.Parse(rawURL)
+	if err != nil || (u.Scheme != "http" && u.Scheme != "https") || u.Hostname() == "" {
+		return errors.New("url must be an absolute http or https URL")
+	}
+
+	host := u.Hostname()
+	if ip := net.ParseIP(host); ip != nil {
+		if !isWebhookIPAllowed(ip) {
+			return errWebhookURLNotAllowed
+		}
+		return nil
+	}
+	addrs, err := net.DefaultResolver.LookupIPAddr(ctx, host)
+	if err != nil || len(addrs) == 0 {
+		return fmt.Errorf("url host %s could not be resolved", host)
+	}
+	for _, addr := range addrs {
+		if !isWebhookIPAllowed(addr.IP) {
+			return errWebhookURLNotAllowed
+		}
+	}
+	return nil
+}
+
+// webhookDeliveryStore は配信履歴の保存先。テストではメモリ上の実装に差し替える
+type webhookDeliveryStore interface {
+	// record は配信を追加するか、同じ ID の配信の状態を更新する
+	record(ctx context.Context, delivery *WebhookDelivery) error
+	// listByWebhook は新しい順に最大 limit 件を返す
+	listByWebhook(ctx context.Context, webhookID string, limit int) ([]WebhookDelivery, error)
+}
+
+var webhookDeliveries webhookDeliveryStore = &mysqlWebhookDeliveryStore{}
+
+type mysqlWebhookDeliveryStore struct{}
+
+func (s *mysqlWebhookDeliveryStore) record(ctx context.Context, delivery *WebhookDelivery) error {
+	_, err := db.NamedExecContext(
+		ctx,
+		`INSERT INTO webhook_deliveries (id, webhook_id, event_type, payload, status, attempts, last_status_code, last_error, next_attempt_at, created_at, updated_at)
+		VALUES (:id, :webhook_id, :event_type, :payload, :status, :attempts, :last_status_code, :last_error, :next_attempt_at, :created_at, :updated_at)
+		ON DUPLICATE KEY UPDATE status = VALUES(status), attempts = VALUES(attempts), last_status_code = VALUES(last_status_code), last_error = VALUES(last_error),
+			next_attempt_at = VALUES(next_attempt_at), updated_at = VALUES(updated_at)`,
+		delivery,
+	)
+	return err
+}
+
+func (s *mysqlWebhookDeliveryStore) listByWebhook(ctx context.Context, webhookID string, limit int) ([]WebhookDelivery, error) {
+	deliveries := []WebhookDelivery{}
+	if err := db.SelectContext(ctx, &deliveries, "SELECT * FROM webhook_deliveries WHERE webhook_id = ? ORDER BY created_at DESC LIMIT ?", webhookID, limit); err != nil {
+		return nil, err
+	}
+	return deliveries, nil
+}
+
+var ownerWebhookCacheRWMutex = sync.RWMutex{}
+var ownerIdToWebhooksCache map[string][]*OwnerWebhook = make(map[string][]*OwnerWebhook)
+
+func loadOwnerWebhookCache() error {
+	ownerWebhookCacheRWMutex.Lock()
+	defer ownerWebhookCacheRWMutex.Unlock()
+
+	webhooks := []*OwnerWebhook{}
+	if err := db.Select(&webhooks, "SELECT * FROM owner_webhooks ORDER BY created_at"); err != nil {
+		return err
+	}
+
+	ownerIdToWebhooksCache = make(map[string][]*OwnerWebhook)
+	for _, webhook := range webhooks {
+		ownerIdToWebhooksCache[webhook.OwnerID] = append(ownerIdToWebhooksCache[webhook.OwnerID], webhook)
+	}
+	return nil
+}
+
+func insertOwnerWebhookCache(webhook OwnerWebhook) {
+	ownerWebhookCacheRWMutex.Lock()
+	defer ownerWebhookCacheRWMutex.Unlock()
+
+	ownerIdToWebhooksCache[webhook.OwnerID] = append(ownerIdToWebhooksCache[webhook.OwnerID], &webhook)
+}
+
+func deleteOwnerWebhookCache(ownerID, webhookID string) {
+	ownerWebhookCacheRWMutex.Lock()
+	defer ownerWebhookCacheRWMutex.Unlock()
+
+	webhooks := []*OwnerWebhook{}
+	for _, webhook := range ownerIdToWebhooksCache[ownerID] {
+		if webhook.ID != webhookID {
+			webhooks = append(webhooks, webhook)
+		}
+	}
+	ownerIdToWebhooksCache[ownerID] = webhooks
+}
+
+func getOwnerWebhookByIDFromCache(webhookID string) (OwnerWebhook, bool) {
+	ownerWebhookCacheRWMutex.RLock()
+	defer ownerWebhookCacheRWMutex.RUnlock()
+
+	for _, webhooks := range ownerIdToWebhooksCache {
+		for _, webhook := range webhooks {
+			if webhook.ID == webhookID {
+				return *webhook, true
+			}
+		}
+	}
+	return OwnerWebhook{}, false
+}
+
+func getOwnerWebhooksFromCache(ownerID string) []OwnerWebhook {
+	ownerWebhookCacheRWMutex.RLock()
+	defer ownerWebhookCacheRWMutex.RUnlock()
+
+	webhooks := make([]OwnerWebhook, 0, len(ownerIdToWebhooksCache[ownerID]))
+	for _, webhook := range ownerIdToWebhooksCache[ownerID] {
+		webhooks = append(webhooks, *webhook)
+	}
+	return webhooks
+}
+
+type webhookEvent struct {
+	ID        string      `json:"id"`
+	Type      string      `json:"type"`
+	CreatedAt int64       `json:"created_at"`
+	Data      interface{} `json:"data"`
+}
+
+type webhookRideData struct {
+	RideID                string     `json:"ride_id"`
+	ChairID               string     `json:"chair_id"`
+	PickupCoordinate      Coordinate `json:"pickup_coordinate"`
+	DestinationCoordinate Coordinate `json:"destination_coordinate"`
+	Sales                 *int       `json:"sales,omitempty"`
+	Evaluation            *int       `json:"evaluation,omitempty"`
+}
+
+type webhookChairData struct {
+	ChairID string `json:"chair_id"`
+	Name    string `json:"name"`
+	Model   string `json:"model"`
+}
+
+type webhookDeliveryJob struct {
+	webhook  OwnerWebhook
+	delivery WebhookDelivery
+}
+
+var webhookDeliveryChan = make(chan *webhookDeliveryJob, 1000)
+
+// publishOwnerWebhookEvent はオーナーが登録した全ての Webhook に配信を予約する。送信と記録は別の goroutine で行う
+func publishOwnerWebhookEvent(ownerID, eventType string, data interface{}) {
+	webhooks := getOwnerWebhooksFromCache(ownerID)
+	if len(webhooks) == 0 {
+		return
+	}
+
+	now := time.Now().Truncate(time.Microsecond)
+	for _, webhook := range webhooks {
+		deliveryID := ulid.Make().String()
+		payload, err := json.Marshal(&webhookEvent{
+			ID:        deliveryID,
+			Type:      eventType,
+			CreatedAt: now.UnixMilli(),
+			Data:      data,
+		})
+		if err != nil {
+			slog.Error("failed to marshal webhook event", "error", err)
+			return
+		}
+
+		job := &webhookDeliveryJob{
+			webhook: webhook,
+			delivery: WebhookDelivery{
+				ID:        deliveryID,
+				WebhookID: webhook.ID,
+				EventType: eventType,
+				Payload:   string(payload),
+				Status:    webhookDeliveryStatusPending,
+				CreatedAt: now,
+				UpdatedAt: now,
+			},
+		}
+		select {
+		case webhookDeliveryChan <- job:
+		default:
+			slog.Error("webhook delivery queue is full", "webhook", webhook.ID, "event", eventType)
+		}
+	}
+}
+
+// publishRideWebhookEvent は椅子のオーナーにライドのイベントを送る
+func publishRideWebhookEvent(eventType string, ride *Ride, sales *int, evaluation *int) {
+	if !ride.ChairID.Valid {
+		return
+	}
+	chair, err := getChairByID(ride.ChairID.String)
+	if err != nil {
+		return
+	}
+	publishOwnerWebhookEvent(chair.OwnerID, eventType, &webhookRideData{
+		RideID:  ride.ID,
+		ChairID: chair.ID,
+		PickupCoordinate: Coordinate{
+			Latitude:  ride.PickupLatitude,
+			Longitude: ride.PickupLongitude,
+		},
+		DestinationCoordinate: Coordinate{
+			Latitude:  ride.DestinationLatitude,
+			Longitude: ride.DestinationLongitude,
+		},
+		Sales:      sales,
+		Evaluation: evaluation,
+	})
+}
+
+// publishRideStatusWebhookEvent は Webhook で知らせるステータスだけを送る
+func publishRideStatusWebhookEvent(rideID, status string) {
+	if status != "COMPLETED" {
+		return
+	}
+	ride, found := getRideByIDFromCache(rideID)
+	if !found {
+		return
+	}
+	sales := calculateSale(*ride)
+	publishRideWebhookEvent(webhookEventRideCompleted, ride, &sales, nil)
+}
+
+var webhookDeliveryWorker *asyncWorker
+
+func launchWebhookDeliveryWorkers() {
+	worker := newAsyncWorker()
+	webhookDeliveryWorker = worker
+
+	wg := sync.WaitGroup{}
+	for i := 0; i < webhookWorkerCount; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			for {
+				select {
+				case job := <-webhookDeliveryChan:
+					deliverWebhook(job)
+				case <-worker.stop:
+					return
+				}
+			}
+		}()
+	}
+
+	go func() {
+		defer close(worker.done)
+		wg.Wait()
+		// 停止時にキューに残っている配信は送らずに PENDING として記録し、再起動後や他のノードで送る
+		for {
+			select {
+			case job := <-webhookDeliveryChan:
+				now := time.Now().Truncate(time.Microsecond)
+				job.delivery.Status = webhookDeliveryStatusPending
+				job.delivery.NextAttemptAt = &now
+				job.delivery.UpdatedAt = now
+				if err := webhookDeliveries.record(context.Background(), &job.delivery); err != nil {
+					slog.Error("failed to record webhook delivery", "error", err)
+				}
+			default:
+				return
+			}
+		}
+	}()
+}
+
+// signWebhookPayload は "タイムスタンプ.本文" の HMAC-SHA256 を返す
+// 受信側はタイムスタンプも検証することで再送攻撃を防げる
+func signWebhookPayload(secret string, timestamp int64, payload []byte) string {
+	mac := hmac.New(sha256.New, []byte(secret))
+	mac.Write([]byte(strconv.FormatInt(timestamp, 10)))
+	mac.Write([]byte("."))
+	mac.Write(payload)
+	return "sha256=" + hex.EncodeToString(mac.Sum(nil))
+}
+
+func deliverWebhook(job *webhookDeliveryJob) {
+	ctx := context.Background()
+	delivery := &job.delivery
+	delivery.Attempts++
+
+	// 送信中に落ちても配信が失われないよう、先に PENDING として記録する
+	// next_attempt_at は再送のときと同じく webhookRetryClaimTimeout 後にしておき、結果を記録できなければその時刻に再送する
+	now := time.Now().Truncate(time.Microsecond)
+	claimedUntil := now.Add(webhookRetryClaimTimeout)
+	delivery.Status = webhookDeliveryStatusPending
+	delivery.NextAttemptAt = &claimedUntil
+	delivery.UpdatedAt = now
+	if err := webhookDeliveries.record(ctx, delivery); err != nil {
+		slog.Error("failed to record webhook delivery", "error", err)
+	}
+
+	statusCode, err := sendWebhook(&job.webhook, delivery)
+	delivery.LastStatusCode = nil
+	delivery.LastError = nil
+	delivery.NextAttemptAt = nil
+	if statusCode != 0 {
+		delivery.LastStatusCode = &statusCode
+	}
+	switch {
+	case err == nil:
+		delivery.Status = webhookDeliveryStatusSucceeded
+	case delivery.Attempts >= webhookMaxAttempts:
+		message := err.Error()
+		delivery.LastError = &message
+		delivery.Status = webhookDeliveryStatusFailed
+	default:
+		message := err.Error()
+		delivery.LastError = &message
+		delivery.Status = webhookDeliveryStatusPending
+		nextAttemptAt := time.Now().Add(webhookRetryBaseInterval << (delivery.Attempts - 1)).Truncate(time.Microsecond)
+		delivery.NextAttemptAt = &nextAttemptAt
+	}
+	delivery.UpdatedAt = time.Now().Truncate(time.Microsecond)
+
+	if err := webhookDeliveries.record(ctx, delivery); err != nil {
+		slog.Error("failed to record webhook delivery", "error", err)
+	}
+}
+
+var webhookRetryPoller *asyncWorker
+
+// launchWebhookRetryPoller は next_attempt_at を過ぎた PENDING の配信をワーカーに渡す
+func launchWebhookRetryPoller() {
+	worker := newAsyncWorker()
+	webhookRetryPoller = worker
+
+	go func() {
+		defer close(worker.done)
+		ticker := time.NewTicker(webhookRetryPollInterval)
+		defer ticker.Stop()
+		for {
+			select {
+			case <-ticker.C:
+				if err := enqueueWebhookRetries(context.Background(), time.Now()); err != nil {
+					slog.Error("failed to enqueue webhook retries", "error", err)
+				}
+			case <-worker.stop:
+				return
+			}
+		}
+	}()
+}
+
+func enqueueWebhookRetries(ctx context.Context, now time.Time) error {
+	deliveries := []WebhookDelivery{}
+	if err := db.SelectContext(
+		ctx,
+		&deliveries,
+		"SELECT * FROM webhook_deliveries WHERE status = ? AND next_attempt_at <= ? ORDER BY next_attempt_at LIMIT ?",
+		webhookDeliveryStatusPending, now, webhookRetryBatchSize,
+	); err != nil {
+		return err
+	}
+
+	for _, delivery := range deliveries {
+		// 取り出した配信の next_attempt_at を先に延ばし、同じ配信を二重に送らないようにする
+		// ワーカーが記録する前に落ちても、延ばした時刻が来ればまた取り出される
+		claimedUntil := now.Add(webhookRetryClaimTimeout).Truncate(time.Microsecond)
+		result, err := db.ExecContext(
+			ctx,
+			"UPDATE webhook_deliveries SET next_attempt_at = ? WHERE id = ? AND status = ? AND next_attempt_at = ?",
+			claimedUntil, delivery.ID, webhookDeliveryStatusPending, delivery.NextAttemptAt,
+		)
+		if err != nil {
+			return err
+		}
+		if count, err := result.RowsAffected(); err != nil {
+			return err
+		} else if count == 0 {
+			continue
+		}
+
+		webhook, ok := getOwnerWebhookByIDFromCache(delivery.WebhookID)
+		if !ok {
+			if _, err := db.ExecContext(
+				ctx,
+				"UPDATE webhook_deliveries SET status = ?, last_error = ?, next_attempt_at = NULL WHERE id = ?",
+				webhookDeliveryStatusFailed, "webhook was deleted", delivery.ID,
+			); err != nil {
+				return err
+			}
+			continue
+		}
+
+		select {
+		case webhookDeliveryChan <- &webhookDeliveryJob{webhook: webhook, delivery: delivery}:
+		default:
+			slog.Error("webhook delivery queue is full", "webhook", webhook.ID, "delivery", delivery.ID)
+		}
+	}
+	return nil
+}
+
+// sendWebhook は 2xx 以外をエラーとして扱う
+func sendWebhook(webhook *OwnerWebhook, delivery *WebhookDelivery) (int, error) {
+	payload := []byte(delivery.Payload)
+	timestamp := time.Now().Unix()
+
+	req, err := http.NewRequestWithContext(context.Background(), http.MethodPost, webhook.URL, bytes.NewReader(payload))
+	if err != nil {
+		return 0, err
+	}
+	req.Header.Set("Content-Type", "application/json")
+	req.Header.Set("X-Isuride-Event", delivery.EventType)
+	req.Header.Set("X-Isuride-Delivery", delivery.ID)
+	req.Header.Set("X-Isuride-Timestamp", strconv.FormatInt(timestamp, 10))
+	req.Header.Set("X-Isuride-Signature", signWebhookPayload(webhook.Secret, timestamp, payload))
+
+	res, err := webhookHTTPClient.Do(req)
+	if err != nil {
+		return 0, err
+	}
+	defer res.Body.Close()
+	io.Copy(io.Discard, res.Body)
+
+	if res.StatusCode < 200 || res.StatusCode >= 300 {
+		return res.StatusCode, fmt.Errorf("webhook responded with status %d", res.StatusCode)
+	}
+	return res.StatusCode, nil
+}
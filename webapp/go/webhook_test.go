@@ -0,0 +1,281 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"io"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"sort"
+	"strconv"
+	"sync"
+	"testing"
+	"time"
+)
+
+// memoryWebhookDeliveryStore は記録された配信をメモリ上に持つ
+type memoryWebhookDeliveryStore struct {
+	mu         sync.Mutex
+	deliveries map[string]WebhookDelivery
+	// 記録された状態を順に残す
+	history []WebhookDelivery
+}
+
+func newMemoryWebhookDeliveryStore() *memoryWebhookDeliveryStore {
+	return &memoryWebhookDeliveryStore{deliveries: make(map[string]WebhookDelivery)}
+}
+
+func (s *memoryWebhookDeliveryStore) record(ctx context.Context, delivery *WebhookDelivery) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	s.deliveries[delivery.ID] = *delivery
+	s.history = append(s.history, *delivery)
+	return nil
+}
+
+func (s *memoryWebhookDeliveryStore) listByWebhook(ctx context.Context, webhookID string, limit int) ([]WebhookDelivery, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	deliveries := []WebhookDelivery{}
+	for _, delivery := range s.deliveries {
+		if delivery.WebhookID == webhookID {
+			deliveries = append(deliveries, delivery)
+		}
+	}
+	sort.Slice(deliveries, func(i, j int) bool { return deliveries[i].CreatedAt.After(deliveries[j].CreatedAt) })
+	return deliveries[:min(limit, len(deliveries))], nil
+}
+
+func (s *memoryWebhookDeliveryStore) get(id string) (WebhookDelivery, bool) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	delivery, ok := s.deliveries[id]
+	return delivery, ok
+}
+
+// useTestWebhookEnvironment は httptest のサーバーに送れるようにし、配信履歴をメモリ上に記録する
+func useTestWebhookEnvironment(t *testing.T) *memoryWebhookDeliveryStore {
+	t.Helper()
+	_, loopback, _ := net.ParseCIDR("127.0.0.0/8")
+	savedNetworks, savedStore := webhookAllowedNetworks, webhookDeliveries
+	store := newMemoryWebhookDeliveryStore()
+	webhookAllowedNetworks = []*net.IPNet{loopback}
+	webhookDeliveries = store
+	t.Cleanup(func() {
+		webhookAllowedNetworks, webhookDeliveries = savedNetworks, savedStore
+	})
+	return store
+}
+
+func newTestWebhookJob(url string, attempts int) *webhookDeliveryJob {
+	now := time.Now().Truncate(time.Microsecond)
+	return &webhookDeliveryJob{
+		webhook: OwnerWebhook{ID: "webhook", OwnerID: "owner", URL: url, Secret: "secret"},
+		delivery: WebhookDelivery{
+			ID:        "delivery",
+			WebhookID: "webhook",
+			EventType: webhookEventRideCompleted,
+			Payload:   `{"type":"ride.completed"}`,
+			Status:    webhookDeliveryStatusPending,
+			Attempts:  attempts,
+			CreatedAt: now,
+			UpdatedAt: now,
+		},
+	}
+}
+
+func TestValidateWebhookURL(t *testing.T) {
+	savedNetworks := webhookAllowedNetworks
+	t.Cleanup(func() { webhookAllowedNetworks = savedNetworks })
+
+	tests := []struct {
+		name     string
+		url      string
+		networks string
+		wantErr  bool
+	}{
+		{name: "public address", url: "https://93.184.216.34/hook"},
+		{name: "loopback", url: "http://127.0.0.1:8080/hook", wantErr: true},
+		{name: "private", url: "http://10.0.0.1/hook", wantErr: true},
+		{name: "link local", url: "http://169.254.169.254/latest", wantErr: true},
+		{name: "allowed loopback", url: "http://127.0.0.1:8080/hook", networks: "127.0.0.0/8"},
+		{name: "outside the allowed network", url: "http://10.0.0.1/hook", networks: "127.0.0.0/8", wantErr: true},
+		{name: "not http", url: "ftp://93.184.216.34/hook", wantErr: true},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			webhookAllowedNetworks = nil
+			if tt.networks != "" {
+				networks, err := parseWebhookAllowedNetworks(tt.networks)
+				if err != nil {
+					t.Fatal(err)
+				}
+				webhookAllowedNetworks = networks
+			}
+			if err := validateWebhookURL(context.Background(), tt.url); (err != nil) != tt.wantErr {
+				t.Errorf("validateWebhookURL(%s) error = %v, wantErr %v", tt.url, err, tt.wantErr)
+			}
+		})
+	}
+}
+
+func TestDeliverWebhookSignature(t *testing.T) {
+	store := useTestWebhookEnvironment(t)
+
+	var header http.Header
+	var body []byte
+	var recordedBeforeSend bool
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		header = r.Header.Clone()
+		body, _ = io.ReadAll(r.Body)
+		delivery, ok := store.get(r.Header.Get("X-Isuride-Delivery"))
+		recordedBeforeSend = ok && delivery.Status == webhookDeliveryStatusPending
+		w.WriteHeader(http.StatusNoContent)
+	}))
+	defer server.Close()
+
+	job := newTestWebhookJob(server.URL, 0)
+	deliverWebhook(job)
+
+	if !recordedBeforeSend {
+		t.Error("the delivery was not recorded as PENDING before sending")
+	}
+	if string(body) != job.delivery.Payload {
+		t.Errorf("body = %s, want %s", body, job.delivery.Payload)
+	}
+	timestamp, err := strconv.ParseInt(header.Get("X-Isuride-Timestamp"), 10, 64)
+	if err != nil {
+		t.Fatalf("invalid timestamp header: %v", err)
+	}
+	if got, want := header.Get("X-Isuride-Signature"), signWebhookPayload("secret", timestamp, body); got != want {
+		t.Errorf("signature = %s, want %s", got, want)
+	}
+	if got := header.Get("X-Isuride-Event"); got != webhookEventRideCompleted {
+		t.Errorf("event header = %s, want %s", got, webhookEventRideCompleted)
+	}
+
+	delivery, _ := store.get("delivery")
+	if delivery.Status != webhookDeliveryStatusSucceeded || delivery.Attempts != 1 || delivery.NextAttemptAt != nil {
+		t.Errorf("delivery = %+v, want SUCCEEDED after 1 attempt", delivery)
+	}
+}
+
+func TestDeliverWebhookRetry(t *testing.T) {
+	tests := []struct {
+		name            string
+		statusCode      int
+		attempts        int
+		wantStatus      string
+		wantNextAttempt time.Duration
+	}{
+		{name: "first failure", statusCode: http.StatusInternalServerError, attempts: 0, wantStatus: webhookDeliveryStatusPending, wantNextAttempt: webhookRetryBaseInterval},
+		{name: "backoff doubles", statusCode: http.StatusBadGateway, attempts: 2, wantStatus: webhookDeliveryStatusPending, wantNextAttempt: 4 * webhookRetryBaseInterval},
+		{name: "last attempt", statusCode: http.StatusInternalServerError, attempts: webhookMaxAttempts - 1, wantStatus: webhookDeliveryStatusFailed},
+		{name: "success on retry", statusCode: http.StatusOK, attempts: 3, wantStatus: webhookDeliveryStatusSucceeded},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			store := useTestWebhookEnvironment(t)
+			server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+				w.WriteHeader(tt.statusCode)
+			}))
+			defer server.Close()
+
+			before := time.Now()
+			deliverWebhook(newTestWebhookJob(server.URL, tt.attempts))
+
+			delivery, _ := store.get("delivery")
+			if delivery.Status != tt.wantStatus {
+				t.Errorf("status = %s, want %s", delivery.Status, tt.wantStatus)
+			}
+			if delivery.Attempts != tt.attempts+1 {
+				t.Errorf("attempts = %d, want %d", delivery.Attempts, tt.attempts+1)
+			}
+			if delivery.LastStatusCode == nil || *delivery.LastStatusCode != tt.statusCode {
+				t.Errorf("last_status_code = %v, want %d", delivery.LastStatusCode, tt.statusCode)
+			}
+			if tt.wantNextAttempt == 0 {
+				if delivery.NextAttemptAt != nil {
+					t.Errorf("next_attempt_at = %v, want nil", delivery.NextAttemptAt)
+				}
+				return
+			}
+			if delivery.NextAttemptAt == nil {
+				t.Fatal("next_attempt_at is nil")
+			}
+			if wait := delivery.NextAttemptAt.Sub(before); wait < tt.wantNextAttempt-time.Millisecond || wait > tt.wantNextAttempt+time.Second {
+				t.Errorf("next attempt in %v, want about %v", wait, tt.wantNextAttempt)
+			}
+		})
+	}
+}
+
+func TestOwnerGetWebhookDeliveries(t *testing.T) {
+	store := useTestWebhookEnvironment(t)
+	ownerWebhookCacheRWMutex.Lock()
+	savedCache := ownerIdToWebhooksCache
+	ownerIdToWebhooksCache = map[string][]*OwnerWebhook{
+		"owner": {{ID: "webhook", OwnerID: "owner"}},
+		"other": {{ID: "other-webhook", OwnerID: "other"}},
+	}
+	ownerWebhookCacheRWMutex.Unlock()
+	t.Cleanup(func() {
+		ownerWebhookCacheRWMutex.Lock()
+		ownerIdToWebhooksCache = savedCache
+		ownerWebhookCacheRWMutex.Unlock()
+	})
+
+	now := time.Now().Truncate(time.Millisecond)
+	for i, id := range []string{"old", "new"} {
+		store.record(context.Background(), &WebhookDelivery{
+			ID:        id,
+			WebhookID: "webhook",
+			EventType: webhookEventRideMatched,
+			Status:    webhookDeliveryStatusSucceeded,
+			Attempts:  1,
+			CreatedAt: now.Add(time.Duration(i) * time.Second),
+			UpdatedAt: now,
+		})
+	}
+
+	tests := []struct {
+		name       string
+		webhookID  string
+		wantStatus int
+		wantIDs    []string
+	}{
+		{name: "own webhook", webhookID: "webhook", wantStatus: http.StatusOK, wantIDs: []string{"new", "old"}},
+		{name: "another owner's webhook", webhookID: "other-webhook", wantStatus: http.StatusNotFound},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			req := httptest.NewRequest(http.MethodGet, "/api/owner/webhooks/"+tt.webhookID+"/deliveries", nil)
+			req.SetPathValue("webhook_id", tt.webhookID)
+			req = req.WithContext(context.WithValue(req.Context(), "owner", &Owner{ID: "owner"}))
+			rec := httptest.NewRecorder()
+			ownerGetWebhookDeliveries(rec, req)
+
+			if rec.Code != tt.wantStatus {
+				t.Fatalf("status = %d, want %d", rec.Code, tt.wantStatus)
+			}
+			if tt.wantStatus != http.StatusOK {
+				return
+			}
+			res := ownerGetWebhookDeliveriesResponse{}
+			if err := json.Unmarshal(rec.Body.Bytes(), &res); err != nil {
+				t.Fatal(err)
+			}
+			ids := []string{}
+			for _, delivery := range res.Deliveries {
+				ids = append(ids, delivery.ID)
+			}
+			if len(ids) != len(tt.wantIDs) || ids[0] != tt.wantIDs[0] || ids[1] != tt.wantIDs[1] {
+				t.Errorf("deliveries = %v, want %v", ids, tt.wantIDs)
+			}
+		})
+	}
+}
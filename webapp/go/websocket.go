@@ -0,0 +1,243 @@
+package main
+
+import (
+	"bufio"
+	"crypto/sha1"
+	"encoding/base64"
+	"encoding/binary"
+	"encoding/json"
+	"errors"
+	"io"
+	"net"
+	"net/http"
+	"strings"
+	"sync"
+	"time"
+)
+
+// RFC 6455 の最低限の実装。椅子の WebSocket 接続でしか使わないので拡張やサブプロトコルには対応しない
+
+const websocketGUID = "258EAFA5-E914-47DA-95CA-C5AB0DC85B11"
+
+// 椅子から届くのは座標程度なので大きなメッセージは受け付けない
+const websocketMaxMessageSize = 64 * 1024
+
+const websocketWriteTimeout = 10 * time.Second
+
+// サーバーは通知のハートビートの間隔で ping を送るので、その数回分何も届かなければ切れたとみなす
+const websocketReadTimeout = 3 * notificationHeartbeatInterval
+
+const (
+	websocketOpContinuation = 0x0
+	websocketOpText         = 0x1
+	websocketOpBinary       = 0x2
+	websocketOpClose        = 0x8
+	websocketOpPing         = 0x9
+	websocketOpPong         = 0xA
+)
+
+var errWebSocketMessageTooLarge = errors.New("websocket message too large")
+
+type websocketConn struct {
+	conn    net.Conn
+	br      *bufio.Reader
+	writeMu sync.Mutex
+}
+
+func headerContainsToken(h http.Header, name, token string) bool {
+	for _, v := range h.Values(name) {
+		for _, t := range strings.Split(v, ",") {
+			if strings.EqualFold(strings.TrimSpace(t), token) {
+				return true
+			}
+		}
+	}
+	return false
+}
+
+// upgradeWebSocket はハンドシェイクを行い、失敗した場合はレスポンスを書いてエラーを返す
+func upgradeWebSocket(w http.ResponseWriter, r *http.Request) (*websocketConn, error) {
+	if !headerContainsToken(r.Header, "Connection", "upgrade") || !headerContainsToken(r.Header, "Upgrade", "websocket") {
+		err := errors.New("websocket upgrade is required")
+		writeError(w, http.StatusBadRequest, err)
+		return nil, err
+	}
+	if r.Header.Get("Sec-WebSocket-Version") != "13" {
+		w.Header().Set("Sec-WebSocket-Version", "13")
+		err := errors.New("unsupported websocket version")
+		writeError(w, http.StatusUpgradeRequired, err)
+		return nil, err
+	}
+	key := r.Header.Get("Sec-WebSocket-Key")
+	if key == "" {
+		err := errors.New("Sec-WebSocket-Key is required")
+		writeError(w, http.StatusBadRequest, err)
+		return nil, err
+	}
+
+	hijacker, ok := w.(http.Hijacker)
+	if !ok {
+		err := errors.New("websocket is not supported")
+		writeError(w, http.StatusInternalServerError, err)
+		return nil, err
+	}
+	conn, rw, err := hijacker.Hijack()
+	if err != nil {
+		writeError(w, http.StatusInternalServerError, err)
+		return nil, err
+	}
+
+	h := sha1.New()
+	h.Write([]byte(key + websocketGUID))
+	accept := base64.StdEncoding.EncodeToString(h.Sum(nil))
+
+	conn.SetWriteDeadline(time.Now().Add(websocketWriteTimeout))
+	if _, err := rw.WriteString("HTTP/1.1 101 Switching Protocols\r\nUpgrade: websocket\r\nConnection: Upgrade\r\nSec-WebSocket-Accept: " + accept + "\r\n\r\n"); err != nil {
+		conn.Close()
+		return nil, err
+	}
+	if err := rw.Flush(); err != nil {
+		conn.Close()
+		return nil, err
+	}
+
+	return &websocketConn{conn: conn, br: rw.Reader}, nil
+}
+
+func (c *websocketConn) writeFrame(opcode byte, payload []byte) error {
+	c.writeMu.Lock()
+	defer c.writeMu.Unlock()
+
+	header := make([]byte, 2, 10)
+	header[0] = 0x80 | opcode
+	switch {
+	case len(payload) < 126:
+		header[1] = byte(len(payload))
+	case len(payload) <= 0xFFFF:
+		header[1] = 126
+		header = binary.BigEndian.AppendUint16(header, uint16(len(payload)))
+	default:
+		header[1] = 127
+		header = binary.BigEndian.AppendUint64(header, uint64(len(payload)))
+	}
+
+	c.conn.SetWriteDeadline(time.Now().Add(websocketWriteTimeout))
+	if _, err := c.conn.Write(append(header, payload...)); err != nil {
+		return err
+	}
+	return nil
+}
+
+func (c *websocketConn) writeJSON(v interface{}) error {
+	b, err := json.Marshal(v)
+	if err != nil {
+		return err
+	}
+	return c.writeFrame(websocketOpText, b)
+}
+
+func (c *websocketConn) ping() error {
+	return c.writeFrame(websocketOpPing, nil)
+}
+
+// readMessage はデータメッセージを1つ読む。制御フレームはここで処理する
+// クライアントが閉じた場合は io.EOF を返す。プロトコル違反は 1002 で閉じてエラーを返す
+func (c *websocketConn) readMessage() ([]byte, error) {
+	message := []byte{}
+	fragmented := false
+	for {
+		// ping への pong も届かなくなった接続はここで打ち切る
+		c.conn.SetReadDeadline(time.Now().Add(websocketReadTimeout))
+
+		var head [2]byte
+		if _, err := io.ReadFull(c.br, head[:]); err != nil {
+			return nil, err
+		}
+		fin := head[0]&0x80 != 0
+		opcode := head[0] & 0x0F
+		masked := head[1]&0x80 != 0
+		length := uint64(head[1] & 0x7F)
+
+		switch length {
+		case 126:
+			var ext [2]byte
+			if _, err := io.ReadFull(c.br, ext[:]); err != nil {
+				return nil, err
+			}
+			length = uint64(binary.BigEndian.Uint16(ext[:]))
+		case 127:
+			var ext [8]byte
+			if _, err := io.ReadFull(c.br, ext[:]); err != nil {
+				return nil, err
+			}
+			length = binary.BigEndian.Uint64(ext[:])
+		}
+		if head[0]&0x70 != 0 {
+			return nil, c.protocolError("websocket extensions are not supported")
+		}
+		if !masked {
+			return nil, c.protocolError("websocket client frame must be masked")
+		}
+
+		isControl := opcode&0x8 != 0
+		switch {
+		case isControl && (!fin || length > 125):
+			return nil, c.protocolError("websocket control frame must not be fragmented or longer than 125 bytes")
+		case opcode == websocketOpContinuation && !fragmented:
+			return nil, c.protocolError("unexpected websocket continuation frame")
+		case (opcode == websocketOpText || opcode == websocketOpBinary) && fragmented:
+			return nil, c.protocolError("websocket data frame in the middle of a fragmented message")
+		}
+
+		if length > websocketMaxMessageSize || uint64(len(message))+length > websocketMaxMessageSize {
+			c.writeFrame(websocketOpClose, []byte{0x03, 0xF1}) // 1009: Message Too Big
+			return nil, errWebSocketMessageTooLarge
+		}
+
+		var mask [4]byte
+		if _, err := io.ReadFull(c.br, mask[:]); err != nil {
+			return nil, err
+		}
+		payload := make([]byte, length)
+		if _, err := io.ReadFull(c.br, payload); err != nil {
+			return nil, err
+		}
+		for i := range payload {
+			payload[i] ^= mask[i%4]
+		}
+
+		switch opcode {
+		case websocketOpPing:
+			if err := c.writeFrame(websocketOpPong, payload); err != nil {
+				return nil, err
+			}
+		case websocketOpPong:
+		case websocketOpClose:
+			c.writeFrame(websocketOpClose, payload)
+			return nil, io.EOF
+		case websocketOpText, websocketOpBinary, websocketOpContinuation:
+			message = append(message, payload...)
+			if fin {
+				return message, nil
+			}
+			fragmented = true
+		default:
+			return nil, c.protocolError("unknown websocket opcode")
+		}
+	}
+}
+
+// protocolError は 1002: Protocol Error で閉じることを伝え、エラーを返す
+func (c *websocketConn) protocolError(message string) error {
+	c.writeFrame(websocketOpClose, []byte{0x03, 0xEA})
+	return errors.New(message)
+}
+
+// closeGoingAway はサーバーの停止で閉じることを伝える (1001: Going Away)
+func (c *websocketConn) closeGoingAway() error {
+	return c.writeFrame(websocketOpClose, []byte{0x03, 0xE9})
+}
+
+func (c *websocketConn) close() error {
+	return c.conn.Close()
+}
@@ -0,0 +1,141 @@
+package main
+
+import (
+	"bufio"
+	"bytes"
+	"encoding/binary"
+	"errors"
+	"io"
+	"net"
+	"testing"
+)
+
+// testWebSocketFrame はクライアントが送るマスク付きのフレームを組み立てる
+func testWebSocketFrame(fin bool, opcode byte, payload []byte) []byte {
+	b := opcode
+	if fin {
+		b |= 0x80
+	}
+	frame := []byte{b}
+	switch {
+	case len(payload) < 126:
+		frame = append(frame, 0x80|byte(len(payload)))
+	case len(payload) <= 0xFFFF:
+		frame = append(frame, 0x80|126)
+		frame = binary.BigEndian.AppendUint16(frame, uint16(len(payload)))
+	default:
+		frame = append(frame, 0x80|127)
+		frame = binary.BigEndian.AppendUint64(frame, uint64(len(payload)))
+	}
+	mask := [4]byte{0x12, 0x34, 0x56, 0x78}
+	frame = append(frame, mask[:]...)
+	for i, c := range payload {
+		frame = append(frame, c^mask[i%4])
+	}
+	return frame
+}
+
+func TestWebSocketReadMessage(t *testing.T) {
+	tests := []struct {
+		name    string
+		frames  [][]byte
+		want    string
+		wantErr error
+	}{
+		{
+			name:   "single text frame",
+			frames: [][]byte{testWebSocketFrame(true, websocketOpText, []byte("hello"))},
+			want:   "hello",
+		},
+		{
+			name: "fragmented message with interleaved ping",
+			frames: [][]byte{
+				testWebSocketFrame(false, websocketOpText, []byte("hel")),
+				testWebSocketFrame(true, websocketOpPing, []byte("p")),
+				testWebSocketFrame(true, websocketOpContinuation, []byte("lo")),
+			},
+			want: "hello",
+		},
+		{
+			name:   "extended length",
+			frames: [][]byte{testWebSocketFrame(true, websocketOpBinary, bytes.Repeat([]byte("a"), 300))},
+			want:   string(bytes.Repeat([]byte("a"), 300)),
+		},
+		{
+			name:    "close frame",
+			frames:  [][]byte{testWebSocketFrame(true, websocketOpClose, []byte{0x03, 0xE8})},
+			wantErr: io.EOF,
+		},
+		{
+			name:    "too large message",
+			frames:  [][]byte{testWebSocketFrame(true, websocketOpBinary, make([]byte, websocketMaxMessageSize+1))},
+			wantErr: errWebSocketMessageTooLarge,
+		},
+		{
+			name:    "unmasked frame",
+			frames:  [][]byte{{0x81, 0x01, 'a'}},
+			wantErr: errAnyWebSocketProtocol,
+		},
+		{
+			name:    "control frame longer than 125 bytes",
+			frames:  [][]byte{testWebSocketFrame(true, websocketOpPing, make([]byte, 126))},
+			wantErr: errAnyWebSocketProtocol,
+		},
+		{
+			name:    "fragmented control frame",
+			frames:  [][]byte{testWebSocketFrame(false, websocketOpPing, []byte("p"))},
+			wantErr: errAnyWebSocketProtocol,
+		},
+		{
+			name:    "continuation without a started message",
+			frames:  [][]byte{testWebSocketFrame(true, websocketOpContinuation, []byte("a"))},
+			wantErr: errAnyWebSocketProtocol,
+		},
+		{
+			name: "new data frame inside a fragmented message",
+			frames: [][]byte{
+				testWebSocketFrame(false, websocketOpText, []byte("a")),
+				testWebSocketFrame(true, websocketOpText, []byte("b")),
+			},
+			wantErr: errAnyWebSocketProtocol,
+		},
+		{
+			name:    "unknown opcode",
+			frames:  [][]byte{testWebSocketFrame(true, 0x3, nil)},
+			wantErr: errAnyWebSocketProtocol,
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			server, client := net.Pipe()
+			defer server.Close()
+			defer client.Close()
+			// サーバーが返す pong や close を読み捨てる
+			go io.Copy(io.Discard, client)
+
+			input := bytes.Join(tt.frames, nil)
+			conn := &websocketConn{conn: server, br: bufio.NewReader(bytes.NewReader(input))}
+			got, err := conn.readMessage()
+			switch {
+			case tt.wantErr == nil:
+				if err != nil {
+					t.Fatalf("readMessage() error = %v", err)
+				}
+				if string(got) != tt.want {
+					t.Errorf("readMessage() = %q, want %q", got, tt.want)
+				}
+			case tt.wantErr == errAnyWebSocketProtocol:
+				if err == nil || errors.Is(err, io.EOF) || errors.Is(err, io.ErrUnexpectedEOF) {
+					t.Errorf("readMessage() error = %v, want a protocol error", err)
+				}
+			default:
+				if !errors.Is(err, tt.wantErr) {
+					t.Errorf("readMessage() error = %v, want %v", err, tt.wantErr)
+				}
+			}
+		})
+	}
+}
+
+// errAnyWebSocketProtocol はプロトコル違反のエラーなら何でもよいことを表す
+var errAnyWebSocketProtocol = errors.New("any websocket protocol error")
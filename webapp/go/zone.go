@@ -0,0 +1,268 @@
+package main
+
+import (
+	"context"
+	"database/sql"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"os"
+	"sort"
+	"sync"
+)
+
+// 地域 (ゾーン) は多角形で表し、いずれかのゾーンに含まれる座標をサービス地域とする
+// ゾーンが1つもなければ ISUCON_SERVICE_AREA の範囲を、それも無ければどこでもサービス地域とみなす
+// ゾーンは zones テーブルから読む。ISUCON_ZONES_FILE が設定されていればそのファイルから読む
+
+var errOutOfServiceArea = errors.New("coordinate is out of the service area")
+
+// ゾーンの設定ファイルの場所。空なら zones テーブルを使う
+var zonesFile string
+
+type zoneConfig struct {
+	ID       string       `json:"id"`
+	Name     string       `json:"name"`
+	Polygon  []Coordinate `json:"polygon"`
+	Priority int          `json:"priority"`
+	// 未設定なら全体の運賃を使う
+	InitialFare     *int `json:"initial_fare"`
+	FarePerDistance *int `json:"fare_per_distance"`
+	// 乗車地からこの距離より遠い椅子はマッチングしない。未設定なら制限しない
+	MatchingRadius *int `json:"matching_radius"`
+}
+
+func (c *zoneConfig) validate() error {
+	if c.ID == "" || c.Name == "" {
+		return errors.New("required fields(id, name) are empty")
+	}
+	if len(c.Polygon) < 3 {
+		return fmt.Errorf("zone %s: polygon must have at least 3 vertices", c.ID)
+	}
+	if (c.InitialFare != nil && *c.InitialFare < 0) || (c.FarePerDistance != nil && *c.FarePerDistance < 0) || (c.MatchingRadius != nil && *c.MatchingRadius < 0) {
+		return fmt.Errorf("zone %s: initial_fare, fare_per_distance and matching_radius must not be negative", c.ID)
+	}
+	return nil
+}
+
+func newZoneConfig(zone *Zone) (zoneConfig, error) {
+	polygon := []Coordinate{}
+	if err := json.Unmarshal([]byte(zone.Polygon), &polygon); err != nil {
+		return zoneConfig{}, fmt.Errorf("zone %s: invalid polygon: %w", zone.ID, err)
+	}
+	return zoneConfig{
+		ID:              zone.ID,
+		Name:            zone.Name,
+		Polygon:         polygon,
+		Priority:        zone.Priority,
+		InitialFare:     zone.InitialFare,
+		FarePerDistance: zone.FarePerDistance,
+		MatchingRadius:  zone.MatchingRadius,
+	}, nil
+}
+
+var zoneCacheRWMutex = sync.RWMutex{}
+
+// 優先度の高い順。ゾーンが重なっている場合は先に見つかったものを使う
+var zoneCache []zoneConfig
+
+func loadZoneCache() error {
+	zones := []zoneConfig{}
+	if zonesFile != "" {
+		b, err := os.ReadFile(zonesFile)
+		if err != nil {
+			return err
+		}
+		if err := json.Unmarshal(b, &zones); err != nil {
+			return err
+		}
+	} else {
+		rows := []*Zone{}
+		if err := db.Select(&rows, "SELECT * FROM zones"); err != nil {
+			return err
+		}
+		for _, row := range rows {
+			zone, err := newZoneConfig(row)
+			if err != nil {
+				return err
+			}
+			zones = append(zones, zone)
+		}
+	}
+	for i := range zones {
+		if err := zones[i].validate(); err != nil {
+			return err
+		}
+	}
+
+	zoneCacheRWMutex.Lock()
+	defer zoneCacheRWMutex.Unlock()
+	zoneCache = zones
+	sortZoneCache()
+	return nil
+}
+
+func sortZoneCache() {
+	sort.SliceStable(zoneCache, func(i, j int) bool {
+		if zoneCache[i].Priority != zoneCache[j].Priority {
+			return zoneCache[i].Priority > zoneCache[j].Priority
+		}
+		return zoneCache[i].ID < zoneCache[j].ID
+	})
+}
+
+func insertZoneCache(zone zoneConfig) {
+	zoneCacheRWMutex.Lock()
+	defer zoneCacheRWMutex.Unlock()
+
+	for i := range zoneCache {
+		if zoneCache[i].ID == zone.ID {
+			zoneCache[i] = zone
+			sortZoneCache()
+			return
+		}
+	}
+	zoneCache = append(zoneCache, zone)
+	sortZoneCache()
+}
+
+func getZonesFromCache() []zoneConfig {
+	zoneCacheRWMutex.RLock()
+	defer zoneCacheRWMutex.RUnlock()
+
+	return append([]zoneConfig{}, zoneCache...)
+}
+
+func getZoneByIDFromCache(zoneID string) (zoneConfig, bool) {
+	zoneCacheRWMutex.RLock()
+	defer zoneCacheRWMutex.RUnlock()
+
+	for _, zone := range zoneCache {
+		if zone.ID == zoneID {
+			return zone, true
+		}
+	}
+	return zoneConfig{}, false
+}
+
+// findZone は座標を含むゾーンを返す。サービス地域の外なら ok は false
+// ゾーンが1つもなければ、zone は nil で ok は serviceArea に含まれるかを返す
+func findZone(c Coordinate) (*zoneConfig, bool) {
+	zoneCacheRWMutex.RLock()
+	defer zoneCacheRWMutex.RUnlock()
+
+	if len(zoneCache) == 0 {
+		return nil, serviceArea.contains(c)
+	}
+	for i := range zoneCache {
+		if polygonContains(zoneCache[i].Polygon, c) {
+			zone := zoneCache[i]
+			return &zone, true
+		}
+	}
+	return nil, false
+}
+
+// isInServiceArea は椅子の座標、乗車地、目的地のどれにも同じ基準で使う
+func isInServiceArea(c Coordinate) bool {
+	_, ok := findZone(c)
+	return ok
+}
+
+// polygonContains は点が多角形の内側か辺の上にあるかを返す
+func polygonContains(polygon []Coordinate, c Coordinate) bool {
+	inside := false
+	for i, j := 0, len(polygon)-1; i < len(polygon); j, i = i, i+1 {
+		a, b := polygon[i], polygon[j]
+		if isOnSegment(a, b, c) {
+			return true
+		}
+		if (a.Longitude > c.Longitude) != (b.Longitude > c.Longitude) {
+			// 辺と c を通る水平線の交点が c より大きい側にあるか
+			lhs := (c.Latitude - a.Latitude) * (b.Longitude - a.Longitude)
+			rhs := (b.Latitude - a.Latitude) * (c.Longitude - a.Longitude)
+			if (b.Longitude > a.Longitude && lhs < rhs) || (b.Longitude < a.Longitude && lhs > rhs) {
+				inside = !inside
+			}
+		}
+	}
+	return inside
+}
+
+func isOnSegment(a, b, c Coordinate) bool {
+	cross := (b.Latitude-a.Latitude)*(c.Longitude-a.Longitude) - (b.Longitude-a.Longitude)*(c.Latitude-a.Latitude)
+	if cross != 0 {
+		return false
+	}
+	return min(a.Latitude, b.Latitude) <= c.Latitude && c.Latitude <= max(a.Latitude, b.Latitude) &&
+		min(a.Longitude, b.Longitude) <= c.Longitude && c.Longitude <= max(a.Longitude, b.Longitude)
+}
+
+// fareRatesAt は乗車地のゾーンの初乗り運賃と距離あたりの運賃を返す
+func fareRatesAt(pickupLatitude, pickupLongitude int) (int, int) {
+	base, perDistance := initialFare, farePerDistance
+	zone, _ := findZone(Coordinate{Latitude: pickupLatitude, Longitude: pickupLongitude})
+	if zone == nil {
+		return base, perDistance
+	}
+	if zone.InitialFare != nil {
+		base = *zone.InitialFare
+	}
+	if zone.FarePerDistance != nil {
+		perDistance = *zone.FarePerDistance
+	}
+	return base, perDistance
+}
+
+// matchingRadiusForRide は乗車地のゾーンで決められたマッチングの距離の上限を返す
+func matchingRadiusForRide(ride *Ride) (int, bool) {
+	if !ride.PickupZoneID.Valid {
+		return 0, false
+	}
+	zone, ok := getZoneByIDFromCache(ride.PickupZoneID.String)
+	if !ok || zone.MatchingRadius == nil {
+		return 0, false
+	}
+	return *zone.MatchingRadius, true
+}
+
+// rideZoneIDs は乗車地と目的地のゾーンを返す。どちらかがサービス地域の外なら errOutOfServiceArea を返す
+func rideZoneIDs(pickup, destination Coordinate) (sql.NullString, sql.NullString, error) {
+	pickupZone, ok := findZone(pickup)
+	if !ok {
+		return sql.NullString{}, sql.NullString{}, fmt.Errorf("pickup_coordinate: %w", errOutOfServiceArea)
+	}
+	destinationZone, ok := findZone(destination)
+	if !ok {
+		return sql.NullString{}, sql.NullString{}, fmt.Errorf("destination_coordinate: %w", errOutOfServiceArea)
+	}
+
+	pickupZoneID, destinationZoneID := sql.NullString{}, sql.NullString{}
+	if pickupZone != nil {
+		pickupZoneID = sql.NullString{String: pickupZone.ID, Valid: true}
+	}
+	if destinationZone != nil {
+		destinationZoneID = sql.NullString{String: destinationZone.ID, Valid: true}
+	}
+	return pickupZoneID, destinationZoneID, nil
+}
+
+// upsertZone は zones テーブルに書き込み、キャッシュにも反映する
+func upsertZone(ctx context.Context, zone zoneConfig) error {
+	polygon, err := json.Marshal(zone.Polygon)
+	if err != nil {
+		return err
+	}
+	if _, err := db.ExecContext(
+		ctx,
+		`INSERT INTO zones (id, name, polygon, priority, initial_fare, fare_per_distance, matching_radius) VALUES (?, ?, ?, ?, ?, ?, ?)
+		ON DUPLICATE KEY UPDATE name = VALUES(name), polygon = VALUES(polygon), priority = VALUES(priority),
+			initial_fare = VALUES(initial_fare), fare_per_distance = VALUES(fare_per_distance), matching_radius = VALUES(matching_radius)`,
+		zone.ID, zone.Name, string(polygon), zone.Priority, zone.InitialFare, zone.FarePerDistance, zone.MatchingRadius,
+	); err != nil {
+		return err
+	}
+	insertZoneCache(zone)
+	publishCacheReloadToBus("zones")
+	return nil
+}
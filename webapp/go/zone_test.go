@@ -0,0 +1,63 @@
+package main
+
+import "testing"
+
+func TestPolygonContains(t *testing.T) {
+	square := []Coordinate{{Latitude: 0, Longitude: 0}, {Latitude: 10, Longitude: 0}, {Latitude: 10, Longitude: 10}, {Latitude: 0, Longitude: 10}}
+	// 右上が欠けた L 字
+	lShape := []Coordinate{{Latitude: 0, Longitude: 0}, {Latitude: 10, Longitude: 0}, {Latitude: 10, Longitude: 5}, {Latitude: 5, Longitude: 5}, {Latitude: 5, Longitude: 10}, {Latitude: 0, Longitude: 10}}
+	triangle := []Coordinate{{Latitude: 0, Longitude: 0}, {Latitude: 10, Longitude: 0}, {Latitude: 0, Longitude: 10}}
+
+	tests := []struct {
+		name    string
+		polygon []Coordinate
+		c       Coordinate
+		want    bool
+	}{
+		{name: "inside square", polygon: square, c: Coordinate{Latitude: 5, Longitude: 5}, want: true},
+		{name: "outside square", polygon: square, c: Coordinate{Latitude: 11, Longitude: 5}, want: false},
+		{name: "on square edge", polygon: square, c: Coordinate{Latitude: 10, Longitude: 3}, want: true},
+		{name: "on square vertex", polygon: square, c: Coordinate{Latitude: 0, Longitude: 0}, want: true},
+		{name: "beyond a vertex on the same line", polygon: square, c: Coordinate{Latitude: -1, Longitude: 0}, want: false},
+		{name: "inside concave part", polygon: lShape, c: Coordinate{Latitude: 2, Longitude: 8}, want: true},
+		{name: "in the notch of concave polygon", polygon: lShape, c: Coordinate{Latitude: 8, Longitude: 8}, want: false},
+		{name: "on the inner corner", polygon: lShape, c: Coordinate{Latitude: 5, Longitude: 5}, want: true},
+		{name: "inside triangle", polygon: triangle, c: Coordinate{Latitude: 2, Longitude: 2}, want: true},
+		{name: "on hypotenuse", polygon: triangle, c: Coordinate{Latitude: 5, Longitude: 5}, want: true},
+		{name: "outside hypotenuse", polygon: triangle, c: Coordinate{Latitude: 6, Longitude: 5}, want: false},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			if got := polygonContains(tt.polygon, tt.c); got != tt.want {
+				t.Errorf("polygonContains(%v) = %v, want %v", tt.c, got, tt.want)
+			}
+		})
+	}
+}
+
+func TestRideFareRates(t *testing.T) {
+	zoneInitialFare, zoneFarePerDistance := 300, 50
+	tests := []struct {
+		name string
+		ride Ride
+		want int
+	}{
+		{
+			name: "ride booked before fares were recorded uses the default rates",
+			ride: Ride{PickupLatitude: 0, PickupLongitude: 0, DestinationLatitude: 3, DestinationLongitude: 4},
+			want: initialFare + farePerDistance*7,
+		},
+		{
+			name: "ride keeps the rates at booking",
+			ride: Ride{PickupLatitude: 0, PickupLongitude: 0, DestinationLatitude: 3, DestinationLongitude: 4, InitialFare: &zoneInitialFare, FarePerDistance: &zoneFarePerDistance},
+			want: zoneInitialFare + zoneFarePerDistance*7,
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			if got := calculateFare(&tt.ride); got != tt.want {
+				t.Errorf("calculateFare() = %d, want %d", got, tt.want)
+			}
+		})
+	}
+}
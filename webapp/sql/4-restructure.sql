@@ -31,3 +31,234 @@ LEFT JOIN (SELECT chair_id,
 WHERE total_distance_updated_at IS NOT NULL;
 
 ALTER TABLE chairs ADD COLUMN is_free BOOLEAN NOT NULL DEFAULT 1 COMMENT '乗れるかどうか' AFTER is_active;
+
+DROP TABLE IF EXISTS coupon_campaigns;
+CREATE TABLE coupon_campaigns
+(
+  code        VARCHAR(255) NOT NULL COMMENT 'キャンペーンコード',
+  discount_type ENUM ('AMOUNT', 'PERCENT') NOT NULL DEFAULT 'AMOUNT' COMMENT '割引の種類',
+  discount    INTEGER      NOT NULL COMMENT '割引額(PERCENTの場合は割引率)',
+  max_discount INTEGER     NULL     COMMENT '割引額の上限',
+  min_fare    INTEGER      NULL     COMMENT '利用可能な最低運賃',
+  expires_at  DATETIME(6)  NULL     COMMENT '有効期限',
+  max_uses    INTEGER      NULL     COMMENT '最大発行数',
+  eligibility ENUM ('ALL', 'NEW_USERS', 'EXISTING_USERS') NOT NULL DEFAULT 'ALL' COMMENT '付与対象',
+  created_at  DATETIME(6)  NOT NULL DEFAULT CURRENT_TIMESTAMP(6) COMMENT '作成日時',
+  PRIMARY KEY (code)
+)
+  COMMENT = 'クーポンキャンペーンテーブル';
+
+INSERT INTO coupon_campaigns (code, discount, eligibility)
+VALUES ('CP_NEW2024', 3000, 'NEW_USERS'),
+       ('INV', 1500, 'NEW_USERS'),
+       ('RWD', 1000, 'ALL');
+
+ALTER TABLE coupons ADD COLUMN campaign_code VARCHAR(255) NULL COMMENT '発行元のキャンペーンコード' AFTER code;
+UPDATE coupons SET campaign_code = 'CP_NEW2024' WHERE code = 'CP_NEW2024';
+UPDATE coupons SET campaign_code = 'INV' WHERE code LIKE 'INV\_%';
+UPDATE coupons SET campaign_code = 'RWD' WHERE code LIKE 'RWD\_%';
+ALTER TABLE coupons ADD INDEX coupons_campaign_code_index (campaign_code);
+
+ALTER TABLE coupons ADD COLUMN discount_type ENUM ('AMOUNT', 'PERCENT') NOT NULL DEFAULT 'AMOUNT' COMMENT '割引の種類' AFTER campaign_code;
+ALTER TABLE coupons ADD COLUMN max_discount INTEGER NULL COMMENT '割引額の上限' AFTER discount;
+ALTER TABLE coupons ADD COLUMN min_fare INTEGER NULL COMMENT '利用可能な最低運賃' AFTER max_discount;
+ALTER TABLE coupons ADD COLUMN expires_at DATETIME(6) NULL COMMENT '有効期限' AFTER min_fare;
+
+ALTER TABLE users ADD COLUMN tier VARCHAR(30) NOT NULL DEFAULT 'STANDARD' COMMENT '会員ランク' AFTER invitation_code;
+
+DROP TABLE IF EXISTS referral_tiers;
+CREATE TABLE referral_tiers
+(
+  tier                  VARCHAR(30)  NOT NULL COMMENT '会員ランク',
+  max_referrals         INTEGER      NOT NULL COMMENT '招待コードの利用上限',
+  invitee_campaign_code VARCHAR(255) NOT NULL COMMENT '招待された側に付与するキャンペーン',
+  inviter_campaign_code VARCHAR(255) NOT NULL COMMENT '招待した側に付与するキャンペーン',
+  PRIMARY KEY (tier)
+)
+  COMMENT = '会員ランクごとの招待設定テーブル';
+
+INSERT INTO referral_tiers (tier, max_referrals, invitee_campaign_code, inviter_campaign_code)
+VALUES ('STANDARD', 3, 'INV', 'RWD');
+
+DROP TABLE IF EXISTS referrals;
+CREATE TABLE referrals
+(
+  invitee_id          VARCHAR(26)  NOT NULL COMMENT '招待されたユーザーのID',
+  inviter_id          VARCHAR(26)  NOT NULL COMMENT '招待したユーザーのID',
+  invitation_code     VARCHAR(30)  NOT NULL COMMENT '使われた招待コード',
+  invitee_coupon_code VARCHAR(255) NULL     COMMENT '招待された側に付与したクーポン',
+  inviter_coupon_code VARCHAR(255) NULL     COMMENT '招待した側に付与したクーポン',
+  created_at          DATETIME(6)  NOT NULL DEFAULT CURRENT_TIMESTAMP(6) COMMENT '招待日時',
+  PRIMARY KEY (invitee_id),
+  INDEX referrals_inviter_id_created_at_index (inviter_id, created_at)
+)
+  COMMENT = '招待履歴テーブル';
+
+-- 既存の招待は INV_ と RWD_ のクーポンを付与された順番に対応付けて移行する
+INSERT INTO referrals (invitee_id, inviter_id, invitation_code, invitee_coupon_code, inviter_coupon_code, created_at)
+SELECT inv.user_id, users.id, users.invitation_code, inv.code, rwd.code, inv.created_at
+FROM (SELECT user_id, code, created_at, SUBSTRING(code, 5) AS invitation_code,
+             ROW_NUMBER() OVER (PARTITION BY code ORDER BY created_at) AS n
+      FROM coupons
+      WHERE code LIKE 'INV\_%') inv
+JOIN users ON users.invitation_code = inv.invitation_code
+LEFT JOIN (SELECT code, SUBSTRING_INDEX(SUBSTRING(code, 5), '_', 1) AS invitation_code,
+                  ROW_NUMBER() OVER (PARTITION BY SUBSTRING_INDEX(SUBSTRING(code, 5), '_', 1) ORDER BY created_at) AS n
+           FROM coupons
+           WHERE code LIKE 'RWD\_%') rwd ON rwd.invitation_code = inv.invitation_code AND rwd.n = inv.n;
+
+DROP TABLE IF EXISTS owner_webhooks;
+CREATE TABLE owner_webhooks
+(
+  id         VARCHAR(26)   NOT NULL COMMENT 'Webhook ID',
+  owner_id   VARCHAR(26)   NOT NULL COMMENT 'オーナーID',
+  url        VARCHAR(2048) NOT NULL COMMENT '送信先URL',
+  secret     VARCHAR(255)  NOT NULL COMMENT '署名用の秘密鍵',
+  created_at DATETIME(6)   NOT NULL DEFAULT CURRENT_TIMESTAMP(6) COMMENT '登録日時',
+  PRIMARY KEY (id),
+  INDEX owner_webhooks_owner_id_index (owner_id)
+)
+  COMMENT = 'オーナーのWebhook登録テーブル';
+
+DROP TABLE IF EXISTS webhook_deliveries;
+CREATE TABLE webhook_deliveries
+(
+  id               VARCHAR(26)                              NOT NULL COMMENT '配信ID',
+  webhook_id       VARCHAR(26)                              NOT NULL COMMENT 'Webhook ID',
+  event_type       VARCHAR(50)                              NOT NULL COMMENT 'イベント種別',
+  payload          TEXT                                     NOT NULL COMMENT '送信した本文',
+  status           ENUM ('PENDING', 'SUCCEEDED', 'FAILED')  NOT NULL DEFAULT 'PENDING' COMMENT '配信状態',
+  attempts         INTEGER                                  NOT NULL DEFAULT 0 COMMENT '送信回数',
+  last_status_code INTEGER                                  NULL COMMENT '最後の送信のHTTPステータス',
+  last_error       TEXT                                     NULL COMMENT '最後の送信のエラー',
+  next_attempt_at  DATETIME(6)                              NULL COMMENT '次に送信する日時。PENDING の間だけ設定する',
+  created_at       DATETIME(6)                              NOT NULL DEFAULT CURRENT_TIMESTAMP(6) COMMENT '作成日時',
+  updated_at       DATETIME(6)                              NOT NULL DEFAULT CURRENT_TIMESTAMP(6) ON UPDATE CURRENT_TIMESTAMP(6) COMMENT '更新日時',
+  PRIMARY KEY (id),
+  INDEX webhook_deliveries_webhook_id_created_at_index (webhook_id, created_at),
+  INDEX webhook_deliveries_status_next_attempt_at_index (status, next_attempt_at)
+)
+  COMMENT = 'Webhookの配信履歴テーブル';
+
+DROP TABLE IF EXISTS notification_bus_events;
+CREATE TABLE notification_bus_events
+(
+  id             BIGINT       NOT NULL AUTO_INCREMENT COMMENT 'イベントID',
+  origin         VARCHAR(26)  NOT NULL COMMENT '発行したノードのID',
+  kind           VARCHAR(10)  NOT NULL COMMENT '宛先の種類 (app / chair)、送信済みの印 (sent_at) またはキャッシュの読み直し (reload)',
+  recipient_id   VARCHAR(26)  NOT NULL COMMENT 'ユーザーID、椅子ID、ライドIDまたはキャッシュの名前',
+  ride_status_id VARCHAR(26)  NOT NULL COMMENT 'ライドステータスID',
+  payload        BLOB         NOT NULL COMMENT '通知の本文',
+  created_at     DATETIME(6)  NOT NULL DEFAULT CURRENT_TIMESTAMP(6) COMMENT '発行日時',
+  PRIMARY KEY (id),
+  INDEX notification_bus_events_created_at_index (created_at)
+)
+  COMMENT = '複数台構成で通知を中継するテーブル';
+
+DROP TABLE IF EXISTS ride_metrics;
+CREATE TABLE ride_metrics
+(
+  ride_id           VARCHAR(26) NOT NULL COMMENT 'ライドID',
+  enroute_distance  INTEGER     NOT NULL DEFAULT 0 COMMENT '乗車地に向かう間の走行距離',
+  carrying_distance INTEGER     NOT NULL DEFAULT 0 COMMENT '乗客を乗せている間の走行距離',
+  matching_ms       BIGINT      NOT NULL DEFAULT 0 COMMENT 'MATCHING の時間 (ミリ秒)',
+  enroute_ms        BIGINT      NOT NULL DEFAULT 0 COMMENT 'ENROUTE の時間 (ミリ秒)',
+  pickup_ms         BIGINT      NOT NULL DEFAULT 0 COMMENT 'PICKUP の時間 (ミリ秒)',
+  carrying_ms       BIGINT      NOT NULL DEFAULT 0 COMMENT 'CARRYING の時間 (ミリ秒)',
+  arrived_ms        BIGINT      NOT NULL DEFAULT 0 COMMENT 'ARRIVED の時間 (ミリ秒)',
+  PRIMARY KEY (ride_id)
+)
+  COMMENT = 'ライドごとの走行距離と所要時間テーブル';
+
+DROP TABLE IF EXISTS chair_flags;
+CREATE TABLE chair_flags
+(
+  chair_id   VARCHAR(26)  NOT NULL COMMENT '椅子ID',
+  reason     VARCHAR(30)  NOT NULL COMMENT '印を付けた理由',
+  latitude   INTEGER      NOT NULL COMMENT '検出したときの緯度',
+  longitude  INTEGER      NOT NULL COMMENT '検出したときの経度',
+  distance   INTEGER      NOT NULL COMMENT '前回の座標からの移動距離',
+  elapsed_ms BIGINT       NOT NULL COMMENT '前回の座標からの経過時間 (ミリ秒)',
+  created_at DATETIME(6)  NOT NULL COMMENT '印を付けた日時',
+  PRIMARY KEY (chair_id)
+)
+  COMMENT = 'マッチングから外す椅子テーブル';
+
+DROP TABLE IF EXISTS ride_geofence_events;
+CREATE TABLE ride_geofence_events
+(
+  id         VARCHAR(26) NOT NULL COMMENT 'イベントID',
+  ride_id    VARCHAR(26) NOT NULL COMMENT 'ライドID',
+  chair_id   VARCHAR(26) NOT NULL COMMENT '椅子ID',
+  fence      ENUM ('PICKUP', 'DESTINATION') NOT NULL COMMENT '範囲の種類',
+  event      ENUM ('ENTER', 'EXIT') NOT NULL COMMENT '入った / 出た',
+  latitude   INTEGER     NOT NULL COMMENT '緯度',
+  longitude  INTEGER     NOT NULL COMMENT '経度',
+  created_at DATETIME(6) NOT NULL COMMENT '発生日時',
+  PRIMARY KEY (id),
+  INDEX ride_geofence_events_ride_id_created_at_index (ride_id, created_at)
+)
+  COMMENT = '乗車地・目的地の範囲の出入りテーブル';
+
+DROP TABLE IF EXISTS zones;
+CREATE TABLE zones
+(
+  id                VARCHAR(26)  NOT NULL COMMENT 'ゾーンID',
+  name              VARCHAR(255) NOT NULL COMMENT 'ゾーン名',
+  polygon           JSON         NOT NULL COMMENT '範囲を表す多角形の頂点',
+  priority          INTEGER      NOT NULL DEFAULT 0 COMMENT '重なっている場合に優先する順 (大きいほど優先)',
+  initial_fare      INTEGER      NULL COMMENT '初乗り運賃。NULL なら全体の運賃',
+  fare_per_distance INTEGER      NULL COMMENT '距離あたりの運賃。NULL なら全体の運賃',
+  matching_radius   INTEGER      NULL COMMENT 'マッチングする椅子との距離の上限。NULL なら制限しない',
+  created_at        DATETIME(6)  NOT NULL DEFAULT CURRENT_TIMESTAMP(6) COMMENT '登録日時',
+  PRIMARY KEY (id)
+)
+  COMMENT = 'ゾーンテーブル';
+
+ALTER TABLE rides ADD COLUMN pickup_zone_id VARCHAR(26) NULL COMMENT '乗車地のゾーンID';
+ALTER TABLE rides ADD COLUMN destination_zone_id VARCHAR(26) NULL COMMENT '目的地のゾーンID';
+ALTER TABLE rides ADD COLUMN initial_fare INTEGER NULL COMMENT '予約時の初乗り運賃。NULL なら全体の運賃';
+ALTER TABLE rides ADD COLUMN fare_per_distance INTEGER NULL COMMENT '予約時の距離あたりの運賃。NULL なら全体の運賃';
+
+DROP TABLE IF EXISTS chair_schedules;
+CREATE TABLE chair_schedules
+(
+  chair_id     VARCHAR(26) NOT NULL COMMENT '椅子ID',
+  day_of_week  TINYINT     NOT NULL COMMENT '曜日 (0 が日曜日)',
+  start_minute SMALLINT    NOT NULL COMMENT '稼働を始める時刻 (0 時からの分)',
+  end_minute   SMALLINT    NOT NULL COMMENT '稼働を終える時刻 (0 時からの分、この時刻は含まない)',
+  created_at   DATETIME(6) NOT NULL DEFAULT CURRENT_TIMESTAMP(6) COMMENT '登録日時',
+  PRIMARY KEY (chair_id, day_of_week, start_minute)
+)
+  COMMENT = '椅子の週ごとの稼働時間テーブル';
+
+DROP TABLE IF EXISTS chair_schedule_applied;
+CREATE TABLE chair_schedule_applied
+(
+  chair_id   VARCHAR(26) NOT NULL COMMENT '椅子ID',
+  is_active  TINYINT(1)  NOT NULL COMMENT '最後に稼働時間から決めた稼働状態',
+  updated_at DATETIME(6) NOT NULL DEFAULT CURRENT_TIMESTAMP(6) ON UPDATE CURRENT_TIMESTAMP(6) COMMENT '更新日時',
+  PRIMARY KEY (chair_id)
+)
+  COMMENT = '稼働時間から最後に決めた椅子の稼働状態テーブル';
+
+DROP TABLE IF EXISTS chair_liveness;
+CREATE TABLE chair_liveness
+(
+  chair_id     VARCHAR(26) NOT NULL COMMENT '椅子ID',
+  last_seen_at DATETIME(6) NOT NULL COMMENT 'いずれかのノードが最後に椅子を見た日時',
+  PRIMARY KEY (chair_id),
+  INDEX chair_liveness_last_seen_at_index (last_seen_at)
+)
+  COMMENT = '複数台構成で共有する椅子の生存確認テーブル';
+
+DROP TABLE IF EXISTS chair_conditions;
+CREATE TABLE chair_conditions
+(
+  chair_id          VARCHAR(26) NOT NULL COMMENT '椅子ID',
+  battery           INTEGER     NULL COMMENT '電池残量 (%)。NULL なら不明',
+  maintenance_flags JSON        NOT NULL COMMENT '整備が必要な箇所',
+  updated_at        DATETIME(6) NOT NULL COMMENT '更新日時',
+  PRIMARY KEY (chair_id)
+)
+  COMMENT = '椅子の状態テーブル';